@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"errors"
@@ -13,9 +12,11 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -25,6 +26,8 @@ import (
 
 const (
 	HttpPanicMessage = "http: panic serving"
+	// DefaultDrainTimeout 等待被取代的实例处理完请求和连接的默认最长时间
+	DefaultDrainTimeout = 30 * time.Second
 )
 
 var (
@@ -33,61 +36,75 @@ var (
 	findPackage  = regexp.MustCompile(`:[\s]*cannot find package "([^"]+)" in any of:`)
 	findPackage2 = regexp.MustCompile(`:[\s]*unrecognized import path "([^"]+)"[\s]*\(`)
 	movePackage  = regexp.MustCompile(`can't load package: package [^:]+: code in directory ([^\s]+) expects import "([^"]+)"`)
+
+	// regexBuildPackageLine 匹配 go build -v 输出的包名
+	regexBuildPackageLine = regexp.MustCompile(`(?m)^[\w\-.~]+(/[\w\-.~]+)*\n`)
 )
 
 type App struct {
-	OfflineMode         bool
-	Cmds                map[string]*exec.Cmd
 	RunParams           []string
 	BuildParams         []string
 	MainFile            string
-	Port                string
-	Ports               map[string]int64
 	BuildDir            string
 	Name                string
 	Root                string
 	keyPressListened    bool
-	LastError           string
 	PortParamName       string //端口参数名称(用于指定应用程序监听的端口，例如：webx.exe -p 8080，这里的-p就是端口参数名)
-	SwitchToNewPort     bool
 	DisabledBuild       bool
 	BeforeBuildGenerate bool
-	BuildStart          *sync.Once
-	AppRestart          *sync.Once
 	DisabledLogRequest  bool
 	PkgMirrors          map[string]string
 	Env                 []string
-
-	portBinFiles map[string]string
-	buildErr     error
-	startErr     error
-	restartErr   error
-	_goVersion   string
-	ctx          context.Context
-}
-
-type StderrCapturer struct {
-	app *App
+	EnvFiles            []string //按顺序读取的 .env 文件，后面的覆盖前面的，都覆盖 Env
+	PanicDetectors      []*PanicDetector
+	Requests            *RequestTracker
+	BuildLog            *BuildProgress
+	Logs                *AppLog
+	SlowRequest         time.Duration //慢请求阈值(0为不检测)
+	PprofPath           string        //应用的 pprof goroutine 接口路径
+	HangSigquit         bool          //无法通过 pprof 获取 goroutine 信息时是否发送 SIGQUIT
+	SocketActivation    bool          //由 tower 创建监听端口并通过 LISTEN_FDS 传给应用
+	DrainTimeout        time.Duration //停止被取代的实例前等待请求和连接结束的最长时间
+	StdinPassthrough    bool          //将标准输入转发给应用，不再读取控制台命令
+	Console             *Console
+	State               *StateFile    //记录正在运行的实例，用于清理 tower 被强制结束后遗留的进程
+	Replicas            int           //同时提供服务的实例数量，大于 1 时由代理进行负载均衡
+	IdleTimeout         time.Duration //超过此时间没有请求时停止应用(0为不停止)，下一个请求到达时重新启动
+	Limits              ResourceLimits
+	ReloadSignal        os.Signal   //管理接口默认发送给实例的信号
+	ForwardSignals      []os.Signal //tower 收到时转发给实例的信号
+
+	mu          sync.RWMutex
+	port        string              //当前提供服务的端口
+	serving     []string            //所有提供服务的实例的端口(第一个为 port)
+	ports       map[string]struct{} //可用的端口
+	kernelPort  bool                //由操作系统分配端口
+	instanceSeq atomic.Int64
+	instances   map[string]*Instance //各端口上最近启动的实例
+	building    *Instance
+	buildErr    error
+	subscribers []*instanceSubscriber
+	startCall   singleCall
+	restartCall singleCall
+	_goVersion  string
+	binName     string //最近一次编译生成的可执行文件名，为空时使用 AppBin
+	depsMu      sync.Mutex
+	deps        map[string]struct{} //main 依赖的包所在的目录，为空时重新获取
+	lastRequest atomic.Int64        //最近一次请求的时间(UnixNano)
+	idle        atomic.Bool         //是否因为空闲而停止
+	idleMu      sync.Mutex
+	wakeCall    singleCall
+	envMu       sync.Mutex
+	env         []EnvVar //Env 和 EnvFiles 合并后的环境变量
+	ctx         context.Context
 }
 
-func (a StderrCapturer) Write(p []byte) (n int, err error) {
-	s := string(p)
-	httpError := strings.Contains(s, HttpPanicMessage)
-
-	if httpError {
-		a.app.LastError = s
-		os.Stdout.Write([]byte("----------- Application Error -----------\n"))
-		n, err = os.Stdout.Write(p)
-		os.Stdout.Write([]byte("-----------------------------------------\n"))
-	} else {
-		n, err = os.Stdout.Write(p)
-	}
-	return
+type instanceSubscriber struct {
+	fn func(InstanceEvent)
 }
 
-func NewApp(ctx context.Context, mainFile, port, buildDir, portParamName string) (app App) {
-	app.ctx = ctx
-	app.Cmds = make(map[string]*exec.Cmd)
+func NewApp(ctx context.Context, mainFile, port, buildDir, portParamName string) (app *App) {
+	app = &App{ctx: ctx}
 	goPath := os.Getenv(`GOPATH`)
 	if len(goPath) > 0 && !strings.HasSuffix(mainFile, `.go`) {
 		var err error
@@ -101,105 +118,267 @@ func NewApp(ctx context.Context, mainFile, port, buildDir, portParamName string)
 	}
 	app.BuildDir = buildDir
 	app.PortParamName = portParamName
+	app.instances = make(map[string]*Instance)
+	app.DrainTimeout = DefaultDrainTimeout
 	app.ParseMutiPort(port)
-	app.Port = app.UseRandPort()
+	app.port = app.UseRandPort()
 	wd, _ := os.Getwd()
 	app.Name = filepath.Base(wd)
 	app.Root = filepath.Dir(mainFile)
-	app.BuildStart = &sync.Once{}
-	app.AppRestart = &sync.Once{}
-	app.portBinFiles = make(map[string]string)
+	app.Requests = NewRequestTracker()
+	app.BuildLog = NewBuildProgress()
+	app.Logs = NewAppLog(os.Stdout)
+	app.Console = NewConsole(app)
 	app.PkgMirrors = make(map[string]string)
 	app.RunParams = []string{}
 	app.BuildParams = []string{}
 	return
 }
 
+// Port returns the port of the instance that is serving requests.
+func (a *App) Port() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.port
+}
+
 func (a *App) DisabledVisitPort() bool {
-	return len(a.Port) == 0 || len(a.PortParamName) == 0
+	return len(a.Port()) == 0 || !a.canSetPort()
 }
 
+// canSetPort 能否指定应用监听的端口(通过端口参数名、socket activation 或者 params/env 中的 {{.Port}})
+func (a *App) canSetPort() bool {
+	if len(a.PortParamName) > 0 || a.SocketActivation {
+		return true
+	}
+	for _, v := range a.RunParams {
+		if strings.Contains(v, PortTemplateVar) {
+			return true
+		}
+	}
+	for _, v := range a.Env {
+		if strings.Contains(v, PortTemplateVar) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMutiPort 解析端口列表，"0" 表示由操作系统分配端口
 func (a *App) ParseMutiPort(port string) {
 	p := strings.Split(port, `,`)
-	a.Ports = make(map[string]int64)
+	a.ports = make(map[string]struct{})
+	a.kernelPort = false
 	for _, v := range p {
+		v = strings.TrimSpace(v)
+		if v == `0` {
+			a.kernelPort = true
+			continue
+		}
 		r := strings.Split(v, `-`)
 		if len(r) > 1 {
 			i, _ := strconv.Atoi(r[0])
 			j, _ := strconv.Atoi(r[1])
 			for ; i <= j; i++ {
 				port := fmt.Sprintf("%v", i)
-				a.Ports[port] = 0
+				a.ports[port] = struct{}{}
 			}
 		} else {
-			a.Ports[r[0]] = 0
+			a.ports[r[0]] = struct{}{}
 		}
 	}
 }
 
 func (a *App) SupportMutiPort() bool {
-	return a.Ports != nil && len(a.Ports) > 1 && a.PortParamName != ``
+	return (len(a.ports) > 1 || a.kernelPort) && a.canSetPort()
 }
 
-func (a *App) UseRandPort() string {
-	var lastRunTime []int64
-	lastRunPorts := make(map[int64]string, 0)
-	for port, runningTime := range a.Ports {
-		if runningTime == 0 || a.IsRunning(port) == false || isFreePort(port) {
+// UseRandPort 返回一个没有实例在运行并且可以监听的端口(不包括 excludePorts)，如果都不可用则返回最早启动的实例的端口
+func (a *App) UseRandPort(excludePorts ...string) string {
+	if a.kernelPort {
+		port, err := kernelFreePort()
+		if err == nil && !slices.Contains(excludePorts, port) {
 			return port
 		}
-		lastRunTime = append(lastRunTime, runningTime)
-		lastRunPorts[runningTime] = port
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	// 优先使用从未使用过或者最久以前使用的端口，避免代理复用到已退出的实例的连接
+	var (
+		free, oldest         string
+		freeTime, oldestTime time.Time
+	)
+	for port := range a.ports {
+		if slices.Contains(excludePorts, port) {
+			continue
+		}
+		inst := a.instances[port]
+		if inst.Running() {
+			if len(oldest) == 0 || inst.Created.Before(oldestTime) {
+				oldest = port
+				oldestTime = inst.Created
+			}
+			continue
+		}
+		var used time.Time
+		if inst != nil {
+			used = inst.Created
+		}
+		if (len(free) == 0 || used.Before(freeTime)) && isFreePort(port) {
+			free = port
+			freeTime = used
+		}
+	}
+	if len(free) > 0 {
+		return free
 	}
-	quickSort(lastRunTime, 0, len(lastRunTime)-1)
-	for _, runningTime := range lastRunTime {
-		return lastRunPorts[runningTime]
+	if len(oldest) > 0 {
+		return oldest
 	}
-	return a.Port
+	return a.port
 }
 
-func (a *App) Start(ctx context.Context, build bool, args ...string) error {
-	a.BuildStart.Do(func() {
-		if build {
-			a.buildErr = a.Build()
-			if a.buildErr != nil {
-				log.Error("== Fail to build " + a.Name + ": " + a.buildErr.Error())
-				a.startErr = a.buildErr
-				a.BuildStart = &sync.Once{}
+// Subscribe registers fn to be called after every state transition of the app instances.
+// fn is called synchronously and must not block.
+func (a *App) Subscribe(fn func(InstanceEvent)) (unsubscribe func()) {
+	sub := &instanceSubscriber{fn: fn}
+	a.mu.Lock()
+	a.subscribers = append(a.subscribers, sub)
+	a.mu.Unlock()
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		for i, s := range a.subscribers {
+			if s == sub {
+				a.subscribers = append(a.subscribers[:i:i], a.subscribers[i+1:]...)
 				return
 			}
 		}
-		port := a.Port
+	}
+}
+
+func (a *App) publish(event InstanceEvent) {
+	a.mu.RLock()
+	subscribers := a.subscribers
+	a.mu.RUnlock()
+	for _, sub := range subscribers {
+		sub.fn(event)
+	}
+}
+
+// Instance returns the latest instance started on the port (default: the serving port).
+func (a *App) Instance(args ...string) *Instance {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	port := a.port
+	if len(args) > 0 {
+		port = args[0]
+	}
+	return a.instances[port]
+}
+
+// Instances returns the latest instance of every port and the instance being built.
+func (a *App) Instances() []*Instance {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	instances := make([]*Instance, 0, len(a.instances)+1)
+	if a.building != nil {
+		instances = append(instances, a.building)
+	}
+	for _, inst := range a.instances {
+		instances = append(instances, inst)
+	}
+	return instances
+}
+
+// BuildError returns the error of the last build.
+func (a *App) BuildError() error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.buildErr
+}
+
+// Start 编译(build 为 true 时)并运行应用。并发的调用会合并为一次
+func (a *App) Start(ctx context.Context, build bool, args ...string) error {
+	return a.startCall.Do(func() error {
+		port := a.Port()
 		if len(args) > 0 {
 			port = args[0]
 		}
-		a.startErr = a.Run(port)
-		if a.startErr != nil {
-			a.startErr = errors.New("== Fail to run " + a.Name + ": " + a.startErr.Error())
-			a.BuildStart = &sync.Once{}
-			return
-		}
-		a.RestartOnReturn(ctx)
-		a.BuildStart = &sync.Once{}
+		a.BuildLog.Begin()
+		err := a.start(ctx, build, port)
+		a.BuildLog.End(err)
+		return err
 	})
+}
 
-	return a.startErr
+func (a *App) start(ctx context.Context, build bool, port string) error {
+	inst := newInstance(a, port, StateBuilding)
+	if build && !a.DisabledBuild {
+		a.mu.Lock()
+		a.building = inst
+		a.mu.Unlock()
+		inst.app.publish(InstanceEvent{Instance: inst, To: StateBuilding, Time: time.Now()})
+		err := a.Build()
+		a.mu.Lock()
+		a.building = nil
+		a.buildErr = err
+		a.mu.Unlock()
+		if err != nil {
+			log.Error("== Fail to build " + a.Name + ": " + err.Error())
+			inst.transition(StateStopped)
+			return err
+		}
+	}
+	var err error
+	if a.Replicas > 1 && a.SupportMutiPort() {
+		ports := a.replicaPorts(port)
+		instances := []*Instance{inst}
+		for _, p := range ports[1:] {
+			instances = append(instances, newInstance(a, p, StateBuilding))
+		}
+		a.BuildLog.Println(`Starting at ports ` + strings.Join(ports, `, `))
+		err = a.runReplicas(instances)
+	} else {
+		a.BuildLog.Println(`Starting at port ` + port)
+		err = a.run(inst)
+	}
+	if err != nil {
+		return errors.New("== Fail to run " + a.Name + ": " + err.Error())
+	}
+	a.BuildLog.Println(`Ready`)
+	a.touch()
+	a.idle.Store(false)
+	a.ListenConsole(ctx)
+	return nil
 }
 
+// Busy 是否正在编译、启动或者重启
+func (a *App) Busy() bool {
+	return a.startCall.Running() || a.restartCall.Running()
+}
+
+// Restart 等待所有实例进行中的请求和连接结束(最长 DrainTimeout)并停止它们，然后重新编译运行。并发的调用会合并为一次
 func (a *App) Restart(ctx context.Context) error {
-	a.AppRestart.Do(func() {
+	return a.restartCall.Do(func() error {
 		log.Warn(`== Restart the application.`)
+		a.drainAll()
 		a.Clean()
-		a.Stop(a.Port)
-		a.restartErr = a.Start(ctx, true)
-		a.AppRestart = &sync.Once{} // Assign new Once to allow calling Start again.
+		a.Stop(a.Port())
+		return a.Start(ctx, true)
 	})
-
-	return a.restartErr
 }
 
 func (a *App) BinFile(args ...string) (f string) {
 	binFileName := AppBin
+	a.mu.RLock()
+	if len(a.binName) > 0 {
+		binFileName = a.binName
+	}
+	a.mu.RUnlock()
 	if len(args) > 0 {
 		binFileName = args[0]
 	}
@@ -215,196 +394,310 @@ func (a *App) BinFile(args ...string) (f string) {
 }
 
 func (a *App) Stop(port string, args ...string) {
-	if !a.IsRunning(port) {
+	inst := a.Instance(port)
+	if !inst.Running() {
 		return
 	}
 	log.Info("== Stopping " + a.Name)
-	cmd := a.GetCmd(port)
-	if cmd == nil || cmd.Process == nil {
-		return
-	}
-	err := cmd.Process.Kill()
+	err := inst.kill()
 	if err != nil {
 		log.Error(err)
 	}
-	cmd = nil
-	if port == a.Port && a.DisabledBuild {
+	if port == a.Port() && a.DisabledBuild {
 		return
 	}
-	bin := a.BinFile(args...)
-	err = os.Remove(bin)
+	bin := inst.BinFile
+	if len(args) > 0 {
+		bin = a.BinFile(args...)
+	}
+	removeBinFile(bin, time.Second, false)
+}
+
+func (a *App) Clean(excludePorts ...string) {
+	excludePort := a.Port()
+	if len(excludePorts) > 0 {
+		excludePort = excludePorts[0]
+	}
+	for _, inst := range a.otherInstances(excludePort) {
+		log.Info("== Stopping app at port: " + inst.Port)
+		err := inst.kill()
+		if err != nil {
+			log.Error(err)
+		}
+		if len(inst.BinFile) > 0 {
+			removeBinFile(inst.BinFile, time.Second, true)
+		}
+	}
+}
+
+// otherInstances 返回 excludePorts 以外正在运行的实例
+func (a *App) otherInstances(excludePorts ...string) (instances []*Instance) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for port, inst := range a.instances {
+		if slices.Contains(excludePorts, port) || !inst.Running() {
+			continue
+		}
+		instances = append(instances, inst)
+	}
+	return
+}
+
+// drain 在后台停止 excludePorts 以外的实例: 等待它们进行中的请求和连接结束后再停止
+func (a *App) drain(excludePorts ...string) {
+	for _, inst := range a.otherInstances(excludePorts...) {
+		go func(inst *Instance) {
+			inst.drain(a.DrainTimeout)
+			log.Info("== Stopping app at port: " + inst.Port)
+			err := inst.kill()
+			if err != nil {
+				log.Error(err)
+			}
+			if len(inst.BinFile) > 0 {
+				removeBinFile(inst.BinFile, time.Second, true)
+			}
+		}(inst)
+	}
+}
+
+// drainAll 等待所有正在运行的实例进行中的请求和连接结束，最长等待 DrainTimeout
+func (a *App) drainAll() {
+	var wg sync.WaitGroup
+	for _, inst := range a.otherInstances() {
+		wg.Add(1)
+		go func(inst *Instance) {
+			defer wg.Done()
+			inst.drain(a.DrainTimeout)
+		}(inst)
+	}
+	wg.Wait()
+}
+
+// removeBinFile 删除可执行文件，失败时(例如进程尚未完全退出)在后台重试
+func removeBinFile(bin string, interval time.Duration, backoff bool) {
+	err := os.Remove(bin)
 	if err == nil || os.IsNotExist(err) {
-		a.Ports[port] = 0
 		return
 	}
 	go func() {
 		for i := 0; i < 10; i++ {
-			time.Sleep(time.Second)
-			err = os.Remove(bin)
+			if backoff {
+				time.Sleep(interval * time.Duration(i+1))
+			} else {
+				time.Sleep(interval)
+			}
+			err := os.Remove(bin)
 			if err != nil {
 				if os.IsNotExist(err) {
-					a.Ports[port] = 0
 					return
 				}
 				log.Error(err)
 			} else {
 				log.Info(`== Remove ` + bin + `: Success.`)
-				a.Ports[port] = 0
 				return
 			}
 		}
 	}()
 }
 
-func (a *App) Clean(excludePorts ...string) {
-	excludePort := a.Port
-	if len(excludePorts) > 0 {
-		excludePort = excludePorts[0]
-	}
-	for port, cmd := range a.Cmds {
-		if port == excludePort || !CmdIsRunning(cmd) {
-			continue
-		}
-		if cmd == nil || cmd.Process == nil {
-			continue
-		}
-		log.Info("== Stopping app at port: " + port)
-		err := cmd.Process.Kill()
-		if err != nil {
-			log.Error(err)
-		}
-		cmd = nil
-		if bin, ok := a.portBinFiles[port]; ok && bin != "" {
-			err := os.Remove(bin)
-			if err == nil || os.IsNotExist(err) {
-				a.Ports[port] = 0
-				continue
-			}
-			go func(port string) {
-				for i := 0; i < 10; i++ {
-					time.Sleep(time.Second * time.Duration(i+1))
-					err = os.Remove(bin)
-					if err != nil {
-						if os.IsNotExist(err) {
-							a.Ports[port] = 0
-							return
-						}
-						log.Error(err)
-					} else {
-						log.Info(`== Remove ` + bin + `: Success.`)
-						a.Ports[port] = 0
-						return
-					}
-				}
-			}(port)
-		}
+// LastCrash returns the crash information of the app instance if it exited unexpectedly.
+func (a *App) LastCrash(args ...string) *AppCrash {
+	return a.Instance(args...).Crash()
+}
+
+// WaitCrash waits up to timeout for the app instance to exit and returns its crash information.
+func (a *App) WaitCrash(timeout time.Duration, args ...string) *AppCrash {
+	inst := a.Instance(args...)
+	if inst == nil || inst.stderr == nil {
+		return nil
 	}
+	return inst.stderr.Wait(timeout)
 }
 
-func (a *App) GetCmd(args ...string) (cmd *exec.Cmd) {
-	var port string
-	if len(args) > 0 {
-		port = args[0]
-	} else {
-		port = a.Port
+func (a *App) Run(port string) (err error) {
+	return a.run(newInstance(a, port, StateBuilding))
+}
+
+func (a *App) run(inst *Instance) (err error) {
+	previous, err := a.launch(inst)
+	if err != nil {
+		return
 	}
-	cmd = a.Cmds[port]
-	return
+	a.serve([]*Instance{inst}, previous)
+	return nil
 }
 
-func (a *App) SetCmd(port string, cmd *exec.Cmd) {
-	a.Cmds[port] = cmd
+// runReplicas 同时启动多个实例，全部就绪后一起切换。任何一个启动失败时停止新启动的实例，原来的实例继续提供服务
+func (a *App) runReplicas(instances []*Instance) error {
+	errs := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for i, inst := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = a.launch(inst)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		for _, inst := range instances {
+			if inst.Running() {
+				inst.kill()
+			}
+		}
+		return err
+	}
+	a.serve(instances, nil)
+	return nil
 }
 
-func (a *App) Run(port string) (err error) {
+// launch 启动实例并等待它就绪，返回同一端口上之前的实例
+func (a *App) launch(inst *Instance) (previous *Instance, err error) {
+	port := inst.Port
 	bin := a.BinFile()
 	_, err = os.Stat(bin)
 	if err != nil {
+		inst.transition(StateStopped)
 		return
 	}
-	ableSwitch := true
+	inst.BinFile = bin
+	inst.BuildID = strings.TrimSuffix(strings.TrimPrefix(filepath.Base(bin), BinPrefix), `.exe`)
 	disabledVisitPort := a.DisabledVisitPort()
 	if !disabledVisitPort {
 		log.Info("== Running at port " + port + ": " + a.Name)
-		ableSwitch = a.Port != port
-		a.Port = port //记录被使用的端口，避免下次使用
 	} else {
 		log.Info("== Running " + a.Name)
-		cmd := a.GetCmd(port)
-		bin := a.portBinFiles[port]
-		if cmd != nil && len(bin) > 0 {
-			defer func() {
-				if !CmdIsRunning(cmd) {
-					return
-				}
-				if cmd == nil || cmd.Process == nil {
-					return
-				}
-				log.Info("== Stopping app: " + bin)
-				err := cmd.Process.Kill()
-				if err != nil {
-					log.Error(err)
-				}
-				err = os.Remove(bin)
-				if err == nil || os.IsNotExist(err) {
-					return
-				}
+	}
 
-				go func() {
-					for i := 0; i < 10; i++ {
-						time.Sleep(time.Second * time.Duration(i+1))
-						err = os.Remove(bin)
-						if err != nil {
-							if os.IsNotExist(err) {
-								return
-							}
-							log.Error(err)
-						} else {
-							log.Info(`== Remove ` + bin + `: Success.`)
-							return
-						}
-					}
-				}()
-			}()
-		}
-	}
-
-	var cmd *exec.Cmd
-	a.portBinFiles[port] = bin
-	a.Ports[port] = time.Now().Unix()
+	vars := inst.templateVars()
 	params := []string{}
-	if !disabledVisitPort && a.SupportMutiPort() {
+	if !disabledVisitPort && a.SupportMutiPort() && len(a.PortParamName) > 0 && !a.SocketActivation {
 		params = append(params, com.ParseArgs(a.PortParamName)...)
 		params = append(params, port)
 	}
-	params = append(params, a.RunParams...)
-	cmd = exec.CommandContext(a.ctx, bin, params...)
-	a.SetCmd(a.Port, cmd)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = StderrCapturer{a}
-	cmd.Env = append(os.Environ(), a.Env...)
-	var hasError bool
-	go func() {
-		err := cmd.Run()
+	params = append(params, expandTemplates(a.RunParams, vars)...)
+	var (
+		cmd      *exec.Cmd
+		listener *os.File
+	)
+	if a.SocketActivation {
+		cmd, listener, err = a.socketActivationCommand(port, bin, params)
 		if err != nil {
-			if a.Port == port {
-				log.Error(`== cmd.Run Error:`, err)
-			}
-			hasError = true
+			inst.transition(StateStopped)
+			return
 		}
-	}()
+	} else {
+		cmd = exec.CommandContext(a.ctx, bin, params...)
+	}
+	stdout := a.Logs.Writer(inst, StreamStdout)
+	stderr := NewStderrCapturer(a, port)
+	stderr.out = a.Logs.Writer(inst, StreamStderr)
+	inst.output = []*LogWriter{stdout, stderr.out}
+	// echo 等框架的 panic 恢复中间件会输出到 stdout
+	cmd.Stdout = &PanicScanWriter{w: stdout, scanner: NewPanicScanner(a, port)}
+	cmd.Stderr = stderr
+	if a.StdinPassthrough {
+		inst.stdin, err = cmd.StdinPipe()
+		if err != nil {
+			inst.transition(StateStopped)
+			return
+		}
+	}
+	cmd.Env = append(os.Environ(), vars.Environ()...)
+	if a.SocketActivation {
+		cmd.Env = append(cmd.Env, socketActivationEnv...)
+	}
+	cmd.Env = append(cmd.Env, expandTemplates(a.environ(), vars)...)
+
+	a.mu.Lock()
+	previous = a.instances[port]
+	a.instances[port] = inst
+	a.mu.Unlock()
+	err = inst.start(cmd, stderr)
+	if listener != nil {
+		// 子进程已经继承了监听端口
+		listener.Close()
+	}
+	if err != nil {
+		return
+	}
+	a.applyRlimits(inst)
 	if !disabledVisitPort {
-		err = dialAddress("127.0.0.1:"+a.Port, 60, func() bool {
-			return !hasError
-		})
+		alive := func() bool {
+			return !inst.Exited()
+		}
+		if a.SocketActivation {
+			// 监听端口由 tower 创建，可以连接不代表应用已经就绪，需要等待应用返回响应
+			err = waitHTTPResponse("127.0.0.1:"+port, 60, alive)
+		} else {
+			err = dialAddress("127.0.0.1:"+port, 60, alive)
+		}
+		if err == nil && inst.Exited() {
+			err = errors.New(`the application exited before listening on port ` + port)
+		}
+		if err != nil {
+			return
+		}
+	}
+	if !inst.transition(StateReady) {
+		return previous, errors.New(`the application exited before it was ready`)
+	}
+	return previous, nil
+}
+
+// serve 将请求切换到已经就绪的实例，并停止被取代的实例
+func (a *App) serve(instances []*Instance, previous *Instance) {
+	ports := make([]string, len(instances))
+	for i, inst := range instances {
+		ports[i] = inst.Port
 	}
-	if err == nil && ableSwitch {
-		a.SwitchToNewPort = true
-		if a.OfflineMode {
-			a.Clean()
+	port := ports[0]
+	a.mu.Lock()
+	oldPort := a.port
+	a.port = port
+	a.serving = ports
+	a.mu.Unlock()
+	if oldPort != port || len(ports) > 1 {
+		log.Info(`== Switch port: `, oldPort, ` => `, strings.Join(ports, `,`))
+		a.drain(ports...)
+	} else if previous != nil && previous.Running() {
+		// 不支持切换端口时，新的实例启动后再停止旧的实例
+		log.Info("== Stopping app: " + previous.BinFile)
+		err := previous.kill()
+		if err != nil {
+			log.Error(err)
+		}
+		if previous.BinFile != instances[0].BinFile {
+			removeBinFile(previous.BinFile, time.Second, true)
 		}
 	}
-	return
+}
+
+// Serving returns the running instances that serve requests, in the order of replicas.
+func (a *App) Serving() []*Instance {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	instances := make([]*Instance, 0, len(a.serving))
+	for _, port := range a.serving {
+		if inst := a.instances[port]; inst.Running() {
+			instances = append(instances, inst)
+		}
+	}
+	return instances
+}
+
+// replicaPorts 返回 Replicas 个实例使用的端口，第一个为 port。可用的端口不足时返回的数量会少于 Replicas
+func (a *App) replicaPorts(port string) []string {
+	ports := []string{port}
+	for len(ports) < a.Replicas {
+		p := a.UseRandPort(ports...)
+		if slices.Contains(ports, p) || a.IsRunning(p) {
+			log.Warnf(`== Not enough free ports for %d replicas, running %d`, a.Replicas, len(ports))
+			break
+		}
+		ports = append(ports, p)
+	}
+	return ports
 }
 
 func (a *App) fetchPkg(matches [][]string, isRetry bool, args ...string) bool {
@@ -454,7 +747,7 @@ func (a *App) fetchPkg(matches [][]string, isRetry bool, args ...string) bool {
 		cmd.Stdin = os.Stdin
 		cmd.Stderr = os.Stderr
 		cmd.Stdout = os.Stdout
-		cmd.Env = append(os.Environ(), a.Env...)
+		cmd.Env = append(os.Environ(), a.environ()...)
 		err := cmd.Run()
 		if err != nil && !isRetry {
 			matches2 := findPackage2.FindAllStringSubmatch(err.Error(), -1)
@@ -532,23 +825,33 @@ func (a *App) Build() (err error) {
 		return nil
 	}
 	log.Info("== Building " + a.Name)
-	AppBin = BinPrefix + strconv.FormatInt(time.Now().Unix(), 10)
+	a.mu.Lock()
+	a.binName = BinPrefix + nextBuildID()
+	a.mu.Unlock()
+	a.depsMu.Lock()
+	a.deps = nil
+	a.depsMu.Unlock()
 	build := func() (string, error) {
 		if a.BeforeBuildGenerate {
 			cmd := exec.CommandContext(a.ctx, "go", "generate")
+			a.BuildLog.Println(`go generate`)
+			cmd.Stdout = a.BuildLog
+			cmd.Stderr = a.BuildLog
 			cmd.Run()
 		}
-		args := []string{"build"}
+		// -v 输出正在编译的包，用于在编译中页面显示进度
+		args := []string{"build", "-v"}
 		args = append(args, a.BuildParams...)
 		binFile := a.BinFile()
 		args = append(args, []string{"-o", binFile, a.MainFile}...)
 		cmd := exec.CommandContext(a.ctx, "go", args...)
+		a.BuildLog.Println(`go ` + strings.Join(args, ` `))
 		var b bytes.Buffer
-		cmd.Stderr = &b
+		cmd.Stderr = io.MultiWriter(&b, a.BuildLog)
 		cmd.Stdout = os.Stdout
-		cmd.Env = append(os.Environ(), a.Env...)
+		cmd.Env = append(os.Environ(), a.environ()...)
 		err := cmd.Run()
-		out := b.String()
+		out := regexBuildPackageLine.ReplaceAllString(b.String(), ``)
 		if com.FileExists(binFile) {
 			log.ForceCreateSymlink(binFile, filepath.Dir(binFile)+string(filepath.Separator)+BinPrefix+`latest`)
 		}
@@ -576,59 +879,144 @@ func (a *App) Build() (err error) {
 	return nil
 }
 
-func (a *App) IsRunning(args ...string) bool {
-	return CmdIsRunning(a.GetCmd(args...))
+var lastBuildID atomic.Int64
+
+// nextBuildID 返回编译 ID(Unix 时间戳)。同一秒内多次编译(例如多个服务)时递增，避免可执行文件重名
+func nextBuildID() string {
+	for {
+		last := lastBuildID.Load()
+		id := max(time.Now().Unix(), last+1)
+		if lastBuildID.CompareAndSwap(last, id) {
+			return strconv.FormatInt(id, 10)
+		}
+	}
 }
 
-func CmdIsRunning(cmd *exec.Cmd) bool {
-	return cmd != nil && cmd.ProcessState == nil
+// DependsOn 文件的更改是否会影响应用: 用于多个服务共享代码时只重新编译受影响的服务。
+// 只判断 .go 文件(是否属于 main 依赖的包)，其它文件和无法获取依赖时返回 true
+func (a *App) DependsOn(file string) bool {
+	if !strings.HasSuffix(file, `.go`) {
+		return true
+	}
+	a.depsMu.Lock()
+	defer a.depsMu.Unlock()
+	if a.deps == nil {
+		deps, err := a.listDeps()
+		if err != nil {
+			log.Warn(`== Failed to list the packages of `+a.Name+`: `, err)
+			return true
+		}
+		a.deps = deps
+	}
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return true
+	}
+	_, ok := a.deps[dir]
+	return ok
 }
 
-func CmdIsQuit(cmd *exec.Cmd) bool {
-	return cmd != nil && cmd.ProcessState != nil
+// listDeps 返回 main 及其依赖的包所在的目录
+func (a *App) listDeps() (map[string]struct{}, error) {
+	cmd := exec.CommandContext(a.ctx, `go`, `list`, `-deps`, `-f`, `{{.Dir}}`, a.MainFile)
+	cmd.Env = append(os.Environ(), a.environ()...)
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			err = errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	deps := make(map[string]struct{})
+	for _, dir := range strings.Split(string(out), "\n") {
+		if dir = strings.TrimSpace(dir); len(dir) > 0 {
+			deps[dir] = struct{}{}
+		}
+	}
+	return deps, nil
+}
+
+func (a *App) IsRunning(args ...string) bool {
+	return a.Instance(args...).Running()
 }
 
 func (a *App) IsQuit(args ...string) bool {
-	return CmdIsQuit(a.GetCmd(args...))
+	return a.Instance(args...).Exited()
 }
 
-func (a *App) RestartOnReturn(ctx context.Context) {
-	if a.keyPressListened {
+// IsCrashing 实例是否已经输出了 panic 或 fatal error(进程可能尚未退出)
+func (a *App) IsCrashing(args ...string) bool {
+	inst := a.Instance(args...)
+	return inst != nil && inst.stderr != nil && inst.stderr.Crashing()
+}
+
+// ListenConsole 从标准输入读取控制台命令(或转发给应用)，并在收到 "^C" 信号时停止应用
+func (a *App) ListenConsole(ctx context.Context) {
+	if a.keyPressListened || a.Console.App != a {
+		// apps 中的其它服务由第一个服务的控制台统一处理
 		return
 	}
 	a.keyPressListened = true
 
-	// Listen to keypress of "return" and restart the app automatically
 	go func() {
-		in := bufio.NewReader(os.Stdin)
-		for {
-			input, err := in.ReadString('\n')
-			if err != nil && err != io.EOF {
-				log.Error(`watchingSignal:`, err.Error())
-				return
-			}
-			if input == "\n" {
-				a.Restart(ctx)
-			}
+		if a.StdinPassthrough {
+			a.forwardStdin()
+			return
 		}
+		a.Console.Run(ctx, os.Stdin)
 	}()
 
 	// Listen to "^C" signal and stop the app properly
 	go func() {
 		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-		defer func() {
+		defer signal.Stop(sig)
+		select {
+		case <-sig: // wait for the "^C" signal
 			fmt.Println("")
-			a.Stop(a.Port)
-			os.Exit(0)
-		}()
-		for {
-			select {
-			case <-sig: // wait for the "^C" signal
-				return
-			case <-ctx.Done():
-				return
-			}
+			a.Shutdown()
+		case <-ctx.Done():
+			a.Close()
 		}
 	}()
 }
+
+// forwardStdin 将标准输入转发给当前提供服务的实例
+func (a *App) forwardStdin() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			if inst := a.Instance(); inst != nil && inst.stdin != nil {
+				if _, err := inst.stdin.Write(buf[:n]); err != nil {
+					log.Debug(`== Forward stdin: `, err)
+				}
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Error(`== Forward stdin: `, err)
+			}
+			return
+		}
+	}
+}
+
+// Shutdown 停止所有实例并退出
+func (a *App) Shutdown() {
+	a.Close()
+	log.Close()
+	os.Exit(0)
+}
+
+// Close 停止所有实例和 sidecar 并关闭状态文件
+func (a *App) Close() {
+	log.Info(`== Shutting down`)
+	for _, app := range a.Console.Apps() {
+		app.Clean()
+		app.Stop(app.Port())
+	}
+	a.Console.Sidecars.Stop()
+	a.State.Close()
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+const (
+	// AppLogLines 内存中保留的应用输出行数
+	AppLogLines = 2000
+	// AppLogDir 应用输出日志文件所在的目录
+	AppLogDir = `.tower/logs`
+	// AppLogFileMaxSize 日志文件超过此大小后轮转
+	AppLogFileMaxSize = 10 * 1024 * 1024
+	// AppLogFileBackups 保留的轮转日志文件数量(app.log.1 ~ app.log.N)
+	AppLogFileBackups = 5
+	// appLogEventBuffer 每个订阅者缓冲的行数，订阅者处理不及时的时候新的行会被丢弃
+	appLogEventBuffer = 256
+)
+
+const (
+	StreamStdout = `stdout`
+	StreamStderr = `stderr`
+)
+
+// LogLine 是应用实例输出的一行
+type LogLine struct {
+	Seq      int64
+	Time     time.Time
+	Instance string
+	Port     string
+	BuildID  string
+	Stream   string
+	Text     string
+	Source   string //输出来自的 sidecar，为空时来自应用实例
+}
+
+// Prefix 标明输出来自哪个实例或 sidecar，例如: "[6001 1700000000] "、"[minio] "
+func (l LogLine) Prefix() string {
+	if len(l.Source) > 0 {
+		return `[` + l.Source + `] `
+	}
+	return `[` + l.Port + ` ` + l.BuildID + `] `
+}
+
+func (l LogLine) String() string {
+	return l.Prefix() + l.Text
+}
+
+// LogFilter 按端口、实例 ID 或 sidecar 名称筛选输出，为空时不筛选
+type LogFilter struct {
+	Port     string
+	Instance string
+	Source   string
+}
+
+func (f LogFilter) Match(l LogLine) bool {
+	if len(f.Source) > 0 && f.Source != l.Source {
+		return false
+	}
+	if len(f.Port) > 0 && f.Port != l.Port {
+		return false
+	}
+	if len(f.Instance) > 0 && f.Instance != l.Instance {
+		return false
+	}
+	return true
+}
+
+// AppLog 保存所有实例最近的输出，同时输出到终端、日志文件(可选)和订阅者
+type AppLog struct {
+	mu          sync.Mutex
+	ring        []LogLine //环形缓冲区，seq 对应的行保存在 ring[(seq-1)%AppLogLines]
+	seq         int64
+	out         io.Writer
+	file        *rotateFile
+	subscribers map[chan LogLine]struct{}
+	Formatter   *LogFormatter //为空时原样输出到终端
+}
+
+func NewAppLog(out io.Writer) *AppLog {
+	return &AppLog{
+		out:         out,
+		subscribers: make(map[chan LogLine]struct{}),
+	}
+}
+
+// OpenFile 将输出写入 dir 下的 app.log，文件超过 AppLogFileMaxSize 后轮转
+func (l *AppLog) OpenFile(dir string) error {
+	f, err := openRotateFile(filepath.Join(dir, `app.log`), AppLogFileMaxSize, AppLogFileBackups)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.file = f
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *AppLog) Add(line LogLine) {
+	l.add(line, l.Formatter.Parse(line.Text))
+}
+
+// add 记录一行输出，rec 不为空时在终端显示美化后的日志记录
+func (l *AppLog) add(line LogLine, rec *LogRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	line.Seq = l.seq
+	if len(l.ring) < AppLogLines {
+		l.ring = append(l.ring, line)
+	} else {
+		l.ring[(line.Seq-1)%AppLogLines] = line
+	}
+	if l.out != nil {
+		if rec == nil {
+			io.WriteString(l.out, line.String()+"\n")
+		} else if l.Formatter.Visible(rec) {
+			io.WriteString(l.out, line.Prefix()+l.Formatter.Pretty(rec)+"\n")
+		}
+	}
+	if l.file != nil {
+		l.file.WriteString(line.Time.Format(`2006-01-02 15:04:05.000 `) + line.String() + "\n")
+	}
+	for ch := range l.subscribers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// Seq returns the sequence number of the last line.
+func (l *AppLog) Seq() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// Lines 返回符合条件的最后 tail 行(tail 为 0 时返回全部)
+func (l *AppLog) Lines(filter LogFilter, tail int) []LogLine {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.filter(filter, 0, tail)
+}
+
+// Subscribe 返回序号大于 since 的符合条件的输出(最多 tail 行)和后续的输出
+func (l *AppLog) Subscribe(filter LogFilter, since int64, tail int) (lines []LogLine, events <-chan LogLine, cancel func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lines = l.filter(filter, since, tail)
+	ch := make(chan LogLine, appLogEventBuffer)
+	l.subscribers[ch] = struct{}{}
+	return lines, ch, func() {
+		l.mu.Lock()
+		delete(l.subscribers, ch)
+		l.mu.Unlock()
+	}
+}
+
+// filter 按顺序返回序号大于 since 的符合条件的最后 tail 行
+func (l *AppLog) filter(filter LogFilter, since int64, tail int) (result []LogLine) {
+	first := l.seq - int64(len(l.ring)) + 1
+	if since >= first {
+		first = since + 1
+	}
+	for seq := first; seq <= l.seq; seq++ {
+		line := l.ring[(seq-1)%AppLogLines]
+		if filter.Match(line) {
+			result = append(result, line)
+		}
+	}
+	if tail > 0 && len(result) > tail {
+		result = result[len(result)-tail:]
+	}
+	return
+}
+
+// Writer 返回记录实例 stdout 或 stderr 输出的 io.Writer，输出按行记录
+func (l *AppLog) Writer(inst *Instance, stream string) *LogWriter {
+	return &LogWriter{log: l, inst: inst, stream: stream}
+}
+
+// SourceWriter 返回记录 sidecar 输出的 io.Writer，输出按行记录
+func (l *AppLog) SourceWriter(source string, stream string) *LogWriter {
+	return &LogWriter{log: l, source: source, stream: stream}
+}
+
+// LogWriter 将实例或 sidecar 的输出按行加入 AppLog
+type LogWriter struct {
+	log     *AppLog
+	inst    *Instance
+	source  string
+	stream  string
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *LogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.add(string(bytes.TrimSuffix(w.partial[:i], []byte{'\r'})))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush 记录最后一行没有换行符的输出
+func (w *LogWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.add(string(w.partial))
+		w.partial = nil
+	}
+}
+
+func (w *LogWriter) add(text string) {
+	rec := w.log.Formatter.Parse(text)
+	line := LogLine{
+		Time:   time.Now(),
+		Stream: w.stream,
+		Text:   text,
+		Source: w.source,
+	}
+	if w.inst != nil {
+		line.Instance = w.inst.ID
+		line.Port = w.inst.Port
+		line.BuildID = w.inst.BuildID
+	}
+	w.log.add(line, rec)
+	if rec == nil || w.inst == nil || w.inst.app == nil {
+		return
+	}
+	// 带有调用栈的错误日志作为应用错误显示在错误页面
+	if report := rec.ErrorReport(); len(report) > 0 {
+		w.inst.app.Requests.Report(w.inst.Port, report)
+		log.Warn(`== Error with stack logged at port `, w.inst.Port)
+	}
+}
+
+// rotateFile 是按大小轮转的日志文件
+type rotateFile struct {
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func openRotateFile(path string, maxSize int64, backups int) (*rotateFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f := &rotateFile{path: path, maxSize: maxSize, backups: backups}
+	return f, f.open()
+}
+
+func (f *rotateFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = fi.Size()
+	return nil
+}
+
+func (f *rotateFile) WriteString(s string) (int, error) {
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.size+int64(len(s)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			log.Error(`== Rotate log file: `, err)
+			return 0, err
+		}
+	}
+	n, err := f.file.WriteString(s)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate app.log => app.log.1, app.log.1 => app.log.2 ...
+func (f *rotateFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	for i := f.backups - 1; i > 0; i-- {
+		os.Rename(f.path+`.`+strconv.Itoa(i), f.path+`.`+strconv.Itoa(i+1))
+	}
+	if f.backups > 0 {
+		os.Rename(f.path, f.path+`.1`)
+	} else {
+		os.Remove(f.path)
+	}
+	return f.open()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppLog(t *testing.T) {
+	logs := NewAppLog(nil)
+	a := &Instance{ID: `1`, Port: `6001`, BuildID: `100`}
+	b := &Instance{ID: `2`, Port: `6002`, BuildID: `200`}
+	wa := logs.Writer(a, StreamStdout)
+	wb := logs.Writer(b, StreamStderr)
+	wa.Write([]byte("hello\r\nwor"))
+	wb.Write([]byte("oops\n"))
+	wa.Write([]byte("ld\npartial"))
+	lines := logs.Lines(LogFilter{}, 0)
+	assert.Len(t, lines, 3)
+	assert.Equal(t, `[6001 100] hello`, lines[0].String())
+	assert.Equal(t, `[6002 200] oops`, lines[1].String())
+	assert.Equal(t, StreamStderr, lines[1].Stream)
+	assert.Equal(t, `world`, lines[2].Text)
+	wa.Flush()
+	lines = logs.Lines(LogFilter{Port: `6001`}, 0)
+	assert.Len(t, lines, 3)
+	assert.Equal(t, `partial`, lines[2].Text)
+	assert.Len(t, logs.Lines(LogFilter{Instance: `2`}, 0), 1)
+	assert.Equal(t, int64(4), logs.Lines(LogFilter{}, 1)[0].Seq)
+
+	lines, events, cancel := logs.Subscribe(LogFilter{}, 2, 0)
+	defer cancel()
+	assert.Len(t, lines, 2)
+	assert.Equal(t, int64(3), lines[0].Seq)
+	wb.Write([]byte("next\n"))
+	select {
+	case line := <-events:
+		assert.Equal(t, int64(5), line.Seq)
+	case <-time.After(time.Second):
+		t.Fatal(`no event`)
+	}
+
+	// 环形缓冲区只保留最后 AppLogLines 行
+	for i := 0; i < AppLogLines; i++ {
+		wa.Write([]byte(strconv.Itoa(i) + "\n"))
+	}
+	lines = logs.Lines(LogFilter{}, 0)
+	assert.Len(t, lines, AppLogLines)
+	assert.Equal(t, `0`, lines[0].Text)
+	assert.Equal(t, strconv.Itoa(AppLogLines-1), lines[len(lines)-1].Text)
+	assert.Len(t, logs.Lines(LogFilter{Port: `6002`}, 0), 0)
+
+	dir := t.TempDir()
+	f, err := openRotateFile(dir+`/app.log`, 10, 2)
+	assert.NoError(t, err)
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		_, err = f.WriteString(s)
+		assert.NoError(t, err)
+	}
+	for name, expected := range map[string]string{`app.log`: "dddddd\n", `app.log.1`: "cccccc\n", `app.log.2`: "bbbbbb\n"} {
+		b, err := os.ReadFile(dir + `/` + name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(b))
+	}
+	_, err = os.Stat(dir + `/app.log.3`)
+	assert.True(t, os.IsNotExist(err))
+}
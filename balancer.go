@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/webx-top/reverseproxy"
+)
+
+const (
+	BalanceRoundRobin = `round-robin`       // 依次转发给每个实例
+	BalanceLeastConn  = `least-connections` // 转发给进行中的请求和连接最少的实例
+	BalanceSticky     = `sticky`            // 根据 cookie 转发给同一个实例，没有 cookie 时依次分配
+	// StickyCookieName 记录 sticky 负载均衡分配的实例序号的 cookie
+	StickyCookieName = `tower_replica`
+)
+
+// IsBalanceStrategy 是否是支持的负载均衡方式
+func IsBalanceStrategy(strategy string) bool {
+	switch strategy {
+	case BalanceRoundRobin, BalanceLeastConn, BalanceSticky:
+		return true
+	}
+	return false
+}
+
+// Balancer 在多个实例(app.replicas)之间分配请求
+type Balancer struct {
+	Strategy string
+	next     atomic.Uint64
+}
+
+// Choose 返回处理请求的实例及其序号。cookie 不为空时需要在响应中设置此 cookie(sticky)
+func (b *Balancer) Choose(ctx reverseproxy.Context, instances []*Instance) (inst *Instance, idx int, cookie string) {
+	switch len(instances) {
+	case 0:
+		return nil, 0, ``
+	case 1:
+		return instances[0], 0, ``
+	}
+	switch b.Strategy {
+	case BalanceLeastConn:
+		for i, v := range instances {
+			if inst == nil || v.InFlight() < inst.InFlight() {
+				inst, idx = v, i
+			}
+		}
+		return
+	case BalanceSticky:
+		if i, ok := stickyReplica(ctx); ok && i < len(instances) {
+			return instances[i], i, ``
+		}
+		idx = b.roundRobin(len(instances))
+		cookie = (&http.Cookie{
+			Name:     StickyCookieName,
+			Value:    strconv.Itoa(idx),
+			Path:     `/`,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}).String()
+		return instances[idx], idx, cookie
+	default:
+		idx = b.roundRobin(len(instances))
+		return instances[idx], idx, ``
+	}
+}
+
+func (b *Balancer) roundRobin(n int) int {
+	return int((b.next.Add(1) - 1) % uint64(n))
+}
+
+// stickyReplica 返回请求的 cookie 中记录的实例序号
+func stickyReplica(ctx reverseproxy.Context) (int, bool) {
+	req := &http.Request{Header: http.Header{`Cookie`: {requestHeader(ctx, `Cookie`)}}}
+	c, err := req.Cookie(StickyCookieName)
+	if err != nil {
+		return 0, false
+	}
+	i, err := strconv.Atoi(c.Value)
+	return i, err == nil && i >= 0
+}
+
+// backendHandoff 将 ResponseBefore 中选中的服务和实例传给紧接着在同一个请求中调用的 ChooseBackend
+// (ChooseBackend 只能获得 host，fast 引擎在 ResponseBefore 之前就取得了 host)。
+// 两种引擎都在执行 ResponseBefore 的 goroutine 中调用 ChooseBackend，因此按 goroutine 保存每个请求的选择
+type backendHandoff struct {
+	choices sync.Map // goroutine ID => *backendChoice
+}
+
+type backendChoice struct {
+	proxy   *Proxy //处理请求的服务(apps)
+	backend string //转发给其它服务器(proxy.routes 的 url)时为它的地址
+	inst    *Instance
+	idx     int
+	len     int
+}
+
+func newBackendHandoff() *backendHandoff {
+	return &backendHandoff{}
+}
+
+// Put 保存当前请求选中的实例，替换同一个 goroutine 之前没有被取走的选择
+func (h *backendHandoff) Put(choice *backendChoice) {
+	h.choices.Store(goroutineID(), choice)
+}
+
+// Take 取走当前请求的选择，没有时返回 nil
+func (h *backendHandoff) Take() *backendChoice {
+	if v, ok := h.choices.LoadAndDelete(goroutineID()); ok {
+		return v.(*backendChoice)
+	}
+	return nil
+}
+
+// goroutineID 返回当前 goroutine 的 ID，从 runtime.Stack 的第一行 "goroutine 18 [running]:" 中获取
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte(`goroutine `))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/webx-top/reverseproxy"
+)
+
+func TestBalancer(t *testing.T) {
+	app := NewApp(context.Background(), `main.go`, `6001-6003`, ``, ``)
+	var instances []*Instance
+	for _, port := range []string{`6001`, `6002`, `6003`} {
+		inst := newInstance(app, port, StateBuilding)
+		inst.transition(StateStarting)
+		inst.transition(StateReady)
+		instances = append(instances, inst)
+	}
+	ctx := &reverseproxy.NativeResponse{Request: httptest.NewRequest(`GET`, `/`, nil)}
+
+	b := &Balancer{Strategy: BalanceRoundRobin}
+	var ports []string
+	for i := 0; i < 4; i++ {
+		inst, idx, cookie := b.Choose(ctx, instances)
+		assert.Equal(t, i%3, idx)
+		assert.Empty(t, cookie)
+		ports = append(ports, inst.Port)
+	}
+	assert.Equal(t, []string{`6001`, `6002`, `6003`, `6001`}, ports)
+
+	b = &Balancer{Strategy: BalanceLeastConn}
+	instances[0].Acquire()
+	instances[1].Acquire()
+	inst, idx, _ := b.Choose(ctx, instances)
+	assert.Equal(t, `6003`, inst.Port)
+	assert.Equal(t, 2, idx)
+
+	b = &Balancer{Strategy: BalanceSticky}
+	b.Choose(ctx, instances)
+	inst, idx, cookie := b.Choose(ctx, instances)
+	assert.Equal(t, 1, idx)
+	assert.Contains(t, cookie, StickyCookieName+`=1`)
+	ctx.Request.Header.Set(`Cookie`, `a=b; `+StickyCookieName+`=2`)
+	for i := 0; i < 3; i++ {
+		inst, idx, cookie = b.Choose(ctx, instances)
+		assert.Equal(t, `6003`, inst.Port)
+		assert.Empty(t, cookie)
+	}
+	ctx.Request.Header.Set(`Cookie`, StickyCookieName+`=9`) // fewer replicas than before
+	_, _, cookie = b.Choose(ctx, instances)
+	assert.NotEmpty(t, cookie)
+
+	h := newBackendHandoff()
+	assert.Nil(t, h.Take())
+	h.Put(&backendChoice{inst: instances[1], idx: 1, len: 3})
+	assert.Equal(t, instances[1], h.Take().inst)
+	h.Put(nil)                    // not taken
+	h.Put(&backendChoice{idx: 2}) // replaces the stale choice
+	assert.Equal(t, 2, h.Take().idx)
+	assert.Nil(t, h.Take())
+
+	// 每个 goroutine 只能取走自己保存的选择
+	h.Put(&backendChoice{idx: 1})
+	done := make(chan *backendChoice)
+	go func() {
+		done <- h.Take()
+	}()
+	assert.Nil(t, <-done)
+	assert.Equal(t, 1, h.Take().idx)
+}
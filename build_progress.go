@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+const (
+	// BuildProgressMaxLines 编译中页面最多保留的输出行数
+	BuildProgressMaxLines = 1000
+	// buildEventBuffer 每个订阅者缓冲的事件数量，订阅者处理不及时的时候新的行会被丢弃
+	buildEventBuffer = 256
+)
+
+// BuildEvent 是编译过程中的一行输出。Reset 为 true 时表示开始了新的编译，Done 为 true 时表示编译和启动已经结束
+type BuildEvent struct {
+	Line  string
+	Reset bool
+	Done  bool
+	Err   error
+}
+
+// BuildProgress 记录最近一次编译和启动的输出，并推送给编译中页面
+type BuildProgress struct {
+	mu          sync.Mutex
+	lines       []string
+	partial     []byte
+	running     bool
+	err         error
+	subscribers map[chan BuildEvent]struct{}
+}
+
+func NewBuildProgress() *BuildProgress {
+	return &BuildProgress{subscribers: make(map[chan BuildEvent]struct{})}
+}
+
+// Begin 清空上一次的输出并开始记录
+func (p *BuildProgress) Begin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lines = nil
+	p.partial = nil
+	p.running = true
+	p.err = nil
+	p.broadcast(BuildEvent{Reset: true})
+}
+
+// End 结束记录并通知订阅者
+func (p *BuildProgress) End(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.partial) > 0 {
+		p.println(string(p.partial))
+		p.partial = nil
+	}
+	p.running = false
+	p.err = err
+	p.broadcast(BuildEvent{Done: true, Err: err})
+}
+
+// Running 是否正在编译或启动
+func (p *BuildProgress) Running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running
+}
+
+func (p *BuildProgress) Println(line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.println(line)
+}
+
+// Write 按行记录编译命令的输出
+func (p *BuildProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.partial = append(p.partial, b...)
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			break
+		}
+		p.println(string(p.partial[:i]))
+		p.partial = p.partial[i+1:]
+	}
+	return len(b), nil
+}
+
+func (p *BuildProgress) println(line string) {
+	line = strings.TrimRight(line, "\r")
+	if len(p.lines) >= BuildProgressMaxLines {
+		p.lines = p.lines[1:]
+	}
+	p.lines = append(p.lines, line)
+	p.broadcast(BuildEvent{Line: line})
+}
+
+func (p *BuildProgress) broadcast(e BuildEvent) {
+	for ch := range p.subscribers {
+		select {
+		case ch <- e:
+			continue
+		default:
+		}
+		if e.Done {
+			// 结束事件不能丢弃
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- e
+		}
+	}
+}
+
+// Subscribe 返回已有的输出和后续事件。如果当前没有在编译，events 中会立即收到结束事件
+func (p *BuildProgress) Subscribe() (lines []string, events <-chan BuildEvent, cancel func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lines = append([]string(nil), p.lines...)
+	ch := make(chan BuildEvent, buildEventBuffer)
+	if !p.running {
+		ch <- BuildEvent{Done: true, Err: p.err}
+	}
+	p.subscribers[ch] = struct{}{}
+	return lines, ch, func() {
+		p.mu.Lock()
+		delete(p.subscribers, ch)
+		p.mu.Unlock()
+	}
+}
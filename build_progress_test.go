@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/webx-top/reverseproxy"
+)
+
+func TestBuildProgress(t *testing.T) {
+	p := NewBuildProgress()
+	p.Begin()
+	p.Println(`go build -v -o tower-app-1 main.go`)
+	p.Write([]byte("github.com/admpub/log\ncommand-line"))
+	lines, events, cancel := p.Subscribe()
+	defer cancel()
+	assert.Equal(t, []string{`go build -v -o tower-app-1 main.go`, `github.com/admpub/log`}, lines)
+
+	p.Write([]byte("-arguments\n"))
+	p.End(errors.New(`exit status 1`))
+	e := <-events
+	assert.Equal(t, `command-line-arguments`, e.Line)
+	e = <-events
+	assert.True(t, e.Done)
+	assert.EqualError(t, e.Err, `exit status 1`)
+
+	// not building: the end event is received immediately
+	_, events, cancel = p.Subscribe()
+	defer cancel()
+	assert.True(t, (<-events).Done)
+
+	out := "github.com/admpub/log\ncommand-line-arguments\n# command-line-arguments\n./main.go:5:2: undefined: x\n"
+	assert.Equal(t, "# command-line-arguments\n./main.go:5:2: undefined: x\n", regexBuildPackageLine.ReplaceAllString(out, ``))
+}
+
+func TestBuildingPage(t *testing.T) {
+	var b strings.Builder
+	info := ErrorInfo{Title: `Building…`, BuildLines: []string{`go build -v -o tower-app-1 main.go`, `<pkg>`}, ShowBuilding: true}
+	assert.NoError(t, errorTemplate.Execute(&b, info))
+	assert.Contains(t, b.String(), "go build -v -o tower-app-1 main.go\n&lt;pkg&gt;\n</pre>")
+	assert.Contains(t, b.String(), `new EventSource('/tower-proxy/build/progress')`)
+}
+
+func TestBuildProgressAuth(t *testing.T) {
+	p := &Proxy{App: &App{BuildLog: NewBuildProgress()}, AdminIPs: []string{`127.0.0.1`}}
+	rec := httptest.NewRecorder()
+	// httptest.NewRequest 的 RemoteAddr 为 192.0.2.1
+	p.handleBuildProgress(&reverseproxy.NativeResponse{RespWriter: rec, Request: httptest.NewRequest(`GET`, `/tower-proxy/build/progress`, nil)})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
@@ -1,18 +1,24 @@
 package config
 
-import "strings"
+import (
+	"reflect"
+	"strings"
+)
 
 var Conf = NewConfig()
 
 func NewConfig() *Config {
 	return &Config{
 		App: App{
-			ExecFile: `tower-app-*.exe`,
-			Port:     `5001-5050`,
+			ExecFile:     `tower-app-*.exe`,
+			Port:         `5001-5050`,
+			PprofPath:    `/debug/pprof/goroutine?debug=2`,
+			DrainTimeout: `30s`,
 		},
 		Proxy: Proxy{
-			Port:   `8080`,
-			Engine: `standard`,
+			Port:        `8080`,
+			Engine:      `standard`,
+			HoldTimeout: `60s`,
 		},
 		Admin: Admin{
 			IPs: `127.0.0.1,::1`,
@@ -39,12 +45,96 @@ type App struct {
 	RunParams     string            `json:"params"`
 	PkgMirrors    map[string]string `json:"pkgMirrors"`
 	Env           []string          `json:"env"`
+	EnvProfile    string            `json:"envProfile"`    // 额外读取 .env.<envProfile> 和 .env.<envProfile>.local，例如: dev
+	PanicPatterns []PanicPattern    `json:"panicPatterns"` // 框架自行恢复的 panic 的输出格式
+	SlowRequest   string            `json:"slowRequest"`   // 慢请求阈值，例如: 30s
+	PprofPath     string            `json:"pprofPath"`     // 应用的 pprof goroutine 接口路径
+	HangSigquit   bool              `json:"hangSigquit"`   // 无法通过 pprof 获取 goroutine 信息时是否发送 SIGQUIT 并重启应用
+	// 由 tower 创建监听端口并以 systemd socket activation(LISTEN_FDS/LISTEN_PID) 的方式传给应用
+	SocketActivation bool   `json:"socketActivation"`
+	DrainTimeout     string `json:"drainTimeout"` // 切换到新实例后等待旧实例的请求和连接结束的最长时间
+	LogFile          bool   `json:"logFile"`      // 是否将应用输出写入 .tower/logs/app.log(按大小轮转)
+	// 应用输出的日志格式: json、logfmt 或 text，设置后在终端美化显示
+	LogFormat   string   `json:"logFormat"`
+	LogMinLevel string   `json:"logMinLevel"` // 终端显示的最低日志级别: debug、info、warn 或 error
+	LogAttrs    []string `json:"logAttrs"`    // 终端显示的日志字段，为空时显示全部
+	Stdin       string   `json:"stdin"`       // 为 passthrough 时将标准输入转发给应用，否则读取控制台命令
+	Replicas    int      `json:"replicas"`    // 同时运行的实例数量(使用 port 中的端口)，大于 1 时由代理进行负载均衡
+	IdleTimeout string   `json:"idleTimeout"` // 超过此时间没有请求时停止应用，下一个请求到达时重新启动，例如: 10m
+	Limits      Limits   `json:"limits"`      // 实例的资源限制
+	// 管理接口 /tower-proxy/watch/reload 和 watch.reload 默认发送给实例的信号，默认为 SIGHUP
+	ReloadSignal   string   `json:"reloadSignal"`
+	ForwardSignals []string `json:"forwardSignals"` // tower 收到这些信号时转发给提供服务的实例，例如: ["SIGHUP", "SIGUSR1"]
+
+	// 以下用于 apps 中的服务
+	Name  string   `json:"name"`  // 服务名称，用于日志和控制台命令
+	Host  string   `json:"host"`  // 转发给此服务的请求的主机名(不含端口)
+	Path  string   `json:"path"`  // 转发给此服务的请求的路径前缀(转发时保留)
+	Watch []string `json:"watch"` // 监控的目录，默认为 main 所在的目录和 watch.otherDir
+
+	set map[string]bool // 在配置文件中明确设置的项(小写的 json 名称)，即使是零值也不继承
+}
+
+// Limits 是应用实例的资源限制(大小可以使用 KB、MB、GB 等单位)
+type Limits struct {
+	MaxRSS   string `json:"maxRSS"`   // 常驻内存上限，例如: 512MB
+	OnMaxRSS string `json:"onMaxRSS"` // 超过 maxRSS 时: warn(默认，输出警告) 或 restart(重启应用)
+	NoFile   uint64 `json:"nofile"`   // 启动时设置的 RLIMIT_NOFILE(最多打开的文件数)
+	AS       string `json:"as"`       // 启动时设置的 RLIMIT_AS(虚拟内存上限)，例如: 8GB
+}
+
+// PanicPattern 指定预设名称(Preset)或者起止正则表达式(Start/End)
+type PanicPattern struct {
+	Preset string `json:"preset"`
+	Start  string `json:"start"`
+	End    string `json:"end"`
 }
 
 type Proxy struct {
-	IP     string `json:"ip"`
-	Port   string `json:"port"`
-	Engine string `json:"engine"`
+	IP          string  `json:"ip"`
+	Port        string  `json:"port"`
+	Engine      string  `json:"engine"`
+	HoldTimeout string  `json:"holdTimeout"` // 编译或重启期间请求等待新实例就绪的最长时间
+	Timeout     string  `json:"timeout"`     // 转发给应用的请求的超时时间，为空时不限制，例如: 2m
+	Balance     string  `json:"balance"`     // 多个实例(app.replicas)的负载均衡方式: round-robin、least-connections 或 sticky
+	TLS         TLS     `json:"tls"`
+	LiveReload  bool    `json:"liveReload"` // 向页面注入脚本: 编译成功后自动刷新，CSS 文件更改时替换样式表，编译失败时显示错误
+	Routes      []Route `json:"routes"`     // 按顺序匹配的路径路由，在 apps 的 host 和 path 之前匹配
+	Faults      []Fault `json:"faults"`     // 故障注入规则，用于测试前端在后端缓慢或不稳定时的表现
+}
+
+// Route 将路径前缀匹配的请求转发给 apps 中的服务或其它服务器，返回目录中的静态文件或 mock 响应。app、dir、url 和 mock 只能设置一个
+type Route struct {
+	Path        string            `json:"path"`        // 路径前缀，例如: /api 或 /api/*
+	Method      string            `json:"method"`      // 只匹配此请求方法，为空时匹配所有
+	App         string            `json:"app"`         // 转发给 apps 中此名称的服务，都未设置时转发给第一个服务
+	Dir         string            `json:"dir"`         // 返回此目录中的静态文件
+	URL         string            `json:"url"`         // 转发给其它服务器(例如前端开发服务器): http://localhost:5173
+	Mock        string            `json:"mock"`        // 以此文件的内容作为响应(每次请求时读取)
+	Status      int               `json:"status"`      // mock 响应的状态码，默认为 200
+	Headers     map[string]string `json:"headers"`     // mock 响应头，默认根据文件扩展名设置 Content-Type
+	StripPrefix bool              `json:"stripPrefix"` // 转发或查找文件前去掉匹配的路径前缀
+	Rewrite     string            `json:"rewrite"`     // 将匹配的路径前缀替换为此路径，例如 path 为 /shop、rewrite 为 /store 时 /shop/cart 改写为 /store/cart
+}
+
+// Fault 是一条故障注入规则，按顺序匹配，只使用第一条匹配并开启的规则
+type Fault struct {
+	Name      string  `json:"name"`      // 名称，用于通过管理接口开启或关闭，默认为 fault1、fault2...
+	Path      string  `json:"path"`      // 路径前缀，例如: /api 或 /api/*，为空时匹配所有请求
+	Method    string  `json:"method"`    // 只匹配此请求方法，为空时匹配所有
+	Disabled  bool    `json:"disabled"`  // 启动时关闭，可以通过管理接口开启
+	Delay     string  `json:"delay"`     // 转发前的延迟，例如: 500ms，或 200ms-2s 表示在此范围内随机
+	Status    []int   `json:"status"`    // 以 rate 的概率返回这些状态码中的一个(随机)，例如: [500, 503]
+	Drop      bool    `json:"drop"`      // 以 rate 的概率断开连接，不返回响应
+	Rate      float64 `json:"rate"`      // 返回错误或断开连接的概率(0-1)，默认为 1
+	Bandwidth string  `json:"bandwidth"` // 限制响应的速度(每秒)，例如: 50KB
+}
+
+// TLS 是代理的 HTTPS 设置，证书由 tower 生成的本地 CA 签发
+type TLS struct {
+	Port  string   `json:"port"`  // HTTPS 端口，为空时不启用
+	Hosts []string `json:"hosts"` // 除 localhost、*.localhost 和 apps 的 host 之外需要签发证书的主机名，支持 *.example.test
+	Dir   string   `json:"dir"`   // 保存本地 CA 和证书的目录，默认为用户配置目录下的 tower/tls
 }
 
 func (p Proxy) ListenAddr() string {
@@ -61,10 +151,29 @@ func (p Proxy) ListenAddr() string {
 	return listenAddr
 }
 
+// Sidecar 是随应用一起启动和停止的其它进程(例如前端开发服务器、minio、队列 worker)
+type Sidecar struct {
+	Name         string   `json:"name"`
+	Command      string   `json:"command"` // 命令及参数，例如: npm run dev
+	Dir          string   `json:"dir"`     // 工作目录，默认为当前目录
+	Env          []string `json:"env"`
+	Ready        string   `json:"ready"`        // 就绪检查: tcp://127.0.0.1:9000、http://127.0.0.1:5173/ 或 log:<正则表达式>，为空时启动后即就绪
+	ReadyTimeout string   `json:"readyTimeout"` // 等待就绪的最长时间，默认 60s
+	Restart      string   `json:"restart"`      // 意外退出时是否重启: no(默认)、on-failure 或 always
+	DependsOn    []string `json:"dependsOn"`    // 需要先启动并就绪的 sidecar
+}
+
 type Watch struct {
-	FileExtension string `json:"fileExtension"`
-	OtherDir      string `json:"otherDir"` //编译模式下有效
-	IgnoredPath   string `json:"ignoredPath"`
+	FileExtension string   `json:"fileExtension"`
+	OtherDir      string   `json:"otherDir"` //编译模式下有效
+	IgnoredPath   string   `json:"ignoredPath"`
+	Reload        []Reload `json:"reload"` // 匹配的文件更改时向实例发送信号(软重载)而不重新编译
+}
+
+// Reload 是软重载规则
+type Reload struct {
+	Pattern string `json:"pattern"` // 文件路径的正则表达式，例如: \.(html|tmpl|yaml)$
+	Signal  string `json:"signal"`  // 发送的信号，默认为 app.reloadSignal
 }
 
 type Admin struct {
@@ -73,14 +182,62 @@ type Admin struct {
 }
 
 type Config struct {
-	App        App    `json:"app"`
-	Proxy      Proxy  `json:"proxy"`
-	Admin      Admin  `json:"admin"`
-	Watch      Watch  `json:"watch"`
-	Verbose    bool   `json:"verbose"`
-	ConfigFile string `json:"-"`
-	LogLevel   string `json:"logLevel"`
-	LogRequest bool   `json:"logRequest"`
-	AutoClear  bool   `json:"autoClear"`
-	Offline    bool   `json:"offline"`
+	App        App       `json:"app"`
+	Apps       []App     `json:"apps"`     // 由同一个 tower 管理的多个服务，未设置的项使用 app 中的设置
+	Sidecars   []Sidecar `json:"sidecars"` // 在应用之前启动、随 tower 停止的其它进程
+	Proxy      Proxy     `json:"proxy"`
+	Admin      Admin     `json:"admin"`
+	Watch      Watch     `json:"watch"`
+	Verbose    bool      `json:"verbose"`
+	ConfigFile string    `json:"-"`
+	LogLevel   string    `json:"logLevel"`
+	LogRequest bool      `json:"logRequest"`
+	AutoClear  bool      `json:"autoClear"`
+	Offline    bool      `json:"offline"`
+}
+
+// Services 返回要运行的服务: 没有设置 apps 时只有 app，否则为继承了 app 设置的 apps
+func (c *Config) Services() []App {
+	if len(c.Apps) == 0 {
+		return []App{c.App}
+	}
+	services := make([]App, len(c.Apps))
+	for i, a := range c.Apps {
+		services[i] = a.Inherit(c.App)
+	}
+	return services
+}
+
+// MarkSet 根据以 map 解码的配置文件内容记录 apps 中每个服务明确设置的项，使 false、0 等零值也能覆盖 app 中的设置
+func (c *Config) MarkSet(raw map[string]interface{}) {
+	apps, _ := raw[`apps`].([]interface{})
+	for i, v := range apps {
+		m, ok := v.(map[string]interface{})
+		if !ok || i >= len(c.Apps) {
+			continue
+		}
+		c.Apps[i].set = make(map[string]bool, len(m))
+		for key := range m {
+			c.Apps[i].set[strings.ToLower(key)] = true
+		}
+	}
+}
+
+// Inherit 返回用 base 中的设置填充了未设置的项的副本。服务自身的 name、host、path 和 watch 不会继承
+func (a App) Inherit(base App) App {
+	base.Name, base.Host, base.Path, base.Watch = ``, ``, ``, nil
+	v := reflect.ValueOf(&a).Elem()
+	b := reflect.ValueOf(base)
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.ToLower(strings.Split(field.Tag.Get(`json`), `,`)[0])
+		if f := v.Field(i); f.IsZero() && !a.set[name] {
+			f.Set(b.Field(i))
+		}
+	}
+	return a
 }
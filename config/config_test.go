@@ -0,0 +1,52 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/admpub/confl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServices(t *testing.T) {
+	conf := NewConfig()
+	conf.App.BuildParams = `-tags dev`
+	conf.Apps = []App{
+		{Name: `api`, MainFile: `cmd/api/main.go`, Port: `7101-7110`, Path: `/api`},
+		{Name: `admin`, MainFile: `cmd/admin/main.go`, Host: `admin.localhost`},
+	}
+	services := conf.Services()
+	assert.Equal(t, `7101-7110`, services[0].Port)
+	assert.Equal(t, `5001-5050`, services[1].Port)
+	assert.Equal(t, `-tags dev`, services[1].BuildParams)
+	assert.Equal(t, `admin.localhost`, services[1].Host)
+	assert.Empty(t, services[1].Path)
+}
+
+func TestInheritOverride(t *testing.T) {
+	content := `
+app : {
+  logFile : true
+  replicas : 2
+  drainTimeout : "10s"
+}
+apps : [
+  {name : "api", logFile : false, replicas : 0},
+  {name : "admin"}
+]
+`
+	conf := NewConfig()
+	_, err := confl.Decode(content, conf)
+	assert.NoError(t, err)
+	var raw map[string]interface{}
+	_, err = confl.Decode(content, &raw)
+	assert.NoError(t, err)
+	conf.MarkSet(raw)
+
+	services := conf.Services()
+	// 明确设置为 false 和 0 的项覆盖 app 中的设置
+	assert.False(t, services[0].LogFile)
+	assert.Equal(t, 0, services[0].Replicas)
+	assert.Equal(t, `10s`, services[0].DrainTimeout)
+	assert.True(t, services[1].LogFile)
+	assert.Equal(t, 2, services[1].Replicas)
+}
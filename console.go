@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+// StdinPassthrough 将 tower 的标准输入转发给当前提供服务的实例(app.stdin)
+const StdinPassthrough = `passthrough`
+
+const consoleHelp = `Commands:
+  r, <Enter>  restart the application (r <name>: only the named app)
+  b           rebuild and switch to the new instance (b <name>: only the named app)
+  p           pause watching
+  c           continue watching
+  s           show status
+  l <level>   change the log level (debug, info, warn, error)
+  o           open the application in the browser
+  q           stop all instances and quit
+  h           show this help`
+
+// Console 从标准输入读取并执行命令
+type Console struct {
+	App      *App
+	Watcher  *Watcher
+	URL      string     //代理地址，用于在浏览器中打开
+	Rebuild  func()     //编译并切换到新的实例
+	Services []*Service //apps 中的其它服务
+	Sidecars *Sidecars
+
+	out io.Writer
+}
+
+// Service 是由控制台管理的一个服务
+type Service struct {
+	App     *App
+	Watcher *Watcher
+	Rebuild func()
+}
+
+func NewConsole(app *App) *Console {
+	return &Console{App: app, out: os.Stdout}
+}
+
+// services 返回所有服务，第一个为 App
+func (c *Console) services() []*Service {
+	return append([]*Service{{App: c.App, Watcher: c.Watcher, Rebuild: c.Rebuild}}, c.Services...)
+}
+
+// Apps returns the apps of all services.
+func (c *Console) Apps() []*App {
+	apps := make([]*App, 0, len(c.Services)+1)
+	for _, s := range c.services() {
+		apps = append(apps, s.App)
+	}
+	return apps
+}
+
+// selectServices 返回名称为 name 的服务，name 为空时返回全部
+func (c *Console) selectServices(name string) []*Service {
+	services := c.services()
+	if len(name) == 0 {
+		return services
+	}
+	for _, s := range services {
+		if s.App.Name == name {
+			return []*Service{s}
+		}
+	}
+	fmt.Fprintf(c.out, "Unknown app %q\n", name)
+	return nil
+}
+
+// Run 逐行读取命令直到 in 结束或 ctx 被取消
+func (c *Console) Run(ctx context.Context, in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return
+		}
+		c.Exec(ctx, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		log.Error(`== Console: `, err)
+	}
+}
+
+// Exec 执行一条命令
+func (c *Console) Exec(ctx context.Context, line string) {
+	fields := strings.Fields(line)
+	var cmd, arg string
+	if len(fields) > 0 {
+		cmd = strings.ToLower(fields[0])
+	}
+	if len(fields) > 1 {
+		arg = fields[1]
+	}
+	switch cmd {
+	case ``, `r`:
+		for _, s := range c.selectServices(arg) {
+			go s.App.Restart(ctx)
+		}
+	case `b`:
+		for _, s := range c.selectServices(arg) {
+			if s.Rebuild == nil {
+				go s.App.Restart(ctx)
+				continue
+			}
+			log.Info(`== Rebuilding ` + s.App.Name)
+			go s.Rebuild()
+		}
+	case `p`, `c`:
+		paused := cmd == `p`
+		for _, s := range c.services() {
+			if s.Watcher != nil {
+				s.Watcher.Paused = paused
+			}
+		}
+		if paused {
+			log.Info(`== Watching paused`)
+		} else {
+			log.Info(`== Watching continued`)
+		}
+	case `s`:
+		c.Status()
+	case `l`:
+		c.setLogLevel(arg)
+	case `o`:
+		if err := openBrowser(c.URL); err != nil {
+			log.Error(`== Open browser: `, err)
+		}
+	case `q`:
+		c.App.Shutdown()
+	case `h`, `?`:
+		fmt.Fprintln(c.out, consoleHelp)
+	default:
+		fmt.Fprintf(c.out, "Unknown command %q\n%s\n", cmd, consoleHelp)
+	}
+}
+
+// Status 输出代理地址、监控状态和各实例的状态
+func (c *Console) Status() {
+	var b strings.Builder
+	if len(c.URL) > 0 {
+		b.WriteString(`Proxy:     ` + c.URL + "\n")
+	}
+	if c.Watcher != nil {
+		watching := `on`
+		if c.Watcher.Paused {
+			watching = `paused`
+		}
+		b.WriteString(`Watching:  ` + watching + "\n")
+	}
+	building := `no`
+	for _, app := range c.Apps() {
+		if app.Busy() {
+			building = `yes`
+		}
+	}
+	b.WriteString(`Building:  ` + building + "\n")
+	b.WriteString(`Log level: ` + log.DefaultLog.MaxLevel.String() + "\n")
+	for _, s := range c.services() {
+		if len(c.Services) > 0 {
+			b.WriteString(`App ` + s.App.Name + ":\n")
+		}
+		c.writeStatus(&b, s.App)
+	}
+	if list := c.Sidecars.List(); len(list) > 0 {
+		b.WriteString("Sidecars:\n")
+		for _, s := range list {
+			fmt.Fprintf(&b, "  %-12s %s", s.Name, s.Status())
+			if stats := s.Stats(); stats != nil {
+				b.WriteString(`  ` + stats.String())
+			}
+			b.WriteString("\n")
+		}
+	}
+	io.WriteString(c.out, b.String())
+}
+
+// writeStatus 输出应用最近编译的错误和各实例的状态
+func (c *Console) writeStatus(b *strings.Builder, app *App) {
+	if err := app.BuildError(); err != nil {
+		b.WriteString(`Last build failed: ` + strings.SplitN(err.Error(), "\n", 2)[0] + "\n")
+	}
+	if app.Idle() {
+		fmt.Fprintf(b, "Idle: stopped after %v without requests, starts on the next request\n", app.IdleTimeout)
+	}
+	writeEnvStatus(b, app.Environ())
+	b.WriteString("Instances:\n")
+	serving := map[string]bool{app.Port(): true}
+	for _, inst := range app.Serving() {
+		serving[inst.Port] = true
+	}
+	instances := app.Instances()
+	if len(instances) == 0 {
+		b.WriteString("  (none)\n")
+	}
+	for _, inst := range instances {
+		mark := ` `
+		if serving[inst.Port] && inst.State() == StateReady {
+			mark = `*`
+		}
+		fmt.Fprintf(b, "  %s%-6s %-9s build %s  up %v  in-flight %d",
+			mark, inst.Port, inst.State(), inst.BuildID, time.Since(inst.Created).Round(time.Second), inst.InFlight())
+		if stats := inst.Stats(); stats != nil && inst.Running() {
+			b.WriteString(`  ` + stats.String())
+		}
+		b.WriteString("\n")
+	}
+}
+
+// setLogLevel 修改 tower 的日志级别，设置了 app.logFormat 时同时修改应用日志在终端显示的最低级别
+func (c *Console) setLogLevel(level string) {
+	if len(level) == 0 {
+		fmt.Fprintln(c.out, `Log level: `+log.DefaultLog.MaxLevel.String()+` (usage: l debug|info|warn|error)`)
+		return
+	}
+	if level == `warning` {
+		level = `warn`
+	}
+	if _, ok := log.GetLevel(level); !ok {
+		fmt.Fprintf(c.out, "Unknown log level %q\n", level)
+		return
+	}
+	log.DefaultLog.SetLevel(level)
+	for _, app := range c.Apps() {
+		if f := app.Logs.Formatter; f != nil {
+			if lv := ParseLogLevel(level); lv != LogLevelUnknown {
+				f.MinLevel = lv
+			}
+		}
+	}
+	fmt.Fprintln(c.out, `Log level: `+log.DefaultLog.MaxLevel.String())
+}
+
+func openBrowser(url string) error {
+	if len(url) == 0 {
+		return fmt.Errorf(`no address to open`)
+	}
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case `darwin`:
+		cmd = exec.Command(`open`, url)
+	case `windows`:
+		cmd = exec.Command(`rundll32`, `url.dll,FileProtocolHandler`, url)
+	default:
+		cmd = exec.Command(`xdg-open`, url)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsole(t *testing.T) {
+	app := NewApp(context.Background(), `main.go`, `6001`, ``, ``)
+	var out strings.Builder
+	console := app.Console
+	console.out = &out
+	console.Watcher = &Watcher{}
+	console.URL = `http://localhost:8080`
+	rebuilt := make(chan struct{}, 1)
+	console.Rebuild = func() { rebuilt <- struct{}{} }
+
+	console.Exec(context.Background(), `p`)
+	assert.True(t, console.Watcher.Paused)
+	console.Exec(context.Background(), ` C `)
+	assert.False(t, console.Watcher.Paused)
+
+	console.Exec(context.Background(), `b`)
+	select {
+	case <-rebuilt:
+	case <-time.After(time.Second):
+		t.Fatal(`rebuild not called`)
+	}
+
+	inst := newInstance(app, `6001`, StateReady)
+	inst.BuildID = `100`
+	app.instances[`6001`] = inst
+	console.Exec(context.Background(), `s`)
+	assert.Contains(t, out.String(), `Proxy:     http://localhost:8080`)
+	assert.Contains(t, out.String(), `Watching:  on`)
+	assert.Contains(t, out.String(), `*6001   ready     build 100`)
+
+	level := log.DefaultLog.MaxLevel.String()
+	defer log.DefaultLog.SetLevel(level)
+	app.Logs.Formatter = &LogFormatter{Format: LogFormatJSON}
+	out.Reset()
+	console.Exec(context.Background(), `l warn`)
+	assert.Equal(t, "Log level: Warn\n", out.String())
+	assert.Equal(t, LogLevelWarn, app.Logs.Formatter.MinLevel)
+	out.Reset()
+	console.Exec(context.Background(), `l verbose`)
+	assert.Contains(t, out.String(), `Unknown log level`)
+
+	out.Reset()
+	console.Exec(context.Background(), `x`)
+	assert.Contains(t, out.String(), `Unknown command "x"`)
+	assert.Contains(t, out.String(), consoleHelp)
+
+	assert.Equal(t, `http://localhost:8080`, proxyURL(`:8080`))
+	assert.Equal(t, `http://127.0.0.1:8080`, proxyURL(`127.0.0.1:8080`))
+	assert.Equal(t, `http://[::1]:8080`, proxyURL(`[::1]:8080`))
+}
+
+func TestListenConsoleCancel(t *testing.T) {
+	app := NewApp(context.Background(), `main.go`, `6001`, ``, ``)
+	state, err := OpenStateFile(t.TempDir())
+	assert.NoError(t, err)
+	state.CleanOrphans()
+	assert.FileExists(t, state.path())
+	app.State = state
+	ctx, cancel := context.WithCancel(context.Background())
+	app.ListenConsole(ctx)
+	cancel()
+	// 取消 ctx 只清理不退出进程
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(state.path())
+		return os.IsNotExist(err)
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -13,10 +13,10 @@ app {
   # 开发环境下用“go run”命令运行的源文件，一般为“main.go”
   main : ""
 
-  # 你的项目在本机运行的端口列表,可以用半角逗号分隔也可以用减号指定范围，也可以两种结合起来用，例如： "5001,5003,5050-5060"。如果为空，则代表不支持访问端口。
+  # 你的项目在本机运行的端口列表,可以用半角逗号分隔也可以用减号指定范围，也可以两种结合起来用，例如： "5001,5003,5050-5060"。设置为 "0" 则由操作系统分配端口。如果为空，则代表不支持访问端口。
   port : "5001-5050"
 
-  # 指定app端口的参数名，例如：webx.exe -p 8080 其中的“-p”就是。如果为空，则代表不支持访问端口。
+  # 指定app端口的参数名，例如：webx.exe -p 8080 其中的“-p”就是。如果为空并且 params 和 env 中没有使用 {{.Port}}，则代表不支持访问端口。
   portParamName : "-p"
 
   # 是否在执行 go build 以前执行 go generate
@@ -34,16 +34,176 @@ app {
   # 包路径替换规则，例如：{"^golang\\.org/x/(.*)$":"github.com/golang/$1"}
   pkgMirrors : {}
 
-  # 自定义环境变量。例如: ["ENV_NAME_1=value1","ENV_NAME_2=value2"]
+  # 自定义环境变量。例如: ["ENV_NAME_1=value1","ENV_NAME_2=value2"]。同样支持模板变量，例如: ["HTTP_ADDR=127.0.0.1:{{.Port}}"]
   env : []
+
+  # 额外读取 .env.<envProfile> 和 .env.<envProfile>.local，例如: dev。也可以使用命令行参数 -env.profile 指定
+  envProfile : ""
+
+  # 框架自行恢复(recover)的 panic 的输出格式，例如: [{preset:"gin"},{start:"^\\[MyRecover\\]",end:"^-- end --$"}]
+  panicPatterns : []
+
+  # 慢请求阈值(例如: 30s)，请求超过此时间时获取应用所有 goroutine 的调用栈。为空则不检测
+  slowRequest : ""
+
+  # 应用的 pprof goroutine 接口路径
+  pprofPath : "/debug/pprof/goroutine?debug=2"
+
+  # 无法通过 pprof 获取 goroutine 信息时，是否向应用发送 SIGQUIT 信号并重启应用
+  hangSigquit : false
+
+  # 是否由 tower 创建监听端口并以 systemd socket activation 的方式传给应用(不支持 Windows)
+  socketActivation : false
+
+  # 切换到新实例后等待旧实例的请求和连接结束的最长时间，为 0 时立即停止
+  drainTimeout : "30s"
+
+  # 是否将应用的输出写入 .tower/logs/app.log(按大小轮转)
+  logFile : false
+
+  # 应用输出的日志格式: json、logfmt 或 text，设置后在终端美化显示
+  logFormat : ""
+
+  # 终端显示的最低日志级别: debug、info、warn 或 error
+  logMinLevel : ""
+
+  # 终端显示的日志字段，为空时显示全部字段
+  logAttrs : []
+
+  # 为 passthrough 时将标准输入转发给应用，否则读取控制台命令
+  stdin : ""
+
+  # 同时运行的实例数量，大于 1 时由代理进行负载均衡
+  replicas : 1
+
+  # 超过此时间没有请求时停止应用，下一个请求到达时重新启动，例如: 10m。为空时不停止
+  idleTimeout : ""
+
+  # 管理接口 /tower-proxy/watch/reload 和 watch.reload 默认发送给实例的信号，为空时为 SIGHUP
+  reloadSignal : ""
+
+  # tower 收到这些信号时转发给提供服务的实例，例如: ["SIGHUP", "SIGUSR1"]
+  forwardSignals : []
+
+  # 实例的资源限制(仅支持 Linux)
+  limits {
+    # 常驻内存上限，例如: 512MB，为空时不检查
+    maxRSS : ""
+    # 超过 maxRSS 时: warn(输出警告) 或 restart(重新编译并重启应用)
+    onMaxRSS : "warn"
+    # 启动实例时设置的 RLIMIT_NOFILE(最多打开的文件数)，0 为不设置
+    nofile : 0
+    # 启动实例时设置的 RLIMIT_AS(虚拟内存上限)，例如: 8GB，为空时不设置
+    as : ""
+  }
 }
 
+# 由同一个 tower 管理的多个服务，未设置的项使用 app 中的设置
+#apps [
+#  {
+#    name : "web"
+#    main : "cmd/web/main.go"
+#    port : "5001-5010"
+#    watch : ["cmd/web", "internal"]
+#  }
+#  {
+#    name : "api"
+#    main : "cmd/api/main.go"
+#    port : "5011-5020"
+#    path : "/api"
+#    watch : ["cmd/api", "internal"]
+#  }
+#  {
+#    name : "admin"
+#    main : "cmd/admin/main.go"
+#    port : "5021-5030"
+#    host : "admin.localhost"
+#  }
+#]
+
+# 在应用之前启动、随 tower 停止的其它进程(例如前端开发服务器、minio、队列 worker)
+#sidecars [
+#  {
+#    name : "minio"
+#    command : "minio server ./data --address :9000"
+#    env : ["MINIO_ROOT_USER=dev", "MINIO_ROOT_PASSWORD=devpassword"]
+#    ready : "http://127.0.0.1:9000/minio/health/live"
+#    readyTimeout : "60s"
+#    restart : "on-failure"
+#  }
+#  {
+#    name : "vite"
+#    command : "npm run dev"
+#    dir : "web"
+#    ready : "tcp://127.0.0.1:5173"
+#    dependsOn : ["minio"]
+#  }
+#]
+
 proxy {
   # 你的项目对外公开访问的端口
   port : "8080"
 
   # 代理引擎。支持fast和standard
   engine : "standard"
+
+  # 编译或重启期间请求等待新实例就绪的最长时间(超时返回 503)
+  holdTimeout : "60s"
+
+  # 转发给应用的请求的超时时间(例如: 2m)，为空时不限制
+  timeout : ""
+
+  # 多个实例(app.replicas)的负载均衡方式: round-robin、least-connections 或 sticky
+  balance : "round-robin"
+
+  # 是否向浏览器打开的页面注入自动刷新(live reload)脚本
+  liveReload : false
+
+  # 按路径前缀匹配的路由，每条路由只能设置 app、dir、url 或 mock 中的一个
+  routes : [
+  #  {
+  #    path : "/api/*"
+  #    app : "api"
+  #  }
+  #  {
+  #    path : "/assets/*"
+  #    dir : "public/assets"
+  #    stripPrefix : true
+  #  }
+  #  {
+  #    path : "/users/me"
+  #    method : "GET"
+  #    mock : "mock/me.json"
+  #    status : 200
+  #    headers : {"X-Mock" : "1"}
+  #  }
+  ]
+
+  # 故障注入规则，只使用第一条匹配并开启的规则
+  faults : [
+  #  {
+  #    name : "slow-api"
+  #    path : "/api/*"
+  #    delay : "200ms-2s"
+  #    status : [500, 503]
+  #    rate : 0.1
+  #  }
+  #  {
+  #    name : "slow-download"
+  #    path : "/download/*"
+  #    method : "GET"
+  #    bandwidth : "50KB"
+  #    disabled : true
+  #  }
+  ]
+
+  # HTTPS 设置，证书由 tower 生成的本地 CA(dir 中的 rootCA.pem)签发
+  tls {
+    port : ""
+    hosts : []
+    # 默认为用户配置目录下的 tower/tls
+    dir : ""
+  }
 }
 
 admin {
@@ -60,6 +220,14 @@ watch {
   
   # 忽略的路径(正则表达式)，不填则不限制(排除某个完整的文件夹名请用“/文件夹名/”的格式)
   ignoredPath : ""
+
+  # 软重载: 匹配 pattern 的文件更改时向实例发送 signal(默认为 app.reloadSignal)而不重新编译
+  #reload [
+  #  {
+  #    pattern : "\\.(html|tmpl)$"
+  #    signal : "SIGHUP"
+  #  }
+  #]
 }
 
 # 是否显示细节信息。如果设置为true，会自动将下面的logLevel设置为Debug
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+const (
+	// EnvFileName 应用环境变量文件的名称
+	EnvFileName = `.env`
+	// EnvSourceConfig 来自配置文件 app.env 的环境变量的来源
+	EnvSourceConfig = `app.env`
+	// EnvReloadDelay .env 文件更改后等待的时间，期间的多次更改只重启一次
+	EnvReloadDelay = 500 * time.Millisecond
+)
+
+var regexEnvKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// EnvVar 是传给应用的环境变量及其来源(文件名或 app.env)
+type EnvVar struct {
+	Key    string
+	Value  string
+	Source string
+}
+
+// EnvFiles 返回 dir 中按加载顺序排列的 .env 文件: .env、.env.local、.env.<profile>、.env.<profile>.local。
+// 后面的文件覆盖前面的文件，都覆盖 app.env
+func EnvFiles(dir string, profile string) []string {
+	names := []string{EnvFileName, EnvFileName + `.local`}
+	if len(profile) > 0 {
+		names = append(names, EnvFileName+`.`+profile, EnvFileName+`.`+profile+`.local`)
+	}
+	files := make([]string, len(names))
+	for i, name := range names {
+		files[i] = filepath.Join(dir, name)
+	}
+	return files
+}
+
+// LoadEnvFiles 按顺序读取存在的 .env 文件，返回合并后的环境变量(包括 base)。
+// 值中的 $VAR、${VAR} 和 ${VAR:-默认值} 使用已经读取的变量、base 或 tower 的环境变量展开
+func LoadEnvFiles(files []string, base []EnvVar) ([]EnvVar, error) {
+	vars := slices.Clone(base)
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		vars, err = parseEnv(f, filepath.Base(file), vars)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vars, nil
+}
+
+// parseEnv 解析 KEY=VALUE 格式的内容并合并到 vars 中。支持 # 注释、export 前缀、单引号(不展开变量)和双引号(支持 \n 等转义)
+func parseEnv(r io.Reader, source string, vars []EnvVar) ([]EnvVar, error) {
+	lookup := func(key string) (string, bool) {
+		if i := envIndex(vars, key); i >= 0 {
+			return vars[i].Value, true
+		}
+		return os.LookupEnv(key)
+	}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		line = strings.TrimPrefix(line, `export `)
+		key, value, ok := strings.Cut(line, `=`)
+		key = strings.TrimSpace(key)
+		if !ok || !regexEnvKey.MatchString(key) {
+			return vars, fmt.Errorf(`%s:%d: invalid line: %s`, source, n, line)
+		}
+		value, err := parseEnvValue(strings.TrimSpace(value), lookup)
+		if err != nil {
+			return vars, fmt.Errorf(`%s:%d: %w`, source, n, err)
+		}
+		v := EnvVar{Key: key, Value: value, Source: source}
+		if i := envIndex(vars, key); i >= 0 {
+			vars[i] = v
+		} else {
+			vars = append(vars, v)
+		}
+	}
+	return vars, scanner.Err()
+}
+
+func parseEnvValue(value string, lookup func(string) (string, bool)) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `'`):
+		end := strings.Index(value[1:], `'`)
+		if end < 0 {
+			return ``, fmt.Errorf(`unterminated quote: %s`, value)
+		}
+		return value[1 : end+1], nil
+	case strings.HasPrefix(value, `"`):
+		var b strings.Builder
+		for i := 1; i < len(value); i++ {
+			switch ch := value[i]; ch {
+			case '"':
+				return expandEnv(b.String(), lookup), nil
+			case '\\':
+				if i+1 < len(value) {
+					i++
+					switch value[i] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					case '$':
+						b.WriteByte(0) // 不展开，在 expandEnv 之后还原
+					default:
+						b.WriteByte(value[i])
+					}
+				}
+			default:
+				b.WriteByte(ch)
+			}
+		}
+		return ``, fmt.Errorf(`unterminated quote: %s`, value)
+	default:
+		if i := strings.Index(value, ` #`); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		return expandEnv(value, lookup), nil
+	}
+}
+
+func expandEnv(value string, lookup func(string) (string, bool)) string {
+	value = os.Expand(value, func(name string) string {
+		name, def, hasDefault := strings.Cut(name, `:-`)
+		if v, ok := lookup(name); ok && (len(v) > 0 || !hasDefault) {
+			return v
+		}
+		return def
+	})
+	return strings.ReplaceAll(value, "\x00", `$`)
+}
+
+func envIndex(vars []EnvVar, key string) int {
+	for i, v := range vars {
+		if v.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// configEnv 返回 app.env 中的环境变量
+func configEnv(env []string) []EnvVar {
+	var vars []EnvVar
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, `=`)
+		v := EnvVar{Key: key, Value: value, Source: EnvSourceConfig}
+		if i := envIndex(vars, key); i >= 0 {
+			vars[i] = v
+		} else {
+			vars = append(vars, v)
+		}
+	}
+	return vars
+}
+
+// LoadEnv 重新读取 EnvFiles，返回环境变量是否有变化
+func (a *App) LoadEnv() (changed bool, err error) {
+	vars, err := LoadEnvFiles(a.EnvFiles, configEnv(a.Env))
+	if err != nil {
+		return false, err
+	}
+	a.envMu.Lock()
+	defer a.envMu.Unlock()
+	changed = !slices.Equal(vars, a.env)
+	a.env = vars
+	return changed, nil
+}
+
+// Environ 返回传给应用的环境变量(app.env 和 .env 文件合并后的结果)
+func (a *App) Environ() []EnvVar {
+	a.envMu.Lock()
+	defer a.envMu.Unlock()
+	if a.env == nil {
+		return configEnv(a.Env)
+	}
+	return slices.Clone(a.env)
+}
+
+// environ 以 KEY=VALUE 的格式返回 Environ()
+func (a *App) environ() []string {
+	vars := a.Environ()
+	env := make([]string, len(vars))
+	for i, v := range vars {
+		env[i] = v.Key + `=` + v.Value
+	}
+	return env
+}
+
+// reloadEnv 在 .env 文件更改后重新读取，环境变量有变化时使用当前的可执行文件重新启动应用(不重新编译)
+func (a *App) reloadEnv(ctx context.Context) {
+	changed, err := a.LoadEnv()
+	if err != nil {
+		log.Error(`== Failed to load env files: `, err)
+		return
+	}
+	if !changed {
+		return
+	}
+	if a.Idle() || !a.IsRunning() {
+		log.Info(`== Environment changed, it will be used when ` + a.Name + ` starts`)
+		return
+	}
+	log.Info(`== Environment changed, restarting ` + a.Name)
+	if err := a.Relaunch(ctx); err != nil {
+		log.Error(err)
+	}
+}
+
+// Relaunch 使用当前的可执行文件重新启动应用(不重新编译)。支持切换端口时新的实例就绪后再停止旧的实例
+func (a *App) Relaunch(ctx context.Context) error {
+	if port, err := getPort(a); err == nil {
+		return a.Start(ctx, false, port)
+	}
+	return a.restartCall.Do(func() error {
+		for _, inst := range a.otherInstances() {
+			if err := inst.kill(); err != nil {
+				log.Error(err)
+			}
+			select {
+			case <-inst.Done():
+			case <-time.After(instanceStopTimeout):
+			}
+		}
+		return a.Start(ctx, false)
+	})
+}
+
+// writeEnvStatus 输出传给应用的环境变量(值已隐藏)及其来源
+func writeEnvStatus(b *strings.Builder, vars []EnvVar) {
+	if len(vars) == 0 {
+		return
+	}
+	sort.SliceStable(vars, func(i, j int) bool { return vars[i].Key < vars[j].Key })
+	b.WriteString("Environment:\n")
+	for _, v := range vars {
+		fmt.Fprintf(b, "  %s=%s (%s)\n", v.Key, MaskedValue, v.Source)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.Setenv(`TOWER_TEST_HOME`, `/home/dev`)
+	defer os.Unsetenv(`TOWER_TEST_HOME`)
+	os.WriteFile(dir+`/.env`, []byte("# comment\nexport DB_HOST=localhost\nDB_URL=\"postgres://${DB_HOST}/app\\n\"\nSECRET=from-env\nCACHE=${TOWER_TEST_HOME}/cache # inline\nRAW='$DB_HOST'\nESCAPED=\"\\$DB_HOST\"\nLEVEL=${LOG_LEVEL:-info}\n"), 0644)
+	os.WriteFile(dir+`/.env.local`, []byte("SECRET=local\n"), 0644)
+	os.WriteFile(dir+`/.env.test`, []byte("DB_HOST=test-db\nDB_URL=postgres://$DB_HOST/test\n"), 0644)
+
+	files := EnvFiles(dir, `test`)
+	assert.Equal(t, []string{filepath.Join(dir, `.env`), filepath.Join(dir, `.env.local`), filepath.Join(dir, `.env.test`), filepath.Join(dir, `.env.test.local`)}, files)
+	vars, err := LoadEnvFiles(files, configEnv([]string{`SECRET=config`, `PORT_ADDR=:{{.Port}}`}))
+	assert.NoError(t, err)
+	values := map[string]EnvVar{}
+	for _, v := range vars {
+		values[v.Key] = v
+	}
+	assert.Equal(t, EnvVar{Key: `SECRET`, Value: `local`, Source: `.env.local`}, values[`SECRET`])
+	assert.Equal(t, EnvVar{Key: `PORT_ADDR`, Value: `:{{.Port}}`, Source: EnvSourceConfig}, values[`PORT_ADDR`])
+	assert.Equal(t, `test-db`, values[`DB_HOST`].Value)
+	assert.Equal(t, `postgres://test-db/test`, values[`DB_URL`].Value)
+	assert.Equal(t, `/home/dev/cache`, values[`CACHE`].Value)
+	assert.Equal(t, `$DB_HOST`, values[`RAW`].Value)
+	assert.Equal(t, `$DB_HOST`, values[`ESCAPED`].Value)
+	assert.Equal(t, `info`, values[`LEVEL`].Value)
+
+	_, err = parseEnv(strings.NewReader("OK=1\nnot a line\n"), `.env`, nil)
+	assert.EqualError(t, err, `.env:2: invalid line: not a line`)
+	_, err = parseEnv(strings.NewReader(`A="open`), `.env`, nil)
+	assert.Error(t, err)
+
+	app := NewApp(context.Background(), `main.go`, `6001`, ``, ``)
+	app.Env = []string{`SECRET=config`}
+	app.EnvFiles = files
+	changed, err := app.LoadEnv()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Contains(t, app.environ(), `SECRET=local`)
+	changed, _ = app.LoadEnv()
+	assert.False(t, changed)
+	os.WriteFile(dir+`/.env.test.local`, []byte("SECRET=profile-local\n"), 0644)
+	changed, _ = app.LoadEnv()
+	assert.True(t, changed)
+	var b strings.Builder
+	writeEnvStatus(&b, app.Environ())
+	assert.Contains(t, b.String(), `  SECRET=`+MaskedValue+` (.env.test.local)`)
+	assert.NotContains(t, b.String(), `profile-local`)
+
+	// 获取依赖和编译时使用 .env 文件中的环境变量
+	os.WriteFile(dir+`/.env.test.local`, []byte("GOFLAGS=-tower-invalid\n"), 0644)
+	app.LoadEnv()
+	_, err = app.listDeps()
+	assert.ErrorContains(t, err, `tower-invalid`)
+
+	// .env 文件所在的目录即使不在 WatchedDir 中也会被监控
+	w := Watcher{IgnoredPathPattern: DefaultIngoredPaths, EnvFiles: files}
+	assert.Contains(t, w.dirsToWatch(), dir)
+}
+
+// TestEnvHelperProcess 是 TestRelaunchOnEnvChange 中运行的应用进程，返回 .env 文件中的 GREETING
+func TestEnvHelperProcess(t *testing.T) {
+	if os.Getenv(`TOWER_TEST_ENV`) != `1` {
+		return
+	}
+	http.ListenAndServe(`127.0.0.1:`+os.Getenv(`TOWER_TEST_PORT`), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, os.Getenv(`GREETING`))
+	}))
+	os.Exit(1)
+}
+
+func TestRelaunchOnEnvChange(t *testing.T) {
+	dir := t.TempDir()
+	// 使用测试程序的副本，停止实例时会删除可执行文件
+	b, err := os.ReadFile(os.Args[0])
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, `tower-app-test`), b, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, `.env`), []byte("GREETING=hello\n"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	app := NewApp(ctx, `main.go`, `0`, dir, ``)
+	app.binName = `tower-app-test`
+	app.DisabledBuild = true
+	app.DrainTimeout = time.Second
+	app.RunParams = []string{`-test.run=^TestEnvHelperProcess$`}
+	app.Env = []string{`TOWER_TEST_ENV=1`, `TOWER_TEST_PORT=` + PortTemplateVar}
+	app.EnvFiles = []string{filepath.Join(dir, `.env`)}
+	_, err = app.LoadEnv()
+	assert.NoError(t, err)
+	defer func() {
+		for _, inst := range app.Instances() {
+			inst.kill()
+		}
+	}()
+
+	get := func(port string) string {
+		resp, err := http.Get(`http://127.0.0.1:` + port + `/`)
+		if !assert.NoError(t, err) {
+			return ``
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+	if !assert.NoError(t, app.Start(ctx, false)) {
+		return
+	}
+	port := app.Port()
+	old := app.Instance(port)
+	assert.Equal(t, `hello`, get(port))
+
+	// .env 更改后使用新的环境变量在新的端口上重新启动，旧的实例随后停止
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, `.env`), []byte("GREETING=world\n"), 0644))
+	app.reloadEnv(ctx)
+	assert.NotEqual(t, port, app.Port())
+	assert.Equal(t, `world`, get(app.Port()))
+	select {
+	case <-old.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal(`the previous instance was not stopped`)
+	}
+}
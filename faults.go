@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/webx-top/reverseproxy"
+	c "github.com/webx-top/tower/config"
+)
+
+const (
+	// FaultHeader 注入了错误状态码的响应带有此响应头，值为规则的名称
+	FaultHeader = `X-Tower-Fault`
+	// throttleInterval 限速时每次输出的间隔
+	throttleInterval = 100 * time.Millisecond
+)
+
+// FaultRule 是 proxy.faults 中的一条故障注入规则
+type FaultRule struct {
+	Name      string
+	Prefix    string //路径前缀(不含末尾的 / 和 /*)，为空时匹配所有请求
+	Method    string
+	Delay     time.Duration
+	MaxDelay  time.Duration //大于 Delay 时在 Delay 和 MaxDelay 之间随机
+	Status    []int
+	Drop      bool
+	Rate      float64 //返回错误或断开连接的概率
+	Bandwidth int64   //每秒输出的字节数，为 0 时不限速
+	enabled   atomic.Bool
+}
+
+// NewFaultRule 解析 proxy.faults 中的一条规则
+func NewFaultRule(conf c.Fault) (*FaultRule, error) {
+	if len(conf.Path) > 0 && !strings.HasPrefix(conf.Path, `/`) {
+		return nil, fmt.Errorf(`invalid path: %q (must start with /)`, conf.Path)
+	}
+	f := &FaultRule{
+		Name:   conf.Name,
+		Prefix: strings.TrimSuffix(strings.TrimSuffix(conf.Path, `*`), `/`),
+		Method: strings.ToUpper(conf.Method),
+		Status: conf.Status,
+		Drop:   conf.Drop,
+		Rate:   conf.Rate,
+	}
+	if len(conf.Delay) > 0 {
+		minDelay, maxDelay, isRange := strings.Cut(conf.Delay, `-`)
+		var err error
+		if f.Delay, err = time.ParseDuration(strings.TrimSpace(minDelay)); err != nil {
+			return nil, err
+		}
+		f.MaxDelay = f.Delay
+		if isRange {
+			if f.MaxDelay, err = time.ParseDuration(strings.TrimSpace(maxDelay)); err != nil {
+				return nil, err
+			}
+			if f.MaxDelay < f.Delay {
+				return nil, fmt.Errorf(`invalid delay: %q`, conf.Delay)
+			}
+		}
+	}
+	if len(f.Status) > 0 && f.Drop {
+		return nil, errors.New(`status and drop cannot be used together`)
+	}
+	for _, status := range f.Status {
+		if status < 100 || status > 999 {
+			return nil, fmt.Errorf(`invalid status: %d`, status)
+		}
+	}
+	if f.Rate < 0 || f.Rate > 1 {
+		return nil, fmt.Errorf(`invalid rate: %v (must be between 0 and 1)`, f.Rate)
+	}
+	if f.Rate == 0 {
+		f.Rate = 1
+	}
+	if len(conf.Bandwidth) > 0 {
+		n, err := parseSize(strings.TrimSuffix(conf.Bandwidth, `/s`))
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, fmt.Errorf(`invalid bandwidth: %q`, conf.Bandwidth)
+		}
+		f.Bandwidth = int64(n)
+	}
+	if f.MaxDelay == 0 && len(f.Status) == 0 && !f.Drop && f.Bandwidth == 0 {
+		return nil, errors.New(`set at least one of delay, status, drop and bandwidth`)
+	}
+	f.enabled.Store(!conf.Disabled)
+	return f, nil
+}
+
+// Enabled 规则是否开启
+func (f *FaultRule) Enabled() bool {
+	return f.enabled.Load()
+}
+
+// Match 请求是否匹配此规则
+func (f *FaultRule) Match(method string, path string) bool {
+	if len(f.Method) > 0 && f.Method != method {
+		return false
+	}
+	return hasPathPrefix(path, f.Prefix)
+}
+
+// delay 返回本次请求的延迟
+func (f *FaultRule) delay() time.Duration {
+	if f.MaxDelay <= f.Delay {
+		return f.Delay
+	}
+	return f.Delay + rand.N(f.MaxDelay-f.Delay+1)
+}
+
+// fail 本次请求是否返回错误或断开连接
+func (f *FaultRule) fail() bool {
+	if len(f.Status) == 0 && !f.Drop {
+		return false
+	}
+	return f.Rate >= 1 || rand.Float64() < f.Rate
+}
+
+// String 返回用于日志和管理接口的简要说明
+func (f *FaultRule) String() string {
+	target := f.Prefix + `/*`
+	if len(f.Method) > 0 {
+		target = f.Method + ` ` + target
+	}
+	var effects []string
+	switch {
+	case f.MaxDelay > f.Delay:
+		effects = append(effects, `delay `+f.Delay.String()+`-`+f.MaxDelay.String())
+	case f.Delay > 0:
+		effects = append(effects, `delay `+f.Delay.String())
+	}
+	var rate string
+	if f.Rate < 1 {
+		rate = ` at ` + strconv.FormatFloat(f.Rate*100, 'f', -1, 64) + `%`
+	}
+	if len(f.Status) > 0 {
+		effects = append(effects, fmt.Sprintf(`status %v%s`, f.Status, rate))
+	}
+	if f.Drop {
+		effects = append(effects, `drop`+rate)
+	}
+	if f.Bandwidth > 0 {
+		effects = append(effects, `bandwidth `+formatBandwidth(f.Bandwidth))
+	}
+	s := f.Name + `: ` + target + ` => ` + strings.Join(effects, `, `)
+	if !f.Enabled() {
+		s += ` (disabled)`
+	}
+	return s
+}
+
+func formatBandwidth(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return strconv.FormatFloat(float64(n)/(1<<20), 'f', -1, 64) + `MB/s`
+	case n >= 1<<10:
+		return strconv.FormatFloat(float64(n)/(1<<10), 'f', -1, 64) + `KB/s`
+	default:
+		return strconv.FormatInt(n, 10) + `B/s`
+	}
+}
+
+// Faults 是代理的故障注入规则(proxy.faults)，可以通过管理接口开启或关闭
+type Faults struct {
+	Rules []*FaultRule
+}
+
+// Rule 返回名称为 name 的规则，不存在时返回 nil
+func (f *Faults) Rule(name string) *FaultRule {
+	for _, r := range f.Rules {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// Match 返回请求匹配的第一条开启的规则，没有时返回 nil。管理接口的请求不会匹配
+func (f *Faults) Match(method string, path string) *FaultRule {
+	if f == nil || strings.HasPrefix(path, `/tower-proxy/`) {
+		return nil
+	}
+	for _, r := range f.Rules {
+		if r.Enabled() && r.Match(method, path) {
+			return r
+		}
+	}
+	return nil
+}
+
+// SetEnabled 开启或关闭名称为 name 的规则，name 为空时为所有规则
+func (f *Faults) SetEnabled(name string, enabled bool) error {
+	if len(name) == 0 {
+		for _, r := range f.Rules {
+			r.enabled.Store(enabled)
+		}
+		return nil
+	}
+	r := f.Rule(name)
+	if r == nil {
+		return fmt.Errorf(`fault not found: %s`, name)
+	}
+	r.enabled.Store(enabled)
+	return nil
+}
+
+// faultedRequest 是注入了延迟或需要限速的请求
+type faultedRequest struct {
+	rule    *FaultRule
+	effects string //用于请求日志
+}
+
+// injectFault 按匹配的规则延迟请求、返回错误状态码或断开连接，handled 为 true 时不再转发
+func (this *Proxy) injectFault(ctx reverseproxy.Context) (handled bool) {
+	method, path := ctx.RequestMethod(), ctx.RequestPath()
+	rule := this.Faults.Match(method, path)
+	if rule == nil {
+		return false
+	}
+	var effects []string
+	if d := rule.delay(); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-this.ctx.Done():
+		}
+		effects = append(effects, `delay `+d.String())
+	}
+	if rule.fail() {
+		if rule.Drop {
+			if !this.App.DisabledLogRequest {
+				log.Infof("== Request: %7s %s => Dropped [fault %s]", method, path, rule.Name)
+			}
+			dropConnection(ctx)
+			return true
+		}
+		status := rule.Status[rand.IntN(len(rule.Status))]
+		if !this.App.DisabledLogRequest {
+			log.Infof("== Request: %7s %s => Fault %d [fault %s]", method, path, status, rule.Name)
+		}
+		ctx.SetHeader(FaultHeader, rule.Name)
+		writeText(ctx, status, http.StatusText(status))
+		return true
+	}
+	if rule.Bandwidth > 0 {
+		effects = append(effects, `bandwidth `+formatBandwidth(rule.Bandwidth))
+	}
+	// 升级后的连接(websocket)不会经过 ResponseAfter
+	if !isUpgradeRequest(ctx) {
+		this.faulted.Store(requestID(ctx), &faultedRequest{rule: rule, effects: rule.Name + `: ` + strings.Join(effects, `, `)})
+	}
+	return false
+}
+
+// faultLog 返回请求日志中注入的故障的说明
+func (this *Proxy) faultLog(id string) string {
+	if v, ok := this.faulted.Load(id); ok {
+		return ` [fault ` + v.(*faultedRequest).effects + `]`
+	}
+	return ``
+}
+
+// endFault 在响应后清除请求注入的故障，并限制 fast 引擎的响应速度。standard 引擎由 Faults.Handler 限速。
+// handled 为 true 时响应由 ResponseBefore 生成(没有转发)
+func (this *Proxy) endFault(ctx reverseproxy.Context, handled bool) {
+	id := requestHeader(ctx, RequestIDHeader)
+	r, ok := ctx.(*reverseproxy.FastResponse)
+	if !ok || handled {
+		// standard 引擎和没有转发的请求不会调用 EndRequest，注入了故障的请求在这里记录
+		if note := this.faultLog(id); len(note) > 0 && !this.App.DisabledLogRequest {
+			log.Infof("== Request: %7s %s => Completed%s", ctx.RequestMethod(), ctx.RequestPath(), note)
+		}
+	}
+	v, loaded := this.faulted.LoadAndDelete(id)
+	if !ok || !loaded {
+		return
+	}
+	rate := v.(*faultedRequest).rule.Bandwidth
+	if rate == 0 || r.Response.IsBodyStream() {
+		return
+	}
+	body := bytes.Clone(r.Response.Body())
+	r.Response.SetBodyStream(&throttledReader{Reader: bytes.NewReader(body), rate: rate}, len(body))
+}
+
+// Handler 返回限制 standard 引擎的响应速度的 http.Handler
+func (f *Faults) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule := f.Match(r.Method, r.URL.Path)
+		if rule == nil || rule.Bandwidth == 0 || isUpgradeRequest(&reverseproxy.NativeResponse{RespWriter: w, Request: r}) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(&throttledWriter{ResponseWriter: w, rate: rule.Bandwidth}, r)
+	})
+}
+
+// throttleChunk 返回每次输出的字节数
+func throttleChunk(rate int64) int {
+	return max(int(rate*int64(throttleInterval)/int64(time.Second)), 1)
+}
+
+// throttleWait 返回输出 n 个字节后需要等待的时间
+func throttleWait(n int, rate int64) time.Duration {
+	return time.Duration(int64(n) * int64(time.Second) / rate)
+}
+
+// throttledWriter 以每秒 rate 字节的速度输出
+type throttledWriter struct {
+	http.ResponseWriter
+	rate int64
+}
+
+func (w *throttledWriter) Write(b []byte) (n int, err error) {
+	chunk := throttleChunk(w.rate)
+	rc := http.NewResponseController(w.ResponseWriter)
+	for len(b) > 0 {
+		size := min(chunk, len(b))
+		m, err := w.ResponseWriter.Write(b[:size])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		rc.Flush()
+		b = b[size:]
+		time.Sleep(throttleWait(size, w.rate))
+	}
+	return n, nil
+}
+
+func (w *throttledWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// throttledReader 以每秒 rate 字节的速度读取
+type throttledReader struct {
+	io.Reader
+	rate int64
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if chunk := throttleChunk(r.rate); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		time.Sleep(throttleWait(n, r.rate))
+	}
+	return n, err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/webx-top/reverseproxy"
+	c "github.com/webx-top/tower/config"
+)
+
+func TestFaults(t *testing.T) {
+	confs := []c.Fault{
+		{Name: `errors`, Path: `/api/*`, Method: `post`, Status: []int{503}},
+		{Name: `slow`, Path: `/api`, Delay: `10ms-30ms`, Bandwidth: `10KB/s`},
+		{Name: `drop`, Drop: true, Rate: 0.5, Disabled: true},
+	}
+	faults := &Faults{}
+	for _, conf := range confs {
+		rule, err := NewFaultRule(conf)
+		assert.NoError(t, err)
+		faults.Rules = append(faults.Rules, rule)
+	}
+	assert.Equal(t, `slow: /api/* => delay 10ms-30ms, bandwidth 10KB/s`, faults.Rules[1].String())
+	assert.Equal(t, `drop: /* => drop at 50% (disabled)`, faults.Rules[2].String())
+	assert.Equal(t, faults.Rules[0], faults.Match(`POST`, `/api/users`))
+	assert.Equal(t, faults.Rules[1], faults.Match(`GET`, `/api/users`))
+	assert.Nil(t, faults.Match(`GET`, `/`))
+	assert.Nil(t, faults.Match(`GET`, `/tower-proxy/faults`))
+	for i := 0; i < 10; i++ {
+		d := faults.Rules[1].delay()
+		assert.True(t, d >= 10*time.Millisecond && d <= 30*time.Millisecond, d)
+	}
+
+	assert.NoError(t, faults.SetEnabled(`drop`, true))
+	assert.Equal(t, faults.Rules[2], faults.Match(`GET`, `/`))
+	assert.NoError(t, faults.SetEnabled(``, false))
+	assert.Nil(t, faults.Match(`POST`, `/api/users`))
+	assert.Error(t, faults.SetEnabled(`missing`, true))
+	assert.NoError(t, faults.SetEnabled(`errors`, true))
+
+	p := &Proxy{App: &App{Name: `web`}, Faults: faults, ctx: context.Background()}
+	rec := httptest.NewRecorder()
+	assert.True(t, p.injectFault(&reverseproxy.NativeResponse{RespWriter: rec, Request: httptest.NewRequest(`POST`, `/api/users`, nil)}))
+	assert.Equal(t, 503, rec.Code)
+	assert.Equal(t, `errors`, rec.Header().Get(FaultHeader))
+
+	// 每秒 10KB，输出 3KB 大约需要 300ms
+	assert.NoError(t, faults.SetEnabled(`errors`, false))
+	assert.NoError(t, faults.SetEnabled(`slow`, true))
+	handler := faults.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 3<<10))
+	}))
+	start := time.Now()
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(`GET`, `/api/download`, nil))
+	assert.Equal(t, 3<<10, rec.Body.Len())
+	assert.True(t, time.Since(start) >= 250*time.Millisecond, time.Since(start))
+
+	for _, conf := range []c.Fault{
+		{Path: `api`, Delay: `1s`},
+		{Delay: `2s-1s`},
+		{Status: []int{500}, Drop: true},
+		{Status: []int{42}},
+		{Drop: true, Rate: 2},
+		{Bandwidth: `fast`},
+		{Path: `/api`},
+	} {
+		_, err := NewFaultRule(conf)
+		assert.Error(t, err, conf)
+	}
+}
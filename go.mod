@@ -4,12 +4,14 @@ go 1.25.1
 
 require (
 	github.com/admpub/confl v0.2.4
+	github.com/admpub/fasthttp v0.0.7
 	github.com/admpub/fsnotify v1.7.1
 	github.com/admpub/log v1.4.0
 	github.com/admpub/rundelay v0.0.3
 	github.com/stretchr/testify v1.11.1
 	github.com/webx-top/com v1.4.1
 	github.com/webx-top/reverseproxy v0.0.2
+	golang.org/x/sys v0.39.0
 )
 
 require (
@@ -17,7 +19,6 @@ require (
 	github.com/admpub/dateparse v0.0.0-20250903020633-d86d3f2a4cfd // indirect
 	github.com/admpub/decimal v1.3.2 // indirect
 	github.com/admpub/events v1.3.6 // indirect
-	github.com/admpub/fasthttp v0.0.7 // indirect
 	github.com/admpub/go-isatty v0.0.11 // indirect
 	github.com/admpub/go-reuseport v0.5.0 // indirect
 	github.com/admpub/humanize v0.0.0-20190501023926-5f826e92c8ca // indirect
@@ -55,7 +56,6 @@ require (
 	golang.org/x/crypto v0.46.0 // indirect
 	golang.org/x/net v0.48.0 // indirect
 	golang.org/x/sync v0.19.0 // indirect
-	golang.org/x/sys v0.39.0 // indirect
 	golang.org/x/text v0.32.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
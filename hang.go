@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/webx-top/reverseproxy"
+)
+
+const (
+	// GoroutineDumpTimeout 获取 goroutine 信息的超时时间
+	GoroutineDumpTimeout = 5 * time.Second
+	// GoroutineDumpMaxSize 通过 pprof 获取的 goroutine 信息的最大字节数
+	GoroutineDumpMaxSize = 4 * 1024 * 1024
+)
+
+var (
+	regexGoroutineStart = regexp.MustCompile(`(?m)^goroutine (\d+) \[([^\]]+)\]:\s*$`)
+
+	// blockedStates 表示 goroutine 处于阻塞状态的 waitReason 前缀
+	blockedStates = []string{`chan `, `select`, `semacquire`, `sleep`, `sync.`}
+)
+
+// Goroutine 是 goroutine 信息中的一项
+type Goroutine struct {
+	ID      int
+	State   string
+	Trace   []Trace
+	Blocked bool
+	AppCode bool // 调用栈中包含应用代码
+}
+
+// Highlight 阻塞在应用代码中的 goroutine 会在页面上突出显示
+func (g Goroutine) Highlight() bool {
+	return g.Blocked && g.AppCode
+}
+
+// hangReport 是请求超过慢请求阈值(app.slowRequest)时获取的 goroutine 信息
+type hangReport struct {
+	timer   *time.Timer
+	done    chan struct{}
+	elapsed time.Duration
+	dump    string
+	err     error
+	aborted bool //已中止转发
+}
+
+type abortKey struct{}
+
+// abortableHandler 为请求设置可以取消的 context，standard 引擎通过它中止超过慢请求阈值的转发
+func abortableHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(context.WithValue(ctx, abortKey{}, cancel)))
+	})
+}
+
+// requestAbort 返回中止转发请求的函数，fast 引擎无法中止，返回 nil
+func requestAbort(ctx reverseproxy.Context) context.CancelFunc {
+	r, ok := ctx.(*reverseproxy.NativeResponse)
+	if !ok {
+		return nil
+	}
+	abort, _ := r.Request.Context().Value(abortKey{}).(context.CancelFunc)
+	return abort
+}
+
+// wait 停止计时。请求超过了阈值时等待 goroutine 信息获取完成并返回 true
+func (h *hangReport) wait() bool {
+	if h.timer.Stop() {
+		return false
+	}
+	<-h.done
+	return true
+}
+
+// DumpGoroutines 获取应用实例所有 goroutine 的调用栈:
+// 优先通过 pprof 获取，失败时如果开启了 hangSigquit 则发送 SIGQUIT(进程会因此退出，quit 为 true)
+func (a *App) DumpGoroutines(port string) (dump string, quit bool, err error) {
+	if len(a.PprofPath) > 0 {
+		dump, err = fetchGoroutineDump(`http://127.0.0.1:` + port + a.PprofPath)
+		if err == nil {
+			return
+		}
+	}
+	if !a.HangSigquit {
+		if err == nil {
+			err = errors.New(`pprof is not configured`)
+		}
+		return
+	}
+	inst := a.Instance(port)
+	process := inst.Process()
+	if !inst.Running() || process == nil {
+		return ``, false, errors.New(`the application is not running`)
+	}
+	stderr := inst.stderr
+	if err = process.Signal(syscall.SIGQUIT); err != nil {
+		return
+	}
+	quit = true
+	crash := stderr.Wait(GoroutineDumpTimeout)
+	if crash == nil {
+		return ``, quit, errors.New(`no goroutine dump received after SIGQUIT`)
+	}
+	crash.MarkReported()
+	dump = stderr.Output()
+	if p := strings.LastIndex(dump, `SIGQUIT: `); p > -1 {
+		dump = dump[p:]
+	}
+	return dump, quit, nil
+}
+
+func fetchGoroutineDump(url string) (string, error) {
+	client := &http.Client{Timeout: GoroutineDumpTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return ``, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ``, errors.New(`pprof: ` + resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, GoroutineDumpMaxSize))
+	if err != nil {
+		return ``, err
+	}
+	if !regexGoroutineStart.Match(b) {
+		return ``, errors.New(`pprof: invalid goroutine dump`)
+	}
+	return string(b), nil
+}
+
+// parseGoroutineDump 解析 goroutine?debug=2 或 SIGQUIT 输出的 goroutine 信息，
+// 阻塞在应用代码中的 goroutine 排在前面
+func parseGoroutineDump(dump string) (goroutines []Goroutine) {
+	locs := regexGoroutineStart.FindAllStringSubmatchIndex(dump, -1)
+	for i, loc := range locs {
+		end := len(dump)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		g := Goroutine{State: dump[loc[4]:loc[5]]}
+		g.ID, _ = strconv.Atoi(dump[loc[2]:loc[3]])
+		_, g.Trace, _ = extractAppErrorInfo(strings.TrimSpace(dump[loc[1]:end]))
+		for j, t := range g.Trace {
+			if !t.AppFile {
+				continue
+			}
+			if strings.HasPrefix(t.File, `vendor/`) || strings.Contains(t.File, `/vendor/`) {
+				g.Trace[j].AppFile = false
+				continue
+			}
+			g.AppCode = true
+		}
+		state := strings.SplitN(g.State, `,`, 2)[0]
+		for _, prefix := range blockedStates {
+			if strings.HasPrefix(state, prefix) {
+				g.Blocked = true
+				break
+			}
+		}
+		goroutines = append(goroutines, g)
+	}
+	sort.SliceStable(goroutines, func(i, j int) bool {
+		return goroutines[i].Highlight() && !goroutines[j].Highlight()
+	})
+	return
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/pprof"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/webx-top/reverseproxy"
+)
+
+func TestGoroutineDump(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	go func() {
+		<-block
+	}()
+	time.Sleep(10 * time.Millisecond)
+	buf := make([]byte, 1<<20)
+	dump := string(buf[:runtime.Stack(buf, true)])
+	goroutines := parseGoroutineDump(dump)
+	assert.True(t, len(goroutines) > 1)
+	g := goroutines[0]
+	assert.True(t, g.Highlight())
+	assert.Equal(t, `chan receive`, g.State)
+	assert.Equal(t, `hang_test.go`, g.Trace[0].File)
+	assert.Contains(t, g.Trace[0].Func, `TestGoroutineDump`)
+	for _, g := range goroutines[1:] {
+		assert.False(t, g.Highlight())
+	}
+	info := ErrorInfo{Goroutines: goroutines, ShowGoroutines: true}
+	assert.NoError(t, errorTemplate.Execute(io.Discard, info))
+}
+
+func TestHandleHang(t *testing.T) {
+	dump := "goroutine 7 [chan receive]:\nmain.slow()\n\t/go/src/app/main.go:12 +0x1d\n"
+	var served atomic.Int32
+	pprof := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		io.WriteString(w, dump)
+	}))
+	defer pprof.Close()
+	_, port, _ := net.SplitHostPort(pprof.Listener.Addr().String())
+
+	p := &Proxy{App: &App{SlowRequest: 20 * time.Millisecond, PprofPath: `/debug/pprof/goroutine?debug=2`}}
+	req := &RequestSnapshot{Method: `GET`, URI: `/slow`, Header: http.Header{}}
+	hang := p.watchHang(port, req, nil)
+	assert.False(t, hang.wait())
+	assert.Equal(t, int32(0), served.Load())
+
+	// 使用处理请求的实例的端口获取 goroutine 信息
+	hang = p.watchHang(port, req, nil)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, hang.wait())
+	assert.Equal(t, int32(1), served.Load())
+	assert.NoError(t, hang.err)
+	assert.Equal(t, dump, hang.dump)
+
+	rec := httptest.NewRecorder()
+	p.handleHang(&reverseproxy.NativeResponse{RespWriter: rec, Request: httptest.NewRequest(`GET`, `/slow`, nil)}, hang, req)
+	assert.Contains(t, rec.Body.String(), `main.slow()`)
+	assert.Contains(t, rec.Body.String(), `The request did not complete within 20ms.`)
+}
+
+func blockingHandler(block chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}
+}
+
+func TestHangAbort(t *testing.T) {
+	block := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle(`/debug/pprof/goroutine`, pprof.Handler(`goroutine`))
+	mux.Handle(`/block`, blockingHandler(block))
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+	defer close(block)
+	_, appPort, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	app := NewApp(context.Background(), `main.go`, appPort, ``, `--port`)
+	app.port = appPort
+	app.instances[appPort] = newInstance(app, appPort, StateReady)
+	app.SlowRequest = 200 * time.Millisecond
+	app.PprofPath = `/debug/pprof/goroutine?debug=2`
+	proxyPort, err := kernelFreePort()
+	assert.NoError(t, err)
+	proxy := NewProxy(context.Background(), app, &Watcher{})
+	proxy.Port = `127.0.0.1:` + proxyPort
+	go proxy.Listen()
+	assert.NoError(t, dialAddress(proxy.Port, 10, nil))
+
+	// standard 引擎在超过阈值后结束请求并显示阻塞的 goroutine，不依赖 proxy.timeout
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(`http://` + proxy.Port + `/block`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	page := string(b)
+	assert.Contains(t, page, `The request did not complete within 200ms.`)
+	assert.Contains(t, page, `blockingHandler`)
+	assert.Contains(t, page, `hang_test.go`)
+}
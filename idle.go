@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+const (
+	// IdleCheckInterval 检查应用是否空闲的间隔
+	IdleCheckInterval = time.Second
+	// instanceStopTimeout 停止实例时等待进程退出的最长时间
+	instanceStopTimeout = 5 * time.Second
+)
+
+// touch 记录最近一次请求的时间
+func (a *App) touch() {
+	a.lastRequest.Store(time.Now().UnixNano())
+}
+
+// Idle 是否因为空闲(app.idleTimeout)而停止了应用，下一个请求到达时重新启动
+func (a *App) Idle() bool {
+	return a.idle.Load()
+}
+
+// IdleSince 返回最近一次请求以来的时间
+func (a *App) IdleSince() time.Duration {
+	return time.Since(time.Unix(0, a.lastRequest.Load()))
+}
+
+// watchIdle 在超过 IdleTimeout 没有请求并且没有进行中的请求和连接时停止应用
+func (a *App) watchIdle(ctx context.Context) {
+	interval := min(IdleCheckInterval, a.IdleTimeout)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if a.shouldSleep() {
+			a.sleep()
+		}
+	}
+}
+
+func (a *App) shouldSleep() bool {
+	if a.Idle() || a.Busy() || !a.IsRunning() || a.IdleSince() < a.IdleTimeout {
+		return false
+	}
+	for _, inst := range a.Instances() {
+		if inst.InFlight() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sleep 停止所有实例，保留可执行文件以便快速重新启动
+func (a *App) sleep() {
+	a.idleMu.Lock()
+	defer a.idleMu.Unlock()
+	if !a.shouldSleep() {
+		return
+	}
+	a.idle.Store(true)
+	log.Infof(`== No requests for %v, stopping %s until the next request`, a.IdleTimeout, a.Name)
+	instances := a.otherInstances()
+	for _, inst := range instances {
+		if err := inst.kill(); err != nil {
+			log.Error(err)
+		}
+	}
+	timeout := time.NewTimer(instanceStopTimeout)
+	defer timeout.Stop()
+	for _, inst := range instances {
+		select {
+		case <-inst.Done():
+		case <-timeout.C:
+			return
+		}
+	}
+}
+
+// Wake 重新启动因为空闲而停止的应用。可执行文件已经不存在时重新编译。并发的调用会合并为一次
+func (a *App) Wake(ctx context.Context) error {
+	return a.wakeCall.Do(func() error {
+		// 等待进行中的 sleep 完成
+		a.idleMu.Lock()
+		idle := a.Idle()
+		a.idleMu.Unlock()
+		if !idle {
+			return nil
+		}
+		log.Info(`== Request received, starting ` + a.Name)
+		_, err := os.Stat(a.BinFile())
+		err = a.Start(ctx, err != nil)
+		// 启动失败时按照意外退出的应用处理(显示错误，由代理重启)
+		a.idle.Store(false)
+		return err
+	})
+}
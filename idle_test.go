@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestIdleHelperProcess 是 TestIdle 中运行的应用进程
+func TestIdleHelperProcess(t *testing.T) {
+	if os.Getenv(`TOWER_TEST_IDLE`) != `1` {
+		return
+	}
+	time.Sleep(30 * time.Second)
+}
+
+func TestIdle(t *testing.T) {
+	app := NewApp(context.Background(), `main.go`, `6001`, ``, ``)
+	app.IdleTimeout = 50 * time.Millisecond
+	inst := newInstance(app, `6001`, StateBuilding)
+	cmd := exec.Command(os.Args[0], `-test.run=^TestIdleHelperProcess$`)
+	cmd.Env = append(os.Environ(), `TOWER_TEST_IDLE=1`)
+	app.instances[`6001`] = inst
+	assert.NoError(t, inst.start(cmd, NewStderrCapturer(app, `6001`)))
+	assert.True(t, inst.transition(StateReady))
+	defer inst.kill()
+
+	app.touch()
+	assert.False(t, app.shouldSleep())
+	time.Sleep(60 * time.Millisecond)
+	release := inst.Acquire()
+	assert.False(t, app.shouldSleep()) // in flight
+	release()
+	assert.True(t, app.shouldSleep())
+
+	app.sleep()
+	assert.True(t, app.Idle())
+	assert.True(t, inst.Exited())
+	assert.False(t, app.IsRunning())
+	assert.False(t, app.shouldSleep())
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+// InstanceState 是应用实例的生命周期状态
+type InstanceState int32
+
+const (
+	StateBuilding InstanceState = iota // 正在编译
+	StateStarting                      // 进程已启动，等待端口可以访问
+	StateReady                         // 正在提供服务
+	StateDraining                      // 已被新实例取代或正在被停止
+	StateStopped                       // 由 tower 停止或未能启动
+	StateCrashed                       // 进程意外退出
+)
+
+var errInstanceState = errors.New(`invalid instance state transition`)
+
+var instanceStateNames = map[InstanceState]string{
+	StateBuilding: `building`,
+	StateStarting: `starting`,
+	StateReady:    `ready`,
+	StateDraining: `draining`,
+	StateStopped:  `stopped`,
+	StateCrashed:  `crashed`,
+}
+
+func (s InstanceState) String() string {
+	return instanceStateNames[s]
+}
+
+// instanceTransitions 允许的状态转换。stopped 和 crashed 是终止状态
+var instanceTransitions = map[InstanceState][]InstanceState{
+	StateBuilding: {StateStarting, StateStopped},
+	StateStarting: {StateReady, StateDraining, StateStopped, StateCrashed},
+	StateReady:    {StateDraining, StateStopped, StateCrashed},
+	StateDraining: {StateStopped, StateCrashed},
+}
+
+func canTransition(from, to InstanceState) bool {
+	for _, s := range instanceTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// InstanceEvent 在实例状态改变后发送给订阅者
+type InstanceEvent struct {
+	Instance *Instance
+	From     InstanceState
+	To       InstanceState
+	Time     time.Time
+}
+
+// Instance 是应用的一次编译和运行
+type Instance struct {
+	ID      string
+	Port    string
+	BinFile string
+	BuildID string
+	Created time.Time
+
+	app     *App
+	mu      sync.Mutex
+	state   InstanceState
+	cmd     *exec.Cmd
+	process *os.Process //启动成功后才设置，用 Process 读取
+	stderr  *StderrCapturer
+	output  []*LogWriter
+	stdin   io.WriteCloser //app.stdin 为 passthrough 时转发标准输入
+	exited  chan struct{}
+
+	inFlight  atomic.Int64                 //进行中的请求和升级后的连接(websocket)数量
+	stats     atomic.Pointer[ProcessStats] //最近一次采集的资源占用
+	overLimit atomic.Bool                  //是否已经超过 limits.maxRSS
+}
+
+func newInstance(app *App, port string, state InstanceState) *Instance {
+	return &Instance{
+		ID:      strconv.FormatInt(app.instanceSeq.Add(1), 10),
+		Port:    port,
+		Created: time.Now(),
+		app:     app,
+		state:   state,
+		exited:  make(chan struct{}),
+	}
+}
+
+func (i *Instance) State() InstanceState {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.state
+}
+
+// transition 转换到 to 状态，不允许的转换会被忽略并返回 false
+func (i *Instance) transition(to InstanceState) bool {
+	i.mu.Lock()
+	from := i.state
+	if !canTransition(from, to) {
+		i.mu.Unlock()
+		return false
+	}
+	i.state = to
+	i.mu.Unlock()
+	log.Debugf(`== Instance(%s): %s => %s`, i.Port, from, to)
+	i.app.publish(InstanceEvent{Instance: i, From: from, To: to, Time: time.Now()})
+	return true
+}
+
+// Running 进程已经启动并且尚未退出
+func (i *Instance) Running() bool {
+	if i == nil {
+		return false
+	}
+	switch i.State() {
+	case StateStarting, StateReady, StateDraining:
+		return true
+	}
+	return false
+}
+
+// Exited 进程已经退出
+func (i *Instance) Exited() bool {
+	if i == nil {
+		return false
+	}
+	select {
+	case <-i.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done returns a channel that is closed once the process has exited.
+func (i *Instance) Done() <-chan struct{} {
+	return i.exited
+}
+
+// Crash returns the crash information if the process exited unexpectedly.
+func (i *Instance) Crash() *AppCrash {
+	if i == nil || i.stderr == nil {
+		return nil
+	}
+	return i.stderr.Crash()
+}
+
+// Stats returns the latest resource usage of the process, or nil if it has not been sampled.
+func (i *Instance) Stats() *ProcessStats {
+	if i == nil {
+		return nil
+	}
+	return i.stats.Load()
+}
+
+// DrainCheckInterval 等待实例的请求和连接结束时检查的间隔
+const DrainCheckInterval = 100 * time.Millisecond
+
+// Acquire 记录一个转发到此实例的请求或连接，请求结束或连接关闭时调用返回的 release
+func (i *Instance) Acquire() (release func()) {
+	if i == nil {
+		return func() {}
+	}
+	i.inFlight.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			i.inFlight.Add(-1)
+		})
+	}
+}
+
+// InFlight returns the number of requests and upgraded connections still being served.
+func (i *Instance) InFlight() int64 {
+	return i.inFlight.Load()
+}
+
+// drain 转换为 draining 状态并等待进行中的请求和连接结束，最多等待 timeout
+func (i *Instance) drain(timeout time.Duration) {
+	i.transition(StateDraining)
+	n := i.InFlight()
+	if n <= 0 || timeout <= 0 {
+		return
+	}
+	log.Infof(`== Draining app at port %s: %d in flight`, i.Port, n)
+	started := time.Now()
+	ticker := time.NewTicker(DrainCheckInterval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for n > 0 {
+		select {
+		case <-i.exited:
+			return
+		case <-deadline.C:
+			log.Warnf(`== Drain timeout (%v) at port %s: %d still in flight`, timeout, i.Port, n)
+			return
+		case <-ticker.C:
+			n = i.InFlight()
+		}
+	}
+	log.Infof(`== Drained app at port %s in %v`, i.Port, time.Since(started).Round(time.Millisecond))
+}
+
+// Process 返回实例的进程，尚未启动时返回 nil
+func (i *Instance) Process() *os.Process {
+	if i == nil {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.process
+}
+
+// kill 结束由 tower 主动停止的进程(不会被当作崩溃)。进程尚未启动时，由 start 在启动后结束它
+func (i *Instance) kill() error {
+	i.transition(StateDraining)
+	i.stderr.Stopping()
+	process := i.Process()
+	if process == nil {
+		return nil
+	}
+	return process.Kill()
+}
+
+// start 启动进程，进程退出后根据是否由 tower 停止转换为 stopped 或 crashed
+func (i *Instance) start(cmd *exec.Cmd, stderr *StderrCapturer) error {
+	i.cmd = cmd
+	i.stderr = stderr
+	if !i.transition(StateStarting) {
+		return errInstanceState
+	}
+	if err := cmd.Start(); err != nil {
+		i.transition(StateStopped)
+		close(i.exited)
+		return err
+	}
+	i.mu.Lock()
+	i.process = cmd.Process
+	i.mu.Unlock()
+	if stderr.IsStopping() {
+		// 启动期间调用了 kill
+		cmd.Process.Kill()
+	}
+	i.app.State.Add(i, !i.app.DisabledBuild)
+	go func() {
+		err := cmd.Wait()
+		i.app.State.Remove(i)
+		for _, w := range i.output {
+			w.Flush()
+		}
+		crash := stderr.Exited(cmd.ProcessState)
+		if i.app.Port() == i.Port && err != nil {
+			log.Error(`== cmd.Run Error:`, err)
+		}
+		if crash != nil {
+			log.Errorf("----------- Application Crashed (%s) -----------\n%s\n-----------------------------------------", crash.Status(), crash.Output)
+		}
+		if stderr.IsStopping() {
+			i.transition(StateStopped)
+		} else {
+			i.transition(StateCrashed)
+		}
+		close(i.exited)
+	}()
+	return nil
+}
+
+// PortTemplateVar 在 params 和 env 中代表实例端口的模板变量
+const PortTemplateVar = `{{.Port}}`
+
+// InstanceVars 是 params 和 env 中可以使用的模板变量
+type InstanceVars struct {
+	Port     string
+	BuildID  string
+	Instance string
+}
+
+// Environ returns the environment variables injected into every instance.
+func (v InstanceVars) Environ() []string {
+	return []string{
+		`PORT=` + v.Port,
+		`TOWER_PORT=` + v.Port,
+		`TOWER_BUILD_ID=` + v.BuildID,
+		`TOWER_INSTANCE=` + v.Instance,
+	}
+}
+
+func (i *Instance) templateVars() InstanceVars {
+	return InstanceVars{Port: i.Port, BuildID: i.BuildID, Instance: i.ID}
+}
+
+// expandTemplates 替换 values 中的模板变量，例如: "-addr=:{{.Port}}"
+func expandTemplates(values []string, vars InstanceVars) []string {
+	result := make([]string, len(values))
+	for k, v := range values {
+		result[k] = v
+		if !strings.Contains(v, `{{`) {
+			continue
+		}
+		t, err := template.New(`param`).Option(`missingkey=error`).Parse(v)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err = t.Execute(&buf, vars); err != nil {
+			log.Error(err)
+			continue
+		}
+		result[k] = buf.String()
+	}
+	return result
+}
+
+// singleCall 合并并发的调用: 调用进行中时，后来的调用者等待它完成并共享它的结果
+type singleCall struct {
+	mu   sync.Mutex
+	call *callResult
+}
+
+type callResult struct {
+	done chan struct{}
+	err  error
+}
+
+// Running 是否有调用正在进行
+func (s *singleCall) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.call != nil
+}
+
+func (s *singleCall) Do(fn func() error) error {
+	s.mu.Lock()
+	if c := s.call; c != nil {
+		s.mu.Unlock()
+		<-c.done
+		return c.err
+	}
+	c := &callResult{done: make(chan struct{})}
+	s.call = c
+	s.mu.Unlock()
+
+	c.err = fn()
+
+	s.mu.Lock()
+	s.call = nil
+	s.mu.Unlock()
+	close(c.done)
+	return c.err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceLifecycle(t *testing.T) {
+	app := NewApp(context.Background(), `main.go`, `6001`, ``, ``)
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	unsubscribe := app.Subscribe(func(e InstanceEvent) {
+		mu.Lock()
+		events = append(events, e.From.String()+`>`+e.To.String())
+		mu.Unlock()
+	})
+	defer unsubscribe()
+
+	inst := newInstance(app, `6001`, StateBuilding)
+	assert.False(t, inst.transition(StateReady)) // not allowed
+	cmd := exec.Command(os.Args[0], `-test.run=^$`)
+	assert.NoError(t, inst.start(cmd, NewStderrCapturer(app, `6001`)))
+	assert.True(t, inst.Running())
+	assert.True(t, inst.transition(StateReady))
+	select {
+	case <-inst.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal(`timeout`)
+	}
+	assert.Equal(t, StateCrashed, inst.State())
+	assert.False(t, inst.transition(StateReady)) // terminal state
+	assert.True(t, inst.Exited())
+	mu.Lock()
+	assert.Equal(t, []string{`building>starting`, `starting>ready`, `ready>crashed`}, events)
+	mu.Unlock()
+}
+
+// TestInstanceHelperProcess 是 TestInstanceKillWhileStarting 和 TestCleanOrphans 中运行的应用进程
+func TestInstanceHelperProcess(t *testing.T) {
+	if os.Getenv(`TOWER_TEST_INSTANCE`) != `1` {
+		return
+	}
+	time.Sleep(30 * time.Second)
+}
+
+func TestInstanceKillWhileStarting(t *testing.T) {
+	app := NewApp(context.Background(), `main.go`, `6001`, ``, ``)
+	unsubscribe := app.Subscribe(func(e InstanceEvent) {
+		if e.To == StateStarting {
+			// 进程尚未启动
+			assert.Nil(t, e.Instance.Process())
+			assert.NoError(t, e.Instance.kill())
+		}
+	})
+	defer unsubscribe()
+	inst := newInstance(app, `6001`, StateBuilding)
+	cmd := exec.Command(os.Args[0], `-test.run=^TestInstanceHelperProcess$`)
+	cmd.Env = append(os.Environ(), `TOWER_TEST_INSTANCE=1`)
+	assert.NoError(t, inst.start(cmd, NewStderrCapturer(app, `6001`)))
+	select {
+	case <-inst.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal(`the instance was not killed`)
+	}
+	// 状态在 Done 之前已经转换
+	assert.Equal(t, StateStopped, inst.State())
+}
+
+func TestSingleCall(t *testing.T) {
+	var (
+		call  singleCall
+		calls atomic.Int32
+		wg    sync.WaitGroup
+	)
+	release := make(chan struct{})
+	errCall := errors.New(`failed`)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := call.Do(func() error {
+				calls.Add(1)
+				<-release
+				return errCall
+			})
+			assert.Equal(t, errCall, err)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+
+	// a later call runs again
+	assert.NoError(t, call.Do(func() error {
+		calls.Add(1)
+		return nil
+	}))
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestPortAllocation(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	busy := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	assert.False(t, isFreePort(busy))
+	ln.Close()
+	assert.True(t, isFreePort(busy))
+
+	port, err := kernelFreePort()
+	assert.NoError(t, err)
+	assert.True(t, isFreePort(port))
+
+	app := NewApp(context.Background(), `main.go`, `0`, ``, ``)
+	app.RunParams = []string{`-addr`, `:` + PortTemplateVar}
+	assert.True(t, app.SupportMutiPort())
+	assert.False(t, app.DisabledVisitPort())
+	assert.NotEqual(t, `0`, app.Port())
+
+	vars := InstanceVars{Port: `6001`, BuildID: `123`, Instance: `2`}
+	assert.Equal(t, []string{`-addr`, `:6001`, `build-123-2`}, expandTemplates([]string{`-addr`, `:{{.Port}}`, `build-{{.BuildID}}-{{.Instance}}`}, vars))
+	assert.Contains(t, vars.Environ(), `TOWER_PORT=6001`)
+}
+
+func TestInstanceDrain(t *testing.T) {
+	app := NewApp(context.Background(), `main.go`, `6001`, ``, ``)
+	inst := newInstance(app, `6001`, StateBuilding)
+	inst.transition(StateStarting)
+	inst.transition(StateReady)
+
+	release := inst.Acquire()
+	inst.Acquire()() // released immediately
+	assert.Equal(t, int64(1), inst.InFlight())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		release()
+		release() // released only once
+	}()
+	started := time.Now()
+	inst.drain(10 * time.Second)
+	assert.Equal(t, StateDraining, inst.State())
+	assert.Equal(t, int64(0), inst.InFlight())
+	assert.Less(t, time.Since(started), 5*time.Second)
+
+	inst.Acquire()
+	started = time.Now()
+	inst.drain(300 * time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(started), 300*time.Millisecond)
+	assert.Equal(t, int64(1), inst.InFlight())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// trackingListener 记录代理接受的客户端连接，用于在连接关闭时释放升级后的连接(websocket)占用的实例
+type trackingListener struct {
+	net.Listener
+	conns *sync.Map // remoteAddr => *trackedConn
+}
+
+func newTrackingListener(l net.Listener) *trackingListener {
+	return &trackingListener{Listener: l, conns: &sync.Map{}}
+}
+
+// Wrap 返回记录 other 接受的连接的 trackingListener，与 l 共享 OnClose 使用的连接记录(用于 HTTPS 端口)
+func (l *trackingListener) Wrap(other net.Listener) *trackingListener {
+	return &trackingListener{Listener: other, conns: l.conns}
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	tc := &trackedConn{Conn: c, listener: l, addr: c.RemoteAddr().String()}
+	l.conns.Store(tc.addr, tc)
+	return tc, nil
+}
+
+// OnClose 在来自 remoteAddr 的连接关闭时调用 fn，找不到连接时返回 false
+func (l *trackingListener) OnClose(remoteAddr string, fn func()) bool {
+	v, ok := l.conns.Load(remoteAddr)
+	if !ok {
+		return false
+	}
+	return v.(*trackedConn).onClose(fn)
+}
+
+type trackedConn struct {
+	net.Conn
+	listener *trackingListener
+	addr     string
+	mu       sync.Mutex
+	closed   bool
+	closers  []func()
+}
+
+func (c *trackedConn) onClose(fn func()) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.closers = append(c.closers, fn)
+	return true
+}
+
+func (c *trackedConn) Close() error {
+	c.mu.Lock()
+	closers := c.closers
+	first := !c.closed
+	c.closed = true
+	c.closers = nil
+	c.mu.Unlock()
+	if first {
+		c.listener.conns.CompareAndDelete(c.addr, c)
+	}
+	for _, fn := range closers {
+		fn()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/webx-top/reverseproxy"
+)
+
+const (
+	// LiveReloadPath 页面订阅 live reload 事件的地址(server-sent events)
+	LiveReloadPath = `/tower-proxy/livereload`
+	// LiveReloadScriptPath 注入到页面中的 live reload 脚本的地址
+	LiveReloadScriptPath = `/tower-proxy/livereload.js`
+	// StylesheetReloadDelay CSS 文件更改后等待的时间，期间的多次更改只通知一次
+	StylesheetReloadDelay = 100 * time.Millisecond
+	// liveReloadEventBuffer 每个页面缓冲的事件数量
+	liveReloadEventBuffer = 16
+)
+
+// liveReloadTag 注入到 text/html 响应中的脚本标签
+const liveReloadTag = `<script src="` + LiveReloadScriptPath + `"></script>`
+
+// LiveReloadEvent 是推送给页面的事件: reload(刷新页面)、css(替换样式表，Data 为文件名)或 failed(显示编译错误，Data 为错误信息)
+type LiveReloadEvent struct {
+	Name string
+	Data string
+}
+
+// LiveReload 将应用的编译结果和 CSS 文件的更改推送给注入了 live reload 脚本的页面(proxy.liveReload)
+type LiveReload struct {
+	mu          sync.Mutex
+	subscribers map[chan LiveReloadEvent]struct{}
+	timers      map[string]*time.Timer
+}
+
+func NewLiveReload() *LiveReload {
+	return &LiveReload{
+		subscribers: make(map[chan LiveReloadEvent]struct{}),
+		timers:      make(map[string]*time.Timer),
+	}
+}
+
+// Publish 将事件发送给所有页面，处理不及时的页面会丢弃事件
+func (l *LiveReload) Publish(e LiveReloadEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ch := range l.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe 返回后续的事件
+func (l *LiveReload) Subscribe() (events <-chan LiveReloadEvent, cancel func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ch := make(chan LiveReloadEvent, liveReloadEventBuffer)
+	l.subscribers[ch] = struct{}{}
+	return ch, func() {
+		l.mu.Lock()
+		delete(l.subscribers, ch)
+		l.mu.Unlock()
+	}
+}
+
+// Watch 订阅 app 的编译和启动: 新的实例开始提供服务后刷新页面，编译或启动失败时显示错误
+func (l *LiveReload) Watch(ctx context.Context, app *App) {
+	_, events, cancel := app.BuildLog.Subscribe()
+	defer cancel()
+	started := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			switch {
+			case e.Reset:
+				started = true
+			case e.Done && started:
+				// 订阅时立即收到的结束事件是上一次的结果，忽略
+				started = false
+				if e.Err != nil {
+					l.Publish(LiveReloadEvent{Name: `failed`, Data: e.Err.Error()})
+				} else {
+					l.Publish(LiveReloadEvent{Name: `reload`})
+				}
+			}
+		}
+	}
+}
+
+// ReloadStylesheet 通知页面重新加载 CSS 文件 file(不刷新页面)。多个服务监控同一个目录时只通知一次
+func (l *LiveReload) ReloadStylesheet(file string) {
+	name := filepath.Base(file)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t, ok := l.timers[name]; ok {
+		t.Reset(StylesheetReloadDelay)
+		return
+	}
+	l.timers[name] = time.AfterFunc(StylesheetReloadDelay, func() {
+		l.mu.Lock()
+		delete(l.timers, name)
+		l.mu.Unlock()
+		l.Publish(LiveReloadEvent{Name: `css`, Data: name})
+	})
+}
+
+// isStylesheet 是否是 CSS 文件
+func isStylesheet(file string) bool {
+	return strings.EqualFold(filepath.Ext(file), `.css`)
+}
+
+// handleLiveReload 以 server-sent events 推送 live reload 事件
+func (this *Proxy) handleLiveReload(ctx reverseproxy.Context) error {
+	if this.LiveReload == nil {
+		ctx.SetStatusCode(http.StatusNotFound)
+		return nil
+	}
+	events, cancel := this.LiveReload.Subscribe()
+	streamEvents(ctx, func(w io.Writer, flush func() error) {
+		defer cancel()
+		writeHeartbeat(w)
+		if flush() != nil {
+			return
+		}
+		ticker := time.NewTicker(SSEHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case e := <-events:
+				writeEvent(w, e.Name, e.Data)
+			case <-ticker.C:
+				writeHeartbeat(w)
+			case <-this.ctx.Done():
+				return
+			}
+			if flush() != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// handleLiveReloadScript 输出注入到页面中的脚本
+func (this *Proxy) handleLiveReloadScript(ctx reverseproxy.Context) error {
+	if this.LiveReload == nil {
+		ctx.SetStatusCode(http.StatusNotFound)
+		return nil
+	}
+	ctx.SetHeader(`Content-Type`, `application/javascript; charset=utf-8`)
+	ctx.SetHeader(`Cache-Control`, `no-cache`)
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetBody([]byte(liveReloadScript))
+	return nil
+}
+
+// canInjectLiveReload 是否可以向响应中注入 live reload 脚本: 未压缩的 text/html 并且有响应体
+func canInjectLiveReload(status int, contentType string, contentEncoding string) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if len(contentEncoding) > 0 && !strings.EqualFold(contentEncoding, `identity`) {
+		return false
+	}
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(contentType)), `text/html`)
+}
+
+// injectLiveReload 在 </body> 之前(没有时在末尾)插入 live reload 脚本
+func injectLiveReload(body []byte) []byte {
+	if bytes.Contains(body, []byte(LiveReloadScriptPath)) {
+		return body
+	}
+	i := bytes.LastIndex(bytes.ToLower(body), []byte(`</body>`))
+	if i < 0 {
+		return append(body, liveReloadTag...)
+	}
+	return slices.Concat(body[:i], []byte(liveReloadTag), body[i:])
+}
+
+// prepareLiveReload 去掉浏览器打开页面的请求的 Accept-Encoding，使应用返回未压缩的 HTML 以便注入脚本
+func (this *Proxy) prepareLiveReload(ctx reverseproxy.Context) {
+	if this.LiveReload != nil && isNavigation(ctx) {
+		delRequestHeader(ctx, `Accept-Encoding`)
+	}
+}
+
+// injectLiveReloadFast 向 fast 引擎的响应中注入 live reload 脚本。standard 引擎由 LiveReload.Handler 处理
+func (this *Proxy) injectLiveReloadFast(ctx reverseproxy.Context) {
+	r, ok := ctx.(*reverseproxy.FastResponse)
+	if !ok || this.LiveReload == nil || !isNavigation(ctx) || r.Response.IsBodyStream() {
+		return
+	}
+	if canInjectLiveReload(r.Response.StatusCode(), string(r.Response.Header.ContentType()), string(r.Response.Header.Peek(`Content-Encoding`))) {
+		r.Response.SetBody(injectLiveReload(r.Response.Body()))
+	}
+}
+
+// Handler 返回向 standard 引擎的 text/html 响应中注入 live reload 脚本的 http.Handler
+func (l *LiveReload) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isNavigation(&reverseproxy.NativeResponse{RespWriter: w, Request: r}) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		lw := &liveReloadWriter{ResponseWriter: w}
+		h.ServeHTTP(lw, r)
+		lw.finish()
+	})
+}
+
+// liveReloadWriter 缓存 text/html 响应，结束后注入脚本再输出。其它响应直接输出
+type liveReloadWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	inject      bool
+	status      int
+	buf         bytes.Buffer
+}
+
+func (w *liveReloadWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	if status >= http.StatusContinue && status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	w.inject = canInjectLiveReload(status, h.Get(`Content-Type`), h.Get(`Content-Encoding`))
+	if w.inject {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *liveReloadWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.inject {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush 注入脚本的响应在结束时一起输出
+func (w *liveReloadWriter) Flush() {
+	if w.inject {
+		return
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *liveReloadWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *liveReloadWriter) finish() {
+	if !w.inject {
+		return
+	}
+	body := injectLiveReload(w.buf.Bytes())
+	w.Header().Set(`Content-Length`, strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
+// liveReloadScript 订阅 LiveReloadPath: reload 时刷新页面，css 时替换同名的样式表，failed 时显示编译错误
+const liveReloadScript = `(function(){
+  if(window.__towerLiveReload||!window.EventSource)return;
+  window.__towerLiveReload=true;
+  var overlay;
+  function showError(message){
+    if(!overlay){
+      overlay=document.createElement('pre');
+      overlay.setAttribute('style','position:fixed;top:0;left:0;right:0;bottom:0;z-index:2147483647;margin:0;padding:24px;overflow:auto;'+
+        'background:rgba(24,24,24,.94);color:#f2f2f2;font:13px/1.5 Menlo,Consolas,monospace;white-space:pre-wrap;cursor:pointer');
+      overlay.title='Click to close';
+      overlay.onclick=function(){overlay.remove();overlay=null;};
+    }
+    overlay.textContent='Build failed\n\n'+message;
+    document.body.appendChild(overlay);
+  }
+  function reloadStylesheet(name){
+    var links=document.querySelectorAll('link[rel~="stylesheet"][href]');
+    var matched=[];
+    for(var i=0;i<links.length;i++){
+      var path=new URL(links[i].href,location.href).pathname;
+      if(path.substring(path.lastIndexOf('/')+1)===name)matched.push(links[i]);
+    }
+    if(!matched.length)matched=links;
+    for(var j=0;j<matched.length;j++){
+      var url=new URL(matched[j].href,location.href);
+      url.searchParams.set('tower-reload',Date.now());
+      matched[j].href=url.href;
+    }
+  }
+  var events=new EventSource('` + LiveReloadPath + `');
+  events.addEventListener('reload',function(){location.reload();});
+  events.addEventListener('css',function(e){reloadStylesheet(e.data);});
+  events.addEventListener('failed',function(e){showError(e.data);});
+})();
+`
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveReload(t *testing.T) {
+	assert.Equal(t, `<body>x`+liveReloadTag+`</BODY>`, string(injectLiveReload([]byte(`<body>x</BODY>`))))
+	assert.Equal(t, `<p>x</p>`+liveReloadTag, string(injectLiveReload([]byte(`<p>x</p>`))))
+	assert.True(t, canInjectLiveReload(http.StatusNotFound, `text/html; charset=utf-8`, ``))
+	assert.False(t, canInjectLiveReload(http.StatusOK, `text/html`, `gzip`))
+	assert.False(t, canInjectLiveReload(http.StatusNotModified, `text/html`, ``))
+	assert.False(t, canInjectLiveReload(http.StatusOK, `application/json`, ``))
+
+	lr := NewLiveReload()
+	handler := lr.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/json` {
+			w.Header().Set(`Content-Type`, `application/json`)
+			io.WriteString(w, `{}`)
+			return
+		}
+		w.Header().Set(`Content-Type`, `text/html`)
+		w.Header().Set(`Content-Length`, `26`)
+		io.WriteString(w, `<html><body></body></html>`)
+	}))
+	for path, want := range map[string]string{`/`: `<html><body>` + liveReloadTag + `</body></html>`, `/json`: `{}`} {
+		req := httptest.NewRequest(`GET`, path, nil)
+		req.Header.Set(`Accept`, `text/html`)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, want, rec.Body.String())
+		if path == `/` {
+			assert.Equal(t, strconv.Itoa(len(want)), rec.Header().Get(`Content-Length`))
+		}
+	}
+
+	events, cancel := lr.Subscribe()
+	defer cancel()
+	lr.ReloadStylesheet(filepath.Join(`static`, `app.css`))
+	lr.ReloadStylesheet(filepath.Join(`public`, `app.css`))
+	select {
+	case e := <-events:
+		assert.Equal(t, LiveReloadEvent{Name: `css`, Data: `app.css`}, e)
+	case <-time.After(time.Second):
+		t.Fatal(`no css event`)
+	}
+	assert.Len(t, events, 0)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// 应用输出的日志格式(app.logFormat)
+const (
+	LogFormatJSON   = `json`   // log/slog JSONHandler、zap、logrus 等输出的 JSON
+	LogFormatLogfmt = `logfmt` // log/slog TextHandler 等输出的 key=value
+	LogFormatText   = `text`   // 普通文本，只根据行中的级别名称着色和筛选
+)
+
+// LogMessageWidth 美化输出时消息的对齐宽度
+const LogMessageWidth = 40
+
+// 日志级别，按严重程度递增
+const (
+	LogLevelUnknown = iota
+	LogLevelDebug
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+	LogLevelFatal
+)
+
+var (
+	logLevelNames = map[string]int{
+		`trace`:   LogLevelDebug,
+		`debug`:   LogLevelDebug,
+		`info`:    LogLevelInfo,
+		`notice`:  LogLevelInfo,
+		`warn`:    LogLevelWarn,
+		`warning`: LogLevelWarn,
+		`error`:   LogLevelError,
+		`err`:     LogLevelError,
+		`dpanic`:  LogLevelError,
+		`panic`:   LogLevelFatal,
+		`fatal`:   LogLevelFatal,
+		`crit`:    LogLevelFatal,
+	}
+	logLevelLabels = map[int]string{
+		LogLevelDebug: `DEBUG`,
+		LogLevelInfo:  `INFO `,
+		LogLevelWarn:  `WARN `,
+		LogLevelError: `ERROR`,
+		LogLevelFatal: `FATAL`,
+	}
+	logLevelColors = map[int]string{
+		LogLevelDebug: "\x1b[90m",
+		LogLevelInfo:  "\x1b[36m",
+		LogLevelWarn:  "\x1b[33m",
+		LogLevelError: "\x1b[31m",
+		LogLevelFatal: "\x1b[1;31m",
+	}
+
+	// 不同日志库使用的字段名称
+	logTimeKeys    = []string{`time`, `ts`, `timestamp`, `@timestamp`}
+	logLevelKeys   = []string{`level`, `lvl`, `severity`}
+	logMessageKeys = []string{`msg`, `message`}
+	logStackKeys   = []string{`stack`, `stacktrace`, `trace`, `error.stack`}
+	logErrorKeys   = []string{`err`, `error`}
+
+	regexTextLogLevel = regexp.MustCompile(`\b(TRACE|DEBUG|INFO|NOTICE|WARN|WARNING|ERROR|ERR|FATAL|PANIC|CRIT)\b`)
+)
+
+const (
+	colorReset = "\x1b[0m"
+	colorFaint = "\x1b[2m"
+)
+
+// ParseLogLevel 解析级别名称，支持 slog 的 "ERROR+2" 形式，无法识别时返回 LogLevelUnknown
+func ParseLogLevel(name string) int {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if p := strings.IndexAny(name, `+-`); p > 0 {
+		name = name[:p]
+	}
+	return logLevelNames[name]
+}
+
+// LogAttr 是日志记录中的一个字段
+type LogAttr struct {
+	Key   string
+	Value string
+}
+
+// LogRecord 是从应用输出的一行中解析出的日志记录
+type LogRecord struct {
+	Time    time.Time
+	Level   int
+	Message string
+	Stack   string
+	Attrs   []LogAttr
+}
+
+// Attr 返回字段的值
+func (r *LogRecord) Attr(key string) (string, bool) {
+	for _, attr := range r.Attrs {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return ``, false
+}
+
+// ErrorReport 将带有调用栈的错误级别记录转换为 extractAppErrorInfo 能够解析的格式。不是错误或没有调用栈时返回空字符串
+func (r *LogRecord) ErrorReport() string {
+	if r.Level < LogLevelError || len(strings.TrimSpace(r.Stack)) == 0 {
+		return ``
+	}
+	message := r.Message
+	for _, key := range logErrorKeys {
+		if v, ok := r.Attr(key); ok && len(v) > 0 {
+			message += `: ` + v
+			break
+		}
+	}
+	if len(message) == 0 {
+		message = `error logged by application`
+	}
+	var attrs []string
+	for _, attr := range r.Attrs {
+		attrs = append(attrs, attr.Key+`=`+attr.Value)
+	}
+	// 字段单独一行，不影响错误信息的解析，但可以用来匹配请求 ID
+	return message + "\n" + strings.Join(attrs, ` `) + "\n\n" + strings.TrimSpace(r.Stack)
+}
+
+// LogFormatter 解析应用输出的结构化日志并美化显示
+type LogFormatter struct {
+	Format   string
+	MinLevel int      //低于此级别的记录不在终端显示
+	Attrs    []string //要显示的字段，为空时显示全部
+	Color    bool
+}
+
+// NewLogFormatter 创建 format 格式的 LogFormatter，format 为空时返回 nil(原样输出)
+func NewLogFormatter(format string, minLevel string, attrs []string) (*LogFormatter, error) {
+	format = strings.ToLower(format)
+	switch format {
+	case ``:
+		return nil, nil
+	case LogFormatJSON, LogFormatLogfmt, LogFormatText:
+	default:
+		return nil, errors.New(`unsupported logFormat: ` + format)
+	}
+	f := &LogFormatter{Format: format, Attrs: attrs, Color: isTerminal(os.Stdout)}
+	if len(minLevel) > 0 {
+		f.MinLevel = ParseLogLevel(minLevel)
+		if f.MinLevel == LogLevelUnknown {
+			return nil, errors.New(`unsupported logMinLevel: ` + minLevel)
+		}
+	}
+	return f, nil
+}
+
+// isTerminal 输出到终端时才使用颜色。设置了 NO_COLOR 环境变量时不使用颜色
+func isTerminal(f *os.File) bool {
+	if len(os.Getenv(`NO_COLOR`)) > 0 {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Parse 解析一行输出，不是日志记录时返回 nil
+func (f *LogFormatter) Parse(line string) *LogRecord {
+	if f == nil {
+		return nil
+	}
+	switch f.Format {
+	case LogFormatJSON:
+		return parseJSONLog(line)
+	case LogFormatLogfmt:
+		return parseLogfmt(line)
+	case LogFormatText:
+		return parseTextLog(line)
+	}
+	return nil
+}
+
+// Visible 是否在终端显示此记录
+func (f *LogFormatter) Visible(r *LogRecord) bool {
+	return r.Level == LogLevelUnknown || r.Level >= f.MinLevel
+}
+
+// Pretty 以 "时间 级别 消息 字段" 的形式输出一条记录
+func (f *LogFormatter) Pretty(r *LogRecord) string {
+	var b strings.Builder
+	if f.Format == LogFormatText {
+		// 普通文本只着色
+		f.colorize(&b, logLevelColors[r.Level], r.Message)
+		return b.String()
+	}
+	if r.Time.IsZero() {
+		b.WriteString(`            `)
+	} else {
+		f.colorize(&b, colorFaint, r.Time.Local().Format(`15:04:05.000`))
+	}
+	b.WriteString(` `)
+	label, ok := logLevelLabels[r.Level]
+	if !ok {
+		label = `     `
+	}
+	f.colorize(&b, logLevelColors[r.Level], label)
+	b.WriteString(` `)
+	b.WriteString(r.Message)
+	attrs := f.attrs(r)
+	if len(attrs) > 0 {
+		if n := utf8.RuneCountInString(r.Message); n < LogMessageWidth {
+			b.WriteString(strings.Repeat(` `, LogMessageWidth-n))
+		}
+		for _, attr := range attrs {
+			b.WriteString(` `)
+			f.colorize(&b, colorFaint, attr.Key+`=`)
+			b.WriteString(quoteLogValue(attr.Value))
+		}
+	}
+	if len(r.Stack) > 0 {
+		b.WriteString("\n")
+		f.colorize(&b, colorFaint, strings.TrimRight(r.Stack, "\n"))
+	}
+	return b.String()
+}
+
+func (f *LogFormatter) attrs(r *LogRecord) []LogAttr {
+	if len(f.Attrs) == 0 {
+		return r.Attrs
+	}
+	var attrs []LogAttr
+	for _, key := range f.Attrs {
+		if v, ok := r.Attr(key); ok {
+			attrs = append(attrs, LogAttr{Key: key, Value: v})
+		}
+	}
+	return attrs
+}
+
+func (f *LogFormatter) colorize(b *strings.Builder, color string, s string) {
+	if !f.Color || len(color) == 0 {
+		b.WriteString(s)
+		return
+	}
+	b.WriteString(color + s + colorReset)
+}
+
+func quoteLogValue(v string) string {
+	if len(v) == 0 || strings.ContainsAny(v, " \t\r\n\"=") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// newLogRecord 从有序的字段中取出时间、级别、消息和调用栈
+func newLogRecord(attrs []LogAttr) *LogRecord {
+	r := &LogRecord{}
+	var found bool
+	for _, attr := range attrs {
+		switch {
+		case r.Time.IsZero() && slices.Contains(logTimeKeys, attr.Key):
+			r.Time = parseLogTime(attr.Value)
+			if !r.Time.IsZero() {
+				found = true
+				continue
+			}
+		case r.Level == LogLevelUnknown && slices.Contains(logLevelKeys, attr.Key):
+			r.Level = ParseLogLevel(attr.Value)
+			if r.Level != LogLevelUnknown {
+				found = true
+				continue
+			}
+		case len(r.Message) == 0 && slices.Contains(logMessageKeys, attr.Key):
+			r.Message = attr.Value
+			found = true
+			continue
+		case len(r.Stack) == 0 && slices.Contains(logStackKeys, attr.Key) && strings.Contains(attr.Value, "\n"):
+			r.Stack = attr.Value
+			continue
+		}
+		r.Attrs = append(r.Attrs, attr)
+	}
+	if !found {
+		return nil
+	}
+	return r
+}
+
+// parseLogTime 支持 RFC3339 格式和 Unix 时间戳(秒，zap 的默认格式)
+func parseLogTime(v string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9))
+	}
+	return time.Time{}
+}
+
+// parseJSONLog 按原有顺序解析 JSON 对象的字段，嵌套的对象和数组保持 JSON 格式
+func parseJSONLog(line string) *LogRecord {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, `{`) {
+		return nil
+	}
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil
+	}
+	var attrs []LogAttr
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil
+		}
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			return nil
+		}
+		attrs = append(attrs, LogAttr{Key: key, Value: jsonLogValue(raw)})
+	}
+	return newLogRecord(attrs)
+}
+
+func jsonLogValue(raw json.RawMessage) string {
+	var s string
+	if len(raw) > 0 && raw[0] == '"' && json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var b bytes.Buffer
+	if json.Compact(&b, raw) == nil {
+		return b.String()
+	}
+	return string(raw)
+}
+
+// parseLogfmt 解析 key=value 形式的记录，值可以使用双引号和转义字符
+func parseLogfmt(line string) *LogRecord {
+	var attrs []LogAttr
+	s := strings.TrimSpace(line)
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || strings.ContainsAny(s[:eq], " \t\"") {
+			return nil
+		}
+		key := s[:eq]
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil
+			}
+			v, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return nil
+			}
+			value = v
+			s = s[end+1:]
+		} else {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			value = s[:end]
+			s = s[end:]
+		}
+		attrs = append(attrs, LogAttr{Key: key, Value: value})
+		s = strings.TrimLeft(s, " \t")
+	}
+	return newLogRecord(attrs)
+}
+
+// parseTextLog 根据行中的级别名称(例如 "[ERROR]")识别级别
+func parseTextLog(line string) *LogRecord {
+	m := regexTextLogLevel.FindString(regexANSIColor.ReplaceAllString(line, ``))
+	if len(m) == 0 {
+		return nil
+	}
+	return &LogRecord{Level: ParseLogLevel(m), Message: line}
+}
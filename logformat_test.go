@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogFormat(t *testing.T) {
+	f, err := NewLogFormatter(LogFormatJSON, `info`, nil)
+	assert.NoError(t, err)
+	f.Color = false
+	rec := f.Parse(`{"time":"2024-05-01T10:20:30.123Z","level":"INFO","msg":"started","port":6001,"tags":["a","b"]}`)
+	if assert.NotNil(t, rec) {
+		assert.Equal(t, LogLevelInfo, rec.Level)
+		assert.Equal(t, `started`, rec.Message)
+		assert.Equal(t, []LogAttr{{`port`, `6001`}, {`tags`, `["a","b"]`}}, rec.Attrs)
+		assert.Equal(t, `INFO  started`+strings.Repeat(` `, LogMessageWidth-7)+` port=6001 tags="[\"a\",\"b\"]"`, f.Pretty(rec)[13:])
+		assert.True(t, f.Visible(rec))
+	}
+	assert.Nil(t, f.Parse(`plain text`))
+	assert.False(t, f.Visible(f.Parse(`{"level":"DEBUG","msg":"x"}`)))
+	assert.Equal(t, LogLevelError, f.Parse(`{"level":"ERROR+2","msg":"x"}`).Level)
+
+	// zap: 时间戳为秒，调用栈在 stacktrace 字段
+	rec = f.Parse(`{"level":"error","ts":1714558830.5,"msg":"query failed","error":"timeout","stacktrace":"main.handler\n\t/app/main.go:20\nnet/http.HandlerFunc.ServeHTTP\n\t/go/src/net/http/server.go:2136"}`)
+	if assert.NotNil(t, rec) {
+		assert.Equal(t, int64(1714558830), rec.Time.Unix())
+		report := rec.ErrorReport()
+		assert.True(t, strings.HasPrefix(report, "query failed: timeout\nerror=timeout\n\nmain.handler\n\t/app/main.go:20"))
+		message, trace, _ := extractAppErrorInfo(report)
+		assert.Equal(t, []string{`query failed: timeout`}, message)
+		assert.Len(t, trace, 2)
+	}
+
+	f, err = NewLogFormatter(LogFormatLogfmt, ``, []string{`user`})
+	assert.NoError(t, err)
+	rec = f.Parse(`time=2024-05-01T10:20:30.123+08:00 level=WARN msg="slow query" user=admin sql="select \"x\""`)
+	if assert.NotNil(t, rec) {
+		assert.Equal(t, LogLevelWarn, rec.Level)
+		assert.Equal(t, `slow query`, rec.Message)
+		v, _ := rec.Attr(`sql`)
+		assert.Equal(t, `select "x"`, v)
+		assert.Equal(t, []LogAttr{{`user`, `admin`}}, f.attrs(rec))
+		assert.Empty(t, rec.ErrorReport())
+	}
+	assert.Nil(t, f.Parse(`listening on :8080`))
+	assert.Nil(t, f.Parse(`a=b trailing words`))
+
+	f, _ = NewLogFormatter(LogFormatText, `warn`, nil)
+	assert.Equal(t, LogLevelError, f.Parse(`2024/05/01 [ERROR] failed`).Level)
+	assert.Nil(t, f.Parse(`information`))
+	_, err = NewLogFormatter(`xml`, ``, nil)
+	assert.Error(t, err)
+	_, err = NewLogFormatter(LogFormatJSON, `verbose`, nil)
+	assert.Error(t, err)
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/admpub/confl"
@@ -29,7 +34,7 @@ func init() {
 const ConfigName = "tower.yml"
 
 var (
-	app               App
+	app               *App
 	build             = "1"
 	proxyListenAddr   string
 	proxyListenPort   uint
@@ -38,9 +43,14 @@ var (
 	buildAppendParams string
 	runAppendParams   string
 	debugPort         int
+	envProfile        string
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == SocketActivationArg {
+		runSocketActivation(os.Args[2:])
+		return
+	}
 	defer log.Close()
 	flag.StringVar(&c.Conf.ConfigFile, "c", ConfigName, "yaml configuration file location.")
 	flag.StringVar(&proxyListenAddr, "proxy.listenAddr", proxyListenAddr, "")
@@ -50,6 +60,7 @@ func main() {
 	flag.StringVar(&buildAppendParams, "build.appendParams", buildAppendParams, "")
 	flag.StringVar(&runAppendParams, "run.appendParams", runAppendParams, "")
 	flag.IntVar(&debugPort, `debug.port`, 0, "--debug.port 8844")
+	flag.StringVar(&envProfile, "env.profile", "", "also load .env.<profile> and .env.<profile>.local")
 	prod := flag.String("prod", "", "Production mode")
 
 	flag.Parse()
@@ -264,6 +275,10 @@ func startTower(ctx context.Context) {
 			log.Error(err.Error())
 		}
 	} else {
+		var raw map[string]interface{}
+		if _, err := confl.DecodeFile(configFile, &raw); err == nil {
+			c.Conf.MarkSet(raw)
+		}
 		c.Conf.Watch.IgnoredPath = strings.Replace(c.Conf.Watch.IgnoredPath, `\\`, `\`, -1)
 		if len(c.Conf.App.BuildDir) == 0 {
 			c.Conf.App.BuildDir, _ = os.Getwd()
@@ -307,6 +322,13 @@ func startTower(ctx context.Context) {
 	}
 
 	log.DefaultLog.SetLevel(c.Conf.LogLevel)
+	state, err := OpenStateFile(filepath.Join(c.Conf.App.BuildDir, StateDir))
+	if err != nil {
+		log.Error(`Error: `, err)
+		log.Close()
+		os.Exit(1)
+	}
+	state.CleanOrphans()
 	if len(c.Conf.Proxy.Port) > 0 {
 		listenAddr := c.Conf.Proxy.ListenAddr()
 		err := dialAddress(listenAddr, 1)
@@ -315,6 +337,12 @@ func startTower(ctx context.Context) {
 			os.Exit(1)
 		}
 	}
+	services := c.Conf.Services()
+	if len(c.Conf.Apps) > 0 && !allowBuild {
+		log.Warn(`== apps is only supported when building from source, running app only`)
+		services = []c.App{c.Conf.App}
+	}
+	apps := make([]*App, len(services))
 	if !allowBuild {
 		if strings.Contains(c.Conf.App.ExecFile, `*`) {
 			orgiMainFile := c.Conf.App.ExecFile
@@ -331,68 +359,256 @@ func startTower(ctx context.Context) {
 			time.Sleep(time.Second * 300)
 			return
 		}
-		app = NewApp(ctx, c.Conf.App.ExecFile, c.Conf.App.Port, c.Conf.App.BuildDir, c.Conf.App.PortParamName)
+		services[0] = c.Conf.App
+		apps[0] = NewApp(ctx, c.Conf.App.ExecFile, c.Conf.App.Port, c.Conf.App.BuildDir, c.Conf.App.PortParamName)
 	} else {
-		if len(c.Conf.App.BuildDir) == 0 {
-			c.Conf.App.MainFile, _ = filepath.Abs(c.Conf.App.MainFile)
-			c.Conf.App.BuildDir = filepath.Dir(c.Conf.App.MainFile)
+		cleared := map[string]bool{}
+		for i, conf := range services {
+			if len(conf.BuildDir) == 0 {
+				conf.MainFile, _ = filepath.Abs(conf.MainFile)
+				conf.BuildDir = filepath.Dir(conf.MainFile)
+			}
+			if c.Conf.AutoClear && !cleared[conf.BuildDir] {
+				cleared[conf.BuildDir] = true
+				removeBinFiles(conf.BuildDir)
+			}
+			apps[i] = NewApp(ctx, conf.MainFile, conf.Port, conf.BuildDir, conf.PortParamName)
+			if len(conf.Name) > 0 {
+				apps[i].Name = conf.Name
+			}
+			services[i] = conf
 		}
-		if c.Conf.AutoClear {
-			err := filepath.Walk(c.Conf.App.BuildDir, func(filePath string, info os.FileInfo, e error) (err error) {
-				if e != nil {
-					return e
-				}
-				if info.IsDir() {
-					return
-				}
-				name := info.Name()
-				if strings.HasPrefix(name, BinPrefix) {
-					err = os.Remove(filePath)
-					if err != nil {
-						if os.IsNotExist(err) {
-							err = nil
-						}
-						return
-					}
-				}
-				return
-			})
+	}
+	app = apps[0]
+	var proxy *Proxy
+	var liveReload *LiveReload
+	if c.Conf.Proxy.LiveReload {
+		liveReload = NewLiveReload()
+	}
+	faults := newFaults()
+	for i, a := range apps {
+		a.State = state
+		configureApp(a, services[i])
+		watcher := newAppWatcher(ctx, a, services[i], allowBuild, _suffix)
+		if len(apps) > 1 {
+			// 共享的包更改时只重新编译依赖它的服务
+			watcher.Filter = a.DependsOn
+		}
+		if liveReload != nil {
+			watcher.OnStylesheet = liveReload.ReloadStylesheet
+		}
+		go func(ctx context.Context) {
+			mustSuccess(watcher.Watch(ctx))
+		}(ctx)
+		if a.IdleTimeout > 0 && !a.DisabledVisitPort() {
+			go a.watchIdle(ctx)
+		}
+		go a.monitorResources(ctx)
+		if len(a.ForwardSignals) > 0 {
+			go a.forwardSignals(ctx)
+		}
+		p := NewProxy(ctx, a, watcher)
+		configureProxy(p)
+		if liveReload != nil {
+			p.LiveReload = liveReload
+			go liveReload.Watch(ctx, a)
+		}
+		p.Faults = faults
+		if i == 0 {
+			proxy = p
+			a.Console.Watcher = watcher
+			a.Console.Rebuild = watcher.OnChanged
+			a.Console.URL = proxyURL(c.Conf.Proxy.ListenAddr())
+			continue
+		}
+		if len(services[i].Host) == 0 && len(services[i].Path) == 0 {
+			log.Warn(`== ` + a.Name + `: set host or path to route requests to it`)
+		}
+		proxy.Routes = append(proxy.Routes, &ProxyRoute{Host: services[i].Host, Path: services[i].Path, Proxy: p})
+		// 由第一个服务的控制台统一处理
+		a.Console = app.Console
+		app.Console.Services = append(app.Console.Services, &Service{App: a, Watcher: watcher, Rebuild: watcher.OnChanged})
+	}
+	proxy.Port = c.Conf.Proxy.Port
+	if len(c.Conf.Proxy.Routes) > 0 {
+		proxies := []*Proxy{proxy}
+		for _, r := range proxy.Routes {
+			proxies = append(proxies, r.Proxy)
+		}
+		for i, conf := range c.Conf.Proxy.Routes {
+			route, err := NewPathRoute(conf, proxies)
 			if err != nil {
+				log.Errorf(`== Invalid proxy.routes[%d]: %v`, i, err)
+				continue
+			}
+			log.Info(`== Route: `, route)
+			proxy.PathRoutes = append(proxy.PathRoutes, route)
+		}
+	}
+	if len(c.Conf.Proxy.TLS.Port) > 0 {
+		if proxy.CA, err = newLocalCA(services); err != nil {
+			log.Error(`== Failed to load local CA: `, err)
+		} else {
+			proxy.TLSPort = c.Conf.Proxy.TLS.Port
+		}
+	}
+	if len(c.Conf.Sidecars) > 0 {
+		sidecars, err := newSidecars(app, state)
+		if err != nil {
+			log.Error(err)
+		} else {
+			app.Console.Sidecars = sidecars
+			// sidecar 在单独的进程组中运行，收不到终端的 "^C"，需要由 tower 停止
+			app.ListenConsole(ctx)
+			if err = sidecars.Start(ctx); err != nil {
 				log.Error(err)
 			}
 		}
-		app = NewApp(ctx, c.Conf.App.MainFile, c.Conf.App.Port, c.Conf.App.BuildDir, c.Conf.App.PortParamName)
 	}
-	app.OfflineMode = c.Conf.Offline
+	for _, a := range apps {
+		err = a.Start(ctx, true, a.Port())
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	mustSuccess(proxy.Listen())
+}
+
+// removeBinFiles 删除 dir 中以前编译生成的可执行文件(autoClear)
+func removeBinFiles(dir string) {
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, e error) (err error) {
+		if e != nil {
+			return e
+		}
+		if info.IsDir() {
+			return
+		}
+		name := info.Name()
+		if strings.HasPrefix(name, BinPrefix) {
+			err = os.Remove(filePath)
+			if err != nil {
+				if os.IsNotExist(err) {
+					err = nil
+				}
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// configureApp 应用配置文件中 app(或 apps 中的一项)的设置
+func configureApp(app *App, conf c.App) {
+	var err error
 	app.DisabledLogRequest = !c.Conf.LogRequest
-	app.PkgMirrors = c.Conf.App.PkgMirrors
-	app.Env = append(app.Env, c.Conf.App.Env...)
-	if len(c.Conf.App.RunParams) > 0 {
-		app.RunParams = parseParams(c.Conf.App.RunParams)
+	app.PkgMirrors = conf.PkgMirrors
+	app.Env = append(app.Env, conf.Env...)
+	if len(envProfile) > 0 {
+		conf.EnvProfile = envProfile
+	}
+	// .env 文件在应用目录(app.main 所在的目录)中，监控文件更改时会监控这个目录
+	if root, err := filepath.Abs(app.Root); err == nil {
+		app.EnvFiles = EnvFiles(root, conf.EnvProfile)
+	}
+	if _, err := app.LoadEnv(); err != nil {
+		log.Error(`== Failed to load env files: `, err)
+	}
+	app.PanicDetectors, err = NewPanicDetectors(conf.PanicPatterns)
+	if err != nil {
+		log.Error(err)
+	}
+	if len(conf.SlowRequest) > 0 {
+		app.SlowRequest, err = time.ParseDuration(conf.SlowRequest)
+		if err != nil {
+			log.Error(`invalid slowRequest: `, err)
+		}
 	}
-	if len(c.Conf.App.BuildParams) > 0 {
-		app.BuildParams = parseParams(c.Conf.App.BuildParams)
+	if len(conf.DrainTimeout) > 0 {
+		app.DrainTimeout, err = time.ParseDuration(conf.DrainTimeout)
+		if err != nil {
+			log.Error(`invalid drainTimeout: `, err)
+		}
+	}
+	app.Logs.Formatter, err = NewLogFormatter(conf.LogFormat, conf.LogMinLevel, conf.LogAttrs)
+	if err != nil {
+		log.Error(err)
+	}
+	if conf.LogFile {
+		dir := AppLogDir
+		if len(c.Conf.Apps) > 0 {
+			dir = filepath.Join(dir, app.Name)
+		}
+		if err := app.Logs.OpenFile(dir); err != nil {
+			log.Error(err)
+		}
+	}
+	switch conf.Stdin {
+	case ``:
+	case StdinPassthrough:
+		app.StdinPassthrough = true
+	default:
+		log.Error(`invalid stdin: `, conf.Stdin)
 	}
-	app.BeforeBuildGenerate = c.Conf.App.Generate
+	if len(conf.IdleTimeout) > 0 {
+		app.IdleTimeout, err = time.ParseDuration(conf.IdleTimeout)
+		if err != nil {
+			log.Error(`invalid idleTimeout: `, err)
+		}
+	}
+	app.Limits, err = NewResourceLimits(conf.Limits)
+	if err != nil {
+		log.Error(err)
+	}
+	configureSignals(app, conf)
+	app.PprofPath = conf.PprofPath
+	app.HangSigquit = conf.HangSigquit
+	app.SocketActivation = conf.SocketActivation
+	if len(conf.RunParams) > 0 {
+		app.RunParams = parseParams(conf.RunParams)
+	}
+	if len(conf.BuildParams) > 0 {
+		app.BuildParams = parseParams(conf.BuildParams)
+	}
+	app.BeforeBuildGenerate = conf.Generate
+	if conf.Replicas > 1 {
+		if app.SupportMutiPort() {
+			app.Replicas = conf.Replicas
+		} else {
+			log.Warn(`== replicas requires a port range (e.g. 5001-5010) or port 0, and portParamName, socketActivation or {{.Port}} in params/env: running a single instance`)
+		}
+	}
+}
+
+// newAppWatcher 返回监控应用文件更改的 Watcher，文件更改后编译并切换到新的实例(或者运行新的可执行文件)
+func newAppWatcher(ctx context.Context, app *App, conf c.App, allowBuild bool, suffix string) *Watcher {
 	watchedDir := app.Root
 	if !allowBuild {
 		if len(app.BuildDir) > 0 {
 			watchedDir = app.BuildDir
 		}
 	}
-	if len(c.Conf.Watch.OtherDir) > 0 {
+	if len(conf.Watch) > 0 {
+		watchedDir = strings.Join(conf.Watch, `|`)
+	} else if len(c.Conf.Watch.OtherDir) > 0 {
 		watchedDir = c.Conf.Watch.OtherDir + "|" + watchedDir
 	}
 	watcher := NewWatcher(watchedDir, c.Conf.Watch.FileExtension, c.Conf.Watch.IgnoredPath)
-	proxy := NewProxy(ctx, &app, &watcher)
-	proxy.AdminPwd = c.Conf.Admin.Password
-	proxy.Engine = c.Conf.Proxy.Engine
-	if len(c.Conf.Admin.IPs) > 0 {
-		proxy.AdminIPs = strings.Split(c.Conf.Admin.IPs, `,`)
+	watcher.Reloads = newReloadRules(app)
+	watcher.EnvFiles = app.EnvFiles
+	watcher.OnEnvChanged = func() {
+		app.reloadEnv(ctx)
+	}
+	watcher.OnReload = func(sig os.Signal) {
+		if err := app.Signal(sig); err != nil {
+			log.Error(`== Reload: `, err)
+		}
 	}
 	if allowBuild {
 		watcher.OnChanged = func() {
-			port, err := getPort()
+			port, err := getPort(app)
 			if err != nil {
 				log.Error(err)
 				return
@@ -404,7 +620,7 @@ func startTower(ctx context.Context) {
 		}
 	} else {
 		watcher.OnChanged = func() {
-			port, err := getPort()
+			port, err := getPort(app)
 			if err != nil {
 				log.Error(err)
 				return
@@ -416,34 +632,178 @@ func startTower(ctx context.Context) {
 			}
 		}
 		watcher.OnlyWatchBin = true
-		watcher.FileNameSuffix = _suffix
+		watcher.FileNameSuffix = suffix
 		app.DisabledBuild = true
 	}
-	proxy.Port = c.Conf.Proxy.Port
-	go func(ctx context.Context) {
-		mustSuccess(watcher.Watch(ctx))
-	}(ctx)
-	err = app.Start(ctx, true, app.Port)
+	return &watcher
+}
+
+// configureSignals 解析 app.reloadSignal 和 app.forwardSignals
+func configureSignals(app *App, conf c.App) {
+	var err error
+	if len(conf.ReloadSignal) > 0 {
+		if app.ReloadSignal, err = parseSignal(conf.ReloadSignal); err != nil {
+			log.Error(`invalid reloadSignal: `, err)
+		}
+	} else {
+		app.ReloadSignal, _ = parseSignal(DefaultReloadSignal)
+	}
+	for _, name := range conf.ForwardSignals {
+		sig, err := parseSignal(name)
+		if err != nil {
+			log.Error(`invalid forwardSignals: `, err)
+			continue
+		}
+		if sig == os.Interrupt || sig == syscall.SIGTERM {
+			log.Warn(`== forwardSignals: ` + signalName(sig) + ` stops tower and is not forwarded`)
+			continue
+		}
+		app.ForwardSignals = append(app.ForwardSignals, sig)
+	}
+}
+
+// newReloadRules 根据 watch.reload 创建软重载规则
+func newReloadRules(app *App) (rules []*ReloadRule) {
+	for _, conf := range c.Conf.Watch.Reload {
+		re, err := regexp.Compile(conf.Pattern)
+		if err != nil {
+			log.Error(`invalid watch.reload pattern: `, err)
+			continue
+		}
+		sig := app.ReloadSignal
+		if len(conf.Signal) > 0 || sig == nil {
+			sig, err = parseSignal(cmp.Or(conf.Signal, DefaultReloadSignal))
+		}
+		if err != nil {
+			log.Error(`invalid watch.reload signal: `, err)
+			continue
+		}
+		rules = append(rules, &ReloadRule{Pattern: re, Signal: sig})
+	}
+	return
+}
+
+// newSidecars 根据配置文件中的 sidecars 创建 Sidecars，输出记录在 app 的日志中
+func newSidecars(app *App, state *StateFile) (*Sidecars, error) {
+	list := make([]*Sidecar, len(c.Conf.Sidecars))
+	for i, conf := range c.Conf.Sidecars {
+		s := &Sidecar{
+			Name:      conf.Name,
+			Dir:       conf.Dir,
+			Env:       conf.Env,
+			Ready:     conf.Ready,
+			Restart:   conf.Restart,
+			DependsOn: conf.DependsOn,
+		}
+		if len(conf.Command) > 0 {
+			s.Args = parseParams(conf.Command)
+		}
+		if len(conf.ReadyTimeout) > 0 {
+			var err error
+			s.ReadyTimeout, err = time.ParseDuration(conf.ReadyTimeout)
+			if err != nil {
+				return nil, fmt.Errorf(`sidecar %s: invalid readyTimeout: %w`, conf.Name, err)
+			}
+		}
+		list[i] = s
+	}
+	return NewSidecars(list, app.Logs, state)
+}
+
+// configureProxy 应用配置文件中 proxy 和 admin 的设置
+func configureProxy(proxy *Proxy) {
+	var err error
+	proxy.AdminPwd = c.Conf.Admin.Password
+	proxy.Engine = c.Conf.Proxy.Engine
+	if len(c.Conf.Proxy.HoldTimeout) > 0 {
+		proxy.HoldTimeout, err = time.ParseDuration(c.Conf.Proxy.HoldTimeout)
+		if err != nil {
+			log.Error(`invalid holdTimeout: `, err)
+		}
+	}
+	if len(c.Conf.Proxy.Timeout) > 0 {
+		proxy.Timeout, err = time.ParseDuration(c.Conf.Proxy.Timeout)
+		if err != nil {
+			log.Error(`invalid timeout: `, err)
+		}
+	}
+	if len(c.Conf.Proxy.Balance) > 0 {
+		if IsBalanceStrategy(c.Conf.Proxy.Balance) {
+			proxy.Balancer.Strategy = c.Conf.Proxy.Balance
+		} else {
+			log.Error(`invalid balance: `, c.Conf.Proxy.Balance)
+		}
+	}
+	if len(c.Conf.Admin.IPs) > 0 {
+		proxy.AdminIPs = strings.Split(c.Conf.Admin.IPs, `,`)
+	}
+}
+
+// newFaults 解析 proxy.faults，没有规则时返回 nil
+func newFaults() *Faults {
+	if len(c.Conf.Proxy.Faults) == 0 {
+		return nil
+	}
+	faults := &Faults{}
+	for i, conf := range c.Conf.Proxy.Faults {
+		if len(conf.Name) == 0 {
+			conf.Name = `fault` + strconv.Itoa(i+1)
+		}
+		rule, err := NewFaultRule(conf)
+		if err == nil && faults.Rule(rule.Name) != nil {
+			err = fmt.Errorf(`duplicate name: %s`, rule.Name)
+		}
+		if err != nil {
+			log.Errorf(`== Invalid proxy.faults[%d]: %v`, i, err)
+			continue
+		}
+		log.Info(`== Fault: `, rule)
+		faults.Rules = append(faults.Rules, rule)
+	}
+	return faults
+}
+
+// newLocalCA 读取或生成 proxy.tls 的本地 CA，允许为 proxy.tls.hosts 和各服务的 host 签发证书
+func newLocalCA(services []c.App) (*LocalCA, error) {
+	dir := c.Conf.Proxy.TLS.Dir
+	if len(dir) == 0 {
+		dir = DefaultTLSDir()
+	}
+	hosts := slices.Clone(c.Conf.Proxy.TLS.Hosts)
+	for _, conf := range services {
+		if len(conf.Host) > 0 {
+			hosts = append(hosts, conf.Host)
+		}
+	}
+	return NewLocalCA(dir, hosts)
+}
+
+// proxyURL 返回在浏览器中访问代理的地址
+func proxyURL(listenAddr string) string {
+	host, port, err := net.SplitHostPort(listenAddr)
 	if err != nil {
-		log.Error(err)
+		return `http://` + listenAddr
 	}
-	mustSuccess(proxy.Listen())
+	if len(host) == 0 || host == `0.0.0.0` || host == `::` {
+		host = `localhost`
+	}
+	return `http://` + net.JoinHostPort(host, port)
 }
 
-func getPort() (port string, err error) {
-	port = app.Port
+func getPort(app *App) (port string, err error) {
+	port = app.Port()
 	if !app.DisabledVisitPort() {
 		if !app.SupportMutiPort() {
 			err = errors.New(`Unspecified switchable other ports.`)
 			return
 		}
 		port = app.UseRandPort()
-		for i := 0; i < 3 && port == app.Port; i++ {
+		for i := 0; i < 3 && port == app.Port(); i++ {
 			app.Clean()
 			time.Sleep(time.Second)
 			port = app.UseRandPort()
 		}
-		if port == app.Port {
+		if port == app.Port() {
 			err = errors.New(`取得的端口与当前端口相同，无法编译切换`)
 		}
 	}
@@ -35,7 +35,7 @@ func TestCmd(t *testing.T) {
 
 	assert.Equal(t, "server 1", get("http://127.0.0.1:8080/"))
 	assert.Equal(t, "server 1", get("http://127.0.0.1:8080/?k=v1&k=v2&k1=v3")) // Test logging parameters
-	assert.Equal(t, "server 1", get("http://127.0.0.1:"+app.Port+"/"))
+	assert.Equal(t, "server 1", get("http://127.0.0.1:"+app.Port()+"/"))
 
 	app.Clean()
 	concurrency := 10
@@ -58,6 +58,10 @@ func TestCmd(t *testing.T) {
 	// test app exits unexpectedly
 	assert.Contains(t, get("http://127.0.0.1:8080/exit"), "App quit unexpetedly") // should restart the application
 
+	// test panic outside HTTP handlers
+	assert.Contains(t, get("http://127.0.0.1:8080/crash"), "panic: Crash !!") // should show the crash output
+	assert.Contains(t, get("http://127.0.0.1:8080/"), "server 1")             // should restart the application
+
 	// test error page
 	highlightCode := `<dd class="codes bold">&nbsp;&nbsp;&nbsp;&nbsp;`
 	assert.Contains(t, get("http://127.0.0.1:8080/panic"), "Panic !!")                          // should be able to detect panic
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"html"
 	"html/template"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -35,11 +37,40 @@ func init() {
 	}
 }
 
-func RenderError(ctx reverseproxy.Context, app *App, message string) {
+func RenderError(ctx reverseproxy.Context, app *App, message string, status ...int) {
 	info := ErrorInfo{Title: "Error", Message: template.HTML(message)}
 	info.Prepare()
 
-	renderPage(ctx, info)
+	renderPage(ctx, info, status...)
+}
+
+// RenderBuilding 编译中页面: 显示编译的输出，新的实例就绪后自动刷新
+func RenderBuilding(ctx reverseproxy.Context, app *App) {
+	lines, _, cancel := app.BuildLog.Subscribe()
+	cancel()
+	info := ErrorInfo{
+		Title:        "Building…",
+		Message:      template.HTML(html.EscapeString(app.Name) + ` is being rebuilt. This page will refresh when it is ready.`),
+		BuildLines:   lines,
+		ShowBuilding: true,
+	}
+	info.Prepare()
+	ctx.SetHeader(`Retry-After`, `1`)
+	ctx.SetHeader(`Cache-Control`, `no-store`)
+	renderPage(ctx, info, http.StatusServiceUnavailable)
+}
+
+// RenderStarting 应用因为空闲而停止后重新启动时的页面，就绪后自动刷新
+func RenderStarting(ctx reverseproxy.Context, app *App) {
+	info := ErrorInfo{
+		Title:        "Starting…",
+		Message:      template.HTML(html.EscapeString(app.Name) + fmt.Sprintf(` was stopped after %v without requests and is starting again. This page will refresh when it is ready.`, app.IdleTimeout)),
+		ShowBuilding: true,
+	}
+	info.Prepare()
+	ctx.SetHeader(`Retry-After`, `1`)
+	ctx.SetHeader(`Cache-Control`, `no-store`)
+	renderPage(ctx, info, http.StatusServiceUnavailable)
 }
 
 func RenderBuildError(ctx reverseproxy.Context, app *App, message string) {
@@ -51,15 +82,31 @@ func RenderBuildError(ctx reverseproxy.Context, app *App, message string) {
 
 const SnippetLineNumbers = 13
 
-func RenderAppError(ctx reverseproxy.Context, app *App, errMessage string) {
+func RenderAppError(ctx reverseproxy.Context, app *App, errMessage string, req *RequestSnapshot, crashes ...*AppCrash) {
 	info := ErrorInfo{Title: "Application Error"}
+	if req != nil {
+		info.Request = NewRequestInfo(req)
+		info.ShowRequest = true
+	}
 	message, trace, appIndex := extractAppErrorInfo(errMessage)
+	if len(message) == 0 {
+		message = []string{strings.TrimSpace(errMessage)}
+	}
 
-	// from: 2013/02/12 18:24:15 http: panic serving 127.0.0.1:54114: Validation Error
-	//   to: Validation Error
-	message[0] = regexIP4Prefix.ReplaceAllString(message[0], "")
-	if !strings.Contains(message[0], "runtime error") {
-		message[0] = "panic: " + message[0]
+	if len(crashes) > 0 && crashes[0] != nil {
+		// panic or fatal error outside HTTP handlers: the process has exited.
+		crash := crashes[0]
+		info.Title = "Application Crashed"
+		info.ExitCode = crash.ExitCode
+		info.Signal = crash.Signal
+		info.ShowExit = true
+	} else {
+		// from: 2013/02/12 18:24:15 http: panic serving 127.0.0.1:54114: Validation Error
+		//   to: Validation Error
+		message[0] = regexIP4Prefix.ReplaceAllString(message[0], "")
+		if !strings.Contains(message[0], "runtime error") && !regexCrashStart.MatchString(message[0]) {
+			message[0] = "panic: " + message[0]
+		}
 	}
 
 	info.Message = template.HTML(strings.Join(message, "\n"))
@@ -80,8 +127,46 @@ func RenderAppError(ctx reverseproxy.Context, app *App, errMessage string) {
 	renderPage(ctx, info)
 }
 
-func renderPage(ctx reverseproxy.Context, info ErrorInfo) {
+// RenderAppHang 显示慢请求发生时应用的 goroutine 信息
+func RenderAppHang(ctx reverseproxy.Context, app *App, elapsed time.Duration, dump string, dumpErr error, req *RequestSnapshot) {
+	info := ErrorInfo{Title: "Application Hang"}
+	message := fmt.Sprintf("The request did not complete within %v.", elapsed.Round(time.Millisecond))
+	if req != nil {
+		info.Request = NewRequestInfo(req)
+		info.Request.Replayable = false
+		info.ShowRequest = true
+		message = req.Method + " " + req.URI + "\n" + message
+	}
+	if dumpErr != nil {
+		message += "\nFailed to get the goroutine dump: " + dumpErr.Error()
+	}
+	info.Message = template.HTML(html.EscapeString(message))
+	info.Goroutines = parseGoroutineDump(dump)
+	info.ShowGoroutines = len(info.Goroutines) > 0
+
+	// 显示第一个阻塞在应用代码中的 goroutine 所在的代码
+	if info.ShowGoroutines && info.Goroutines[0].Highlight() {
+		for _, tr := range info.Goroutines[0].Trace {
+			if !tr.AppFile {
+				continue
+			}
+			info.SnippetPath = tr.File
+			var err error
+			info.Snippet, err = extractAppSnippet(tr.File, tr.Line)
+			info.ShowSnippet = err == nil
+			break
+		}
+	}
+
+	info.Prepare()
+	renderPage(ctx, info)
+}
+
+func renderPage(ctx reverseproxy.Context, info ErrorInfo, status ...int) {
 	ctx.SetHeader(`Content-Type`, `text/html;charset=utf-8`)
+	if len(status) > 0 {
+		ctx.SetStatusCode(status[0])
+	}
 	err := errorTemplate.Execute(ctx.ResponseWriter(), info)
 	if err != nil {
 		panic(err)
@@ -173,12 +258,54 @@ type ErrorInfo struct {
 	Time    string
 	Message template.HTML
 
+	ExitCode int
+	Signal   string
+	ShowExit bool
+
 	Trace     []Trace
 	ShowTrace bool
 
 	SnippetPath string
 	Snippet     []Snippet
 	ShowSnippet bool
+
+	Request     *RequestInfo
+	ShowRequest bool
+
+	Goroutines     []Goroutine
+	ShowGoroutines bool
+
+	BuildLines   []string
+	ShowBuilding bool
+}
+
+// RequestInfo 是错误页面上显示的触发错误的请求
+type RequestInfo struct {
+	ID            string
+	Method        string
+	URL           string
+	Headers       []KV
+	Query         []KV
+	Form          []KV
+	Body          string
+	BodyTruncated bool
+	Curl          string
+	Replayable    bool
+}
+
+func NewRequestInfo(req *RequestSnapshot) *RequestInfo {
+	info := &RequestInfo{
+		ID:         req.ID,
+		Method:     req.Method,
+		URL:        req.URL(),
+		Headers:    req.MaskedHeaders(),
+		Query:      req.Query(),
+		Form:       req.Form(),
+		Curl:       req.Curl(),
+		Replayable: req.Replayable(),
+	}
+	info.Body, info.BodyTruncated = req.DisplayBody()
+	return info
 }
 
 type Snippet struct {
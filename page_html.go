@@ -28,7 +28,8 @@ var defaultPageHTML = `<!DOCTYPE html>
       }
       h2{font-size:20px;}
       .message{margin: 40px 0 60px 0;}
-      .snippet, .trace{
+      .exit{color: #929292;}
+      .snippet, .trace, .request, .goroutines{
         margin-left: -15px;
         padding:14px;
         border: 1px solid burlywood;
@@ -55,6 +56,18 @@ var defaultPageHTML = `<!DOCTYPE html>
       .trace ul li{margin-bottom: 10px;}
       .trace .func{color: #929292;}
       .clearfix{clear: both;}
+      .goroutines details{margin-bottom: 10px;}
+      .goroutines summary{cursor: pointer;}
+      .goroutines .blocked summary{font-weight: bold;color: #c0392b;}
+      .goroutines ul{list-style: none;padding-left: 15px;}
+      .goroutines ul li{margin-bottom: 6px;}
+      .goroutines .func{color: #929292;}
+      .request table{border-collapse: collapse;margin-bottom: 20px;width: 100%;}
+      .request td{padding: 4px 8px;border-bottom: 1px solid #eee;vertical-align: top;word-break: break-all;}
+      .request td.key{width: 200px;color: #929292;}
+      .request pre, .request pre *{font-family: Menlo, Consolas, monospace;font-size: 13px;}
+      .request pre{background: #f7f7f7;padding: 10px;overflow: auto;white-space: pre-wrap;word-break: break-all;}
+      .build{font-family: Menlo, Consolas, monospace;font-size: 13px;background: #f7f7f7;padding: 10px;max-height: 480px;overflow: auto;white-space: pre-wrap;}
     </style>
   </head>
   <body>
@@ -65,6 +78,9 @@ var defaultPageHTML = `<!DOCTYPE html>
     <div class="content">
       <div class="message">
         {{.Message}}
+        {{if .ShowExit}}
+        <p class="exit">Exit code: {{.ExitCode}}{{if .Signal}} | Signal: {{.Signal}}{{end}}</p>
+        {{end}}
         <p><a href="/tower-proxy/watch/restart" target="_blank">[Restart]</a>
         [
         Watcher:
@@ -76,6 +92,42 @@ var defaultPageHTML = `<!DOCTYPE html>
         ]</p>
       </div>
 
+      {{if .ShowBuilding}}
+      <h2>Build output</h2>
+      <pre id="tower-build" class="build">{{range .BuildLines}}{{.}}
+{{end}}</pre>
+      <noscript><meta http-equiv="refresh" content="2"></noscript>
+      <script>
+      (function(){
+        var out=document.getElementById('tower-build');
+        var events=new EventSource('/tower-proxy/build/progress');
+        var first=true;
+        events.onmessage=function(e){
+          if(first){out.textContent='';first=false;}
+          out.textContent+=e.data+'\n';
+          out.scrollTop=out.scrollHeight;
+        };
+        events.addEventListener('reset',function(){
+          out.textContent='';
+          first=false;
+        });
+        events.addEventListener('ready',function(){
+          events.close();
+          location.reload();
+        });
+        events.addEventListener('failed',function(e){
+          events.close();
+          out.textContent+='\nBuild failed:\n'+e.data+'\n';
+          out.scrollTop=out.scrollHeight;
+        });
+        events.onerror=function(){
+          events.close();
+          setTimeout(function(){location.reload();},1000);
+        };
+      })();
+      </script>
+      {{end}}
+
       {{if .ShowSnippet}}
       <h2>{{.SnippetPath}}</h2>
       <div class="snippet">
@@ -113,6 +165,76 @@ var defaultPageHTML = `<!DOCTYPE html>
         </ul>
       </div>
       {{end}}
+
+      {{if .ShowGoroutines}}
+      <h2>Goroutines</h2>
+      <div class="goroutines">
+        {{range .Goroutines}}
+        <details{{if .Highlight}} class="blocked" open{{end}}>
+          <summary>goroutine {{.ID}} [{{.State}}]{{if .Highlight}} - blocked in app code{{end}}</summary>
+          <ul>
+            {{range .Trace}}
+            <li>
+              {{if .AppFile}}<strong>{{.File}}:{{.Line}}</strong>{{else}}{{.File}}:{{.Line}}{{end}}
+              <br/>
+              <span class="func">{{.Func}}</span>
+            </li>
+            {{end}}
+          </ul>
+        </details>
+        {{end}}
+      </div>
+      {{end}}
+
+      {{if .ShowRequest}}{{with .Request}}
+      <h2>Request</h2>
+      <div class="request">
+        <p><strong>{{.Method}}</strong> {{.URL}}</p>
+        <h3>Headers</h3>
+        <table>
+          {{range .Headers}}<tr><td class="key">{{.Key}}</td><td>{{.Value}}</td></tr>{{end}}
+        </table>
+        {{if .Query}}
+        <h3>Query</h3>
+        <table>
+          {{range .Query}}<tr><td class="key">{{.Key}}</td><td>{{.Value}}</td></tr>{{end}}
+        </table>
+        {{end}}
+        {{if .Form}}
+        <h3>Form</h3>
+        <table>
+          {{range .Form}}<tr><td class="key">{{.Key}}</td><td>{{.Value}}</td></tr>{{end}}
+        </table>
+        {{end}}
+        {{if .Body}}
+        <h3>Body{{if .BodyTruncated}} (truncated){{end}}</h3>
+        <pre>{{.Body}}</pre>
+        {{end}}
+        <h3>curl</h3>
+        <pre id="tower-curl">{{.Curl}}</pre>
+        <p>
+          <button type="button" onclick="navigator.clipboard.writeText(document.getElementById('tower-curl').textContent)">Copy as curl</button>
+          {{if .Replayable}}
+          <button type="button" onclick="towerReplay('{{.ID}}')">Replay</button>
+          {{end}}
+        </p>
+        <pre id="tower-replay" style="display:none"></pre>
+      </div>
+      <script>
+      function towerReplay(id){
+        var out=document.getElementById('tower-replay');
+        out.style.display='block';
+        out.textContent='Replaying...';
+        fetch('/tower-proxy/replay?id='+encodeURIComponent(id),{method:'POST'}).then(function(r){
+          return r.text();
+        }).then(function(text){
+          out.textContent=text;
+        }).catch(function(err){
+          out.textContent=String(err);
+        });
+      }
+      </script>
+      {{end}}{{end}}
     </div>
   </body>
 </html>
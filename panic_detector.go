@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+	c "github.com/webx-top/tower/config"
+)
+
+const (
+	// PanicBlockMaxLines 单个 panic 输出块最多收集的行数
+	PanicBlockMaxLines = 500
+	// PanicBlockIdle 没有设置结束正则表达式时，超过此时间没有新的输出即认为 panic 输出块结束
+	PanicBlockIdle = 200 * time.Millisecond
+)
+
+var (
+	// PanicPresets 常用框架的 panic 恢复中间件的输出格式
+	PanicPresets = map[string][]c.PanicPattern{
+		// github.com/labstack/echo 和 github.com/webx-top/echo 的 middleware.Recover
+		`echo`: {{Start: `\[PANIC RECOVER\] `}},
+		// github.com/gin-gonic/gin 的 gin.Recovery
+		`gin`: {{Start: `\[Recovery\] .*panic recovered:`}},
+		// github.com/go-chi/chi 的 middleware.Recoverer
+		`chi`: {{Start: `^\s+panic: `}},
+	}
+
+	regexANSIColor       = regexp.MustCompile("\x1b\\[[0-9;]*m")
+	regexGoroutineHeader = regexp.MustCompile(`goroutine \d+ \[[^\]]+\]:\s*$`)
+	regexTraceFile       = regexp.MustCompile(`^\s*(?:->\s*)?(\S+\.go:\d+)(?:\s+(?:\+0x[0-9a-f]+|\(0x[0-9a-f]+\)))?\s*$`)
+)
+
+type panicBlock struct {
+	detector *PanicDetector
+	lines    []string
+	timer    *time.Timer
+	panic    *AppPanic
+}
+
+// PanicScanner 按行匹配应用的一个输出流(stdout 或 stderr)，匹配到的输出块结束后作为应用错误显示
+type PanicScanner struct {
+	app     *App
+	port    string
+	mu      sync.Mutex
+	pending []byte
+	block   *panicBlock
+}
+
+func NewPanicScanner(app *App, port string) *PanicScanner {
+	return &PanicScanner{app: app, port: port}
+}
+
+func (a *PanicScanner) Scan(p []byte) {
+	if len(a.app.PanicDetectors) == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending = append(a.pending, p...)
+	for {
+		i := bytes.IndexByte(a.pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(a.pending[:i])
+		a.pending = a.pending[i+1:]
+		a.scanLine(line)
+	}
+	if len(a.pending) > StderrBufferSize {
+		a.pending = a.pending[:0]
+	}
+}
+
+func (a *PanicScanner) scanLine(line string) {
+	plain := regexANSIColor.ReplaceAllString(line, ``)
+	if a.block == nil {
+		for _, detector := range a.app.PanicDetectors {
+			if detector.Start.MatchString(plain) {
+				a.block = &panicBlock{detector: detector, panic: a.app.Requests.Panicking(a.port)}
+				break
+			}
+		}
+		if a.block == nil {
+			return
+		}
+		block := a.block
+		block.timer = time.AfterFunc(PanicBlockIdle, func() {
+			a.mu.Lock()
+			if a.block == block {
+				a.finishBlock()
+			}
+			a.mu.Unlock()
+		})
+	}
+	a.block.lines = append(a.block.lines, line)
+	end := a.block.detector.End
+	if (end != nil && len(a.block.lines) > 1 && end.MatchString(plain)) || len(a.block.lines) >= PanicBlockMaxLines {
+		a.finishBlock()
+		return
+	}
+	a.block.timer.Reset(PanicBlockIdle)
+}
+
+func (a *PanicScanner) finishBlock() {
+	block := a.block
+	a.block = nil
+	block.timer.Stop()
+	a.app.Requests.Finish(block.panic, block.detector.Normalize(block.lines))
+	log.Warn(`== Panic detected: `, block.detector.Name)
+}
+
+// PanicScanWriter 在写入 w 的同时检测输出中的 panic
+type PanicScanWriter struct {
+	w       io.Writer
+	scanner *PanicScanner
+}
+
+func (a *PanicScanWriter) Write(p []byte) (int, error) {
+	a.scanner.Scan(p)
+	return a.w.Write(p)
+}
+
+// PanicDetector 通过起止正则表达式从应用输出中识别框架自行恢复的 panic
+type PanicDetector struct {
+	Name  string
+	Start *regexp.Regexp
+	End   *regexp.Regexp
+}
+
+func NewPanicDetectors(patterns []c.PanicPattern) (detectors []*PanicDetector, err error) {
+	for _, pattern := range patterns {
+		if len(pattern.Preset) > 0 {
+			presets, ok := PanicPresets[pattern.Preset]
+			if !ok {
+				return nil, errors.New(`unsupported panic preset: ` + pattern.Preset)
+			}
+			for _, preset := range presets {
+				var detector *PanicDetector
+				detector, err = NewPanicDetector(pattern.Preset, preset.Start, preset.End)
+				if err != nil {
+					return
+				}
+				detectors = append(detectors, detector)
+			}
+			continue
+		}
+		var detector *PanicDetector
+		detector, err = NewPanicDetector(pattern.Start, pattern.Start, pattern.End)
+		if err != nil {
+			return
+		}
+		detectors = append(detectors, detector)
+	}
+	return
+}
+
+func NewPanicDetector(name, start, end string) (detector *PanicDetector, err error) {
+	if len(start) == 0 {
+		return nil, errors.New(`panic pattern requires a start regex`)
+	}
+	detector = &PanicDetector{Name: name}
+	detector.Start, err = regexp.Compile(start)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid panic pattern %q: %w`, start, err)
+	}
+	if len(end) > 0 {
+		detector.End, err = regexp.Compile(end)
+		if err != nil {
+			return nil, fmt.Errorf(`invalid panic pattern %q: %w`, end, err)
+		}
+	}
+	return
+}
+
+// Normalize 将框架输出的 panic 信息转换为 extractAppErrorInfo 能够解析的标准格式:
+//
+//	message
+//
+//	func
+//		file:line
+func (d *PanicDetector) Normalize(lines []string) string {
+	type entry struct {
+		fn   string
+		file string
+	}
+	var (
+		message   string
+		entries   []entry
+		firstFile = -1
+	)
+	lines = expandJSONLogLines(lines)
+	for i, line := range lines {
+		line = strings.TrimRight(regexANSIColor.ReplaceAllString(line, ``), "\r")
+		lines[i] = line
+		if firstFile < 0 && regexTraceFile.MatchString(line) {
+			firstFile = i
+		}
+	}
+	if firstFile < 0 {
+		firstFile = len(lines)
+	}
+
+	// gin: file:line (0x..) 后面紧跟 "\tfunc: code"
+	fileFirst := firstFile+1 < len(lines) && strings.HasPrefix(lines[firstFile+1], "\t") && !regexTraceFile.MatchString(lines[firstFile+1])
+	traceStart := firstFile
+	if !fileFirst && firstFile > 0 && firstFile < len(lines) && len(strings.TrimSpace(lines[firstFile-1])) > 0 && !d.Start.MatchString(lines[firstFile-1]) {
+		traceStart = firstFile - 1
+	}
+
+	// 取 trace 之前最后一行有效内容作为错误信息(例如 gin 会先输出请求头)
+	for i := traceStart - 1; i >= 0; i-- {
+		line := regexGoroutineHeader.ReplaceAllString(lines[i], ``)
+		if loc := d.Start.FindStringIndex(line); loc != nil && len(strings.TrimSpace(line[loc[1]:])) > 0 {
+			line = line[loc[1]:]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasSuffix(line, `:`) {
+			continue
+		}
+		message = line
+		break
+	}
+
+	var fn string
+	for i := traceStart; i < len(lines); i++ {
+		line := lines[i]
+		if m := regexTraceFile.FindStringSubmatch(line); m != nil {
+			e := entry{file: m[1]}
+			if fileFirst {
+				if i+1 < len(lines) && !regexTraceFile.MatchString(lines[i+1]) {
+					i++
+					e.fn = strings.TrimSpace(lines[i])
+				}
+			} else {
+				e.fn = fn
+				fn = ``
+			}
+			if len(e.fn) == 0 {
+				e.fn = `?`
+			}
+			entries = append(entries, e)
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), `->`))
+		if len(line) == 0 || regexGoroutineHeader.MatchString(line) {
+			continue
+		}
+		fn = line
+	}
+	if len(message) == 0 {
+		message = `panic recovered by ` + d.Name
+	}
+	out := message + "\n"
+	for _, e := range entries {
+		out += "\n" + e.fn + "\n\t" + e.file
+	}
+	return out
+}
+
+// expandJSONLogLines 展开 JSON 格式的日志行(例如 labstack/echo 默认的日志格式)，将 message 中的多行内容拆分为独立的行
+func expandJSONLogLines(lines []string) []string {
+	expanded := make([]string, 0, len(lines))
+	for _, line := range lines {
+		plain := strings.TrimSpace(regexANSIColor.ReplaceAllString(line, ``))
+		if strings.HasPrefix(plain, `{`) && strings.HasSuffix(plain, `}`) {
+			var entry map[string]interface{}
+			if json.Unmarshal([]byte(plain), &entry) == nil {
+				message, ok := entry[`message`].(string)
+				if !ok {
+					message, ok = entry[`msg`].(string)
+				}
+				if ok {
+					expanded = append(expanded, strings.Split(strings.TrimRight(message, "\n"), "\n")...)
+					continue
+				}
+			}
+		}
+		expanded = append(expanded, line)
+	}
+	return expanded
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	c "github.com/webx-top/tower/config"
+)
+
+// test/panic 中是 gin v1.10.0 的 gin.Recovery、echo v4.11.4 的 middleware.Recover 和 chi v5.3.1 的 middleware.Recoverer 的实际输出
+func readPanicOutput(t *testing.T, name string) []string {
+	b, err := os.ReadFile(`test/panic/` + name + `.log`)
+	assert.NoError(t, err)
+	return strings.Split(string(b), "\n")
+}
+
+// detectPanic 返回第一个匹配到的输出块
+func detectPanic(detector *PanicDetector, lines []string) []string {
+	for i, line := range lines {
+		if detector.Start.MatchString(regexANSIColor.ReplaceAllString(line, ``)) {
+			return lines[i:]
+		}
+	}
+	return nil
+}
+
+func TestPanicDetectors(t *testing.T) {
+	detectors, err := NewPanicDetectors([]c.PanicPattern{{Preset: `gin`}, {Preset: `echo`}, {Preset: `chi`}})
+	assert.NoError(t, err)
+	assert.Len(t, detectors, 3)
+
+	block := detectPanic(detectors[0], readPanicOutput(t, `gin`))
+	assert.NotNil(t, block)
+	message, trace, _ := extractAppErrorInfo(detectors[0].Normalize(block))
+	assert.Equal(t, []string{`Panic !!`}, message)
+	assert.Equal(t, `/tmp/mw_gin/main.go`, trace[0].File)
+	assert.Equal(t, 13, trace[0].Line)
+	assert.Equal(t, "main.func1: r.GET(`/panic`, func(c *gin.Context) { panic(`Panic !!`) })", trace[0].Func)
+	assert.Len(t, trace, 8)
+
+	block = detectPanic(detectors[1], readPanicOutput(t, `echo`))
+	assert.NotNil(t, block)
+	message, trace, _ = extractAppErrorInfo(detectors[1].Normalize(block))
+	assert.Equal(t, []string{`Panic !!`}, message)
+	assert.Equal(t, `github.com/labstack/echo/v4/middleware.RecoverWithConfig.func1.1.1()`, trace[0].Func)
+	assert.Equal(t, `main.main.func1({0x4880cf?, 0x0?})`, trace[2].Func)
+	assert.Equal(t, `/tmp/mw_echo/main.go`, trace[2].File)
+	assert.Equal(t, 13, trace[2].Line)
+
+	block = detectPanic(detectors[2], readPanicOutput(t, `chi`))
+	assert.NotNil(t, block)
+	message, trace, _ = extractAppErrorInfo(detectors[2].Normalize(block))
+	assert.Equal(t, []string{`Panic !!`}, message)
+	assert.Equal(t, `main.main.func1`, trace[0].Func)
+	assert.Equal(t, `/tmp/mw_chi/main.go`, trace[0].File)
+	assert.Equal(t, 14, trace[0].Line)
+	assert.Equal(t, `net/http.HandlerFunc.ServeHTTP`, trace[1].Func)
+}
+
+func TestPanicScanWriter(t *testing.T) {
+	detectors, err := NewPanicDetectors([]c.PanicPattern{{Preset: `echo`}})
+	assert.NoError(t, err)
+	app := &App{Requests: NewRequestTracker(), PanicDetectors: detectors}
+	id := NewRequestID()
+	app.Requests.Begin(id, `6001`)
+
+	// echo 的日志默认输出到 stdout
+	stdout := &PanicScanWriter{w: io.Discard, scanner: NewPanicScanner(app, `6001`)}
+	for _, line := range readPanicOutput(t, `echo`) {
+		stdout.Write([]byte(line + "\n"))
+	}
+	message, _ := app.Requests.End(id)
+	assert.True(t, strings.HasPrefix(message, "Panic !!\n"))
+}
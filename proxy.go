@@ -4,43 +4,81 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/admpub/log"
 	"github.com/webx-top/reverseproxy"
 )
 
-const ProxyPort = "8080"
+const (
+	ProxyPort = "8080"
+	// DefaultHoldTimeout 编译或重启期间请求等待新实例就绪的默认最长时间
+	DefaultHoldTimeout = time.Minute
+	// HoldCheckInterval 等待编译或重启完成时检查的间隔
+	HoldCheckInterval = 100 * time.Millisecond
+)
 
 var errAppQuit = errors.New("== App quit unexpetedly")
 
 type Proxy struct {
 	App                 *App
-	appOldPort          string
 	ReserveProxy        reverseproxy.ReverseProxy
 	Watcher             *Watcher
-	FirstRequest        *sync.Once
-	upgraded            int64
+	upgraded            atomic.Int64
 	Port                string
 	AdminPwd            string
 	AdminIPs            []string
 	Engine              string
 	AutoRestartMaxTimes int
+	HoldTimeout         time.Duration //编译或重启期间请求等待的最长时间
+	Timeout             time.Duration //转发给应用的请求的超时时间(proxy.timeout)，为 0 时不限制
+	TLSPort             string        //HTTPS 端口(proxy.tls.port)，为空时只提供 HTTP
+	CA                  *LocalCA      //为 HTTPS 签发证书的本地 CA
+	LiveReload          *LiveReload   //不为 nil 时向页面注入 live reload 脚本(proxy.liveReload)
 	autoRestartTimes    int
-	waiting             *sync.Once
+	restartCall         singleCall
+	listener            *trackingListener
+	inFlight            sync.Map // 请求 ID => *proxyRequest
+	Balancer            *Balancer
+	Routes              []*ProxyRoute //apps 中的其它服务
+	PathRoutes          []*PathRoute  //proxy.routes，在 Routes 之前按顺序匹配
+	routed              sync.Map      // 请求 ID => 匹配的 *PathRoute
+	Faults              *Faults       //故障注入规则(proxy.faults)，为 nil 时不注入
+	faulted             sync.Map      // 请求 ID => *faultedRequest
+	handoff             *backendHandoff
 	ctx                 context.Context
 }
 
-func NewProxy(ctx context.Context, app *App, watcher *Watcher) (proxy Proxy) {
+// proxyRequest 是转发给应用的请求
+type proxyRequest struct {
+	inst    *Instance
+	release func()
+	cookie  string      //需要在响应中设置的 cookie(sticky 负载均衡)
+	hang    *hangReport //超过慢请求阈值时获取的 goroutine 信息
+}
+
+func NewProxy(ctx context.Context, app *App, watcher *Watcher) (proxy *Proxy) {
+	proxy = &Proxy{}
 	proxy.App = app
 	proxy.Watcher = watcher
 	proxy.Port = ProxyPort
 	proxy.AdminIPs = []string{`127.0.0.1`, `::1`}
 	proxy.AutoRestartMaxTimes = 3
-	proxy.waiting = &sync.Once{}
+	proxy.HoldTimeout = DefaultHoldTimeout
+	proxy.Balancer = &Balancer{Strategy: BalanceRoundRobin}
+	proxy.handoff = newBackendHandoff()
 	proxy.ctx = ctx
+	app.Subscribe(func(e InstanceEvent) {
+		// 记录新实例开始提供服务的时间
+		if e.To == StateReady && e.Instance.Port != app.Port() {
+			proxy.upgraded.Store(time.Now().Unix())
+		}
+	})
 	return
 }
 
@@ -72,9 +110,7 @@ func (this *Proxy) Listen() error {
 		<-make(chan int)
 		return nil
 	}
-	this.FirstRequest = &sync.Once{}
 	router := &ProxyRouter{Proxy: this}
-	router.dst = "http://localhost:" + app.Port
 	var engine string
 	if strings.ToLower(this.Engine) == `fast` {
 		this.ReserveProxy = &reverseproxy.FastReverseProxy{PassingBrowsingURL: true}
@@ -90,90 +126,393 @@ func (this *Proxy) Listen() error {
 	config := reverseproxy.ReverseProxyConfig{
 		Listen:          listenAddr,
 		Router:          router,
-		RequestIDHeader: "X-Request-ID",
+		RequestIDHeader: RequestIDHeader,
+		RequestTimeout:  this.Timeout,
 		ResponseBefore: func(ctx reverseproxy.Context) bool {
-			switch ctx.RequestPath() {
-			case "/tower-proxy/watch/restart":
-				this.handleWatchRestart(ctx)
-				return true
-
-			case "/tower-proxy/watch/pause":
-				this.handleWatchPause(ctx)
-				return true
-
-			case "/tower-proxy/watch/begin":
-				this.handleWatchBegin(ctx)
-				return true
-
-			case "/tower-proxy/watch":
-				this.handleWatchStatus(ctx)
+			assignRequestID(ctx)
+			if this.injectFault(ctx) {
 				return true
 			}
-
-			this.App.LastError = ""
-			if this.upgraded > 0 {
-				timeout := time.Now().Unix() - this.upgraded
-				if timeout > 3600 {
-					this.upgraded = 0
-				}
-				ctx.SetHeader(`X-Server-Upgraded`, fmt.Sprintf("%v", timeout))
+			var choice *backendChoice
+			var handled bool
+			if route := this.pathRoute(ctx); route != nil {
+				choice, handled = this.servePathRoute(ctx, route)
+			} else {
+				choice, handled = this.route(ctx).responseBefore(ctx)
 			}
-			if this.App.IsQuit() {
-				err := errAppQuit
-				this.waiting.Do(func() {
-					if !this.App.IsQuit() {
-						this.waiting = &sync.Once{}
-						return
-					}
-					for ; this.autoRestartTimes < this.AutoRestartMaxTimes; this.autoRestartTimes++ {
-						this.App.Stop(this.App.Port)
-						this.App.Clean()
-						var port string
-						port, err = getPort()
-						if err == nil {
-							err = this.App.Start(this.ctx, true, port)
-						}
-						if err == nil {
-							this.autoRestartTimes = 0
-							break
-						}
-						log.Error(err)
-					}
-					this.waiting = &sync.Once{}
-				})
-				if err != nil {
-					if this.App.buildErr != nil {
-						RenderBuildError(ctx, this.App, this.App.buildErr.Error())
-						return true
-					}
-					log.Warn(errAppQuit)
-					RenderError(ctx, this.App, "App quit unexpetedly.")
-					return true
-				}
+			if handled {
+				this.endFault(ctx, true)
+				return true
+			}
+			this.prepareLiveReload(ctx)
+			setForwardedProto(ctx)
+			if this.usesHandoff() {
+				this.handoff.Put(choice)
 			}
 			return false
 		},
 		ResponseAfter: func(ctx reverseproxy.Context) bool {
-			if len(this.App.LastError) != 0 {
-				RenderAppError(ctx, this.App, this.App.LastError)
-				return true
+			target := this.route(ctx)
+			if v, ok := this.routed.LoadAndDelete(requestHeader(ctx, RequestIDHeader)); ok {
+				// 路径可能已被改写，使用 ResponseBefore 中匹配的路由。转发给其它服务器的请求没有对应的服务
+				target = v.(*PathRoute).Proxy
 			}
-			if ctx.IsDead() {
-				RenderError(ctx, this.App, "App quit unexpetedly.")
+			var handled bool
+			if target != nil {
+				handled = target.responseAfter(ctx)
 			}
-			return false
+			this.injectLiveReloadFast(ctx)
+			this.endFault(ctx, false)
+			return handled
 		},
 	}
-	this.appOldPort = app.Port
 	err := this.ReserveProxy.Initialize(config)
 	if err != nil {
 		return err
 	}
-	log.Info("== Listening to " + router.dst)
+	log.Info("== Listening to " + router.dst())
 	log.Info(`== Server(`+engine+`) Address `, config.Listen)
-	err = this.ReserveProxy.Listen()
+	listener, err := net.Listen(`tcp`, config.Listen)
+	if err != nil {
+		return err
+	}
+	this.listener = newTrackingListener(listener)
+	for _, route := range this.Routes {
+		route.Proxy.listener = this.listener
+	}
+	if len(this.TLSPort) > 0 && this.CA != nil {
+		go func() {
+			if err := this.listenTLS(); err != nil {
+				log.Error(`== HTTPS: `, err)
+			}
+		}()
+	}
+	if rp, ok := this.ReserveProxy.(*reverseproxy.NativeReverseProxy); ok && (this.LiveReload != nil || this.Faults != nil || this.watchesHang()) {
+		// 需要包装 http.Handler 才能修改 standard 引擎的响应
+		server := &http.Server{Handler: this.nativeHandler(rp)}
+		return server.Serve(this.listener)
+	}
+	err = this.ReserveProxy.Listen(this.listener)
 	if err != nil {
 		return err
 	}
 	return this.ReserveProxy.Stop()
 }
+
+// nativeHandler 返回 standard 引擎使用的 http.Handler: 注入 live reload 脚本，然后限制响应速度
+func (this *Proxy) nativeHandler(rp *reverseproxy.NativeReverseProxy) http.Handler {
+	var handler http.Handler = rp
+	if this.watchesHang() {
+		handler = abortableHandler(handler)
+	}
+	if this.LiveReload != nil {
+		handler = this.LiveReload.Handler(handler)
+	}
+	if this.Faults != nil {
+		handler = this.Faults.Handler(handler)
+	}
+	return handler
+}
+
+// responseBefore 在转发前处理请求，handled 为 true 时不再转发。否则返回选择的实例
+func (this *Proxy) responseBefore(ctx reverseproxy.Context) (choice *backendChoice, handled bool) {
+	switch ctx.RequestPath() {
+	case "/tower-proxy/watch/restart":
+		this.handleWatchRestart(ctx)
+		return nil, true
+
+	case "/tower-proxy/watch/reload":
+		this.handleWatchReload(ctx)
+		return nil, true
+
+	case "/tower-proxy/watch/pause":
+		this.handleWatchPause(ctx)
+		return nil, true
+
+	case "/tower-proxy/watch/begin":
+		this.handleWatchBegin(ctx)
+		return nil, true
+
+	case "/tower-proxy/watch":
+		this.handleWatchStatus(ctx)
+		return nil, true
+
+	case "/tower-proxy/replay":
+		this.handleReplay(ctx)
+		return nil, true
+
+	case "/tower-proxy/build/progress":
+		this.handleBuildProgress(ctx)
+		return nil, true
+
+	case "/tower-proxy/logs":
+		this.handleLogs(ctx)
+		return nil, true
+
+	case "/tower-proxy/logs/stream":
+		this.handleLogStream(ctx)
+		return nil, true
+
+	case "/tower-proxy/metrics":
+		this.handleMetrics(ctx)
+		return nil, true
+
+	case "/tower-proxy/faults":
+		this.handleFaults(ctx)
+		return nil, true
+
+	case "/tower-proxy/faults/enable":
+		this.handleFaultsToggle(ctx, true)
+		return nil, true
+
+	case "/tower-proxy/faults/disable":
+		this.handleFaultsToggle(ctx, false)
+		return nil, true
+
+	case LiveReloadPath:
+		this.handleLiveReload(ctx)
+		return nil, true
+
+	case LiveReloadScriptPath:
+		this.handleLiveReloadScript(ctx)
+		return nil, true
+	}
+
+	this.App.touch()
+	if this.App.Idle() {
+		if isNavigation(ctx) {
+			go this.wake()
+			RenderStarting(ctx, this.App)
+			return nil, true
+		}
+		// 其它请求在 ChooseBackend 中启动应用后转发
+	}
+
+	if this.building() {
+		if isNavigation(ctx) {
+			RenderBuilding(ctx, this.App)
+			return nil, true
+		}
+		if !this.holdRequest() {
+			ctx.SetHeader(`Retry-After`, `1`)
+			RenderError(ctx, this.App, fmt.Sprintf("The application is still building after %v.", this.HoldTimeout), http.StatusServiceUnavailable)
+			return nil, true
+		}
+	}
+
+	if upgraded := this.upgraded.Load(); upgraded > 0 {
+		timeout := time.Now().Unix() - upgraded
+		if timeout > 3600 {
+			this.upgraded.CompareAndSwap(upgraded, 0)
+		}
+		ctx.SetHeader(`X-Server-Upgraded`, fmt.Sprintf("%v", timeout))
+	}
+	if this.App.IsQuit() && !this.App.Idle() {
+		crash := this.App.LastCrash()
+		err := this.restartQuitApp()
+		if crash != nil && crash.MarkReported() {
+			log.Warn(errAppQuit)
+			RenderAppError(ctx, this.App, crash.Output, nil, crash)
+			return nil, true
+		}
+		if err != nil {
+			if buildErr := this.App.BuildError(); buildErr != nil {
+				RenderBuildError(ctx, this.App, buildErr.Error())
+				return nil, true
+			}
+			log.Warn(errAppQuit)
+			RenderError(ctx, this.App, "App quit unexpetedly.")
+			return nil, true
+		}
+	}
+	id := requestID(ctx)
+	choice, cookie := this.chooseInstance(ctx)
+	inst := choice.inst
+	port := this.App.Port()
+	if inst != nil {
+		port = inst.Port
+	}
+	if isUpgradeRequest(ctx) {
+		// 升级后的连接在客户端连接关闭时才结束，不经过 ResponseAfter，因此不记录到 Requests
+		release := inst.Acquire()
+		if !this.listener.OnClose(ctx.RemoteAddr(), release) {
+			release()
+		}
+		return choice, false
+	}
+	if len(cookie) > 0 {
+		addResponseHeader(ctx, `Set-Cookie`, cookie)
+	}
+	snapshot := NewRequestSnapshot(ctx, id)
+	r := &proxyRequest{inst: inst, release: inst.Acquire(), cookie: cookie}
+	if this.App.SlowRequest > 0 {
+		r.hang = this.watchHang(port, snapshot, requestAbort(ctx))
+	}
+	this.inFlight.Store(id, r)
+	this.App.Requests.Begin(id, port, snapshot)
+	return choice, false
+}
+
+// responseAfter 在应用响应后检查应用错误、慢请求和崩溃，返回 true 时已经显示了错误页面
+func (this *Proxy) responseAfter(ctx reverseproxy.Context) bool {
+	id := requestHeader(ctx, RequestIDHeader)
+	port := this.App.Port()
+	var hang *hangReport
+	if v, ok := this.inFlight.LoadAndDelete(id); ok {
+		r := v.(*proxyRequest)
+		r.release()
+		if r.inst != nil {
+			port = r.inst.Port
+		}
+		if len(r.cookie) > 0 {
+			// fast 引擎在转发时会清空 ResponseBefore 中设置的响应头
+			addResponseHeader(ctx, `Set-Cookie`, r.cookie)
+		}
+		if r.hang != nil && r.hang.wait() {
+			hang = r.hang
+		}
+	}
+	if responseStatus(ctx) >= http.StatusInternalServerError {
+		this.App.Requests.AwaitPanic(id, ServerErrorWait)
+	}
+	message, req := this.App.Requests.End(id)
+	if len(message) != 0 {
+		RenderAppError(ctx, this.App, message, req)
+		return true
+	}
+	if hang != nil && (hang.aborted || ctx.IsDead() || responseStatus(ctx) >= http.StatusInternalServerError) {
+		// 慢请求被中止或最终失败(例如超过 proxy.timeout)时显示超过阈值时获取的 goroutine 信息
+		this.handleHang(ctx, hang, req)
+		return true
+	}
+	if ctx.IsDead() || this.App.IsQuit(port) || this.App.IsCrashing(port) {
+		// standard 引擎不会标记 IsDead，进程崩溃时可能还没有退出
+		crash := this.App.WaitCrash(time.Second, port)
+		if crash != nil && crash.MarkReported() {
+			RenderAppError(ctx, this.App, crash.Output, nil, crash)
+			return true
+		}
+	}
+	if ctx.IsDead() {
+		RenderError(ctx, this.App, "App quit unexpetedly.")
+	}
+	return false
+}
+
+// chooseInstance 选择处理请求的实例。运行多个实例(app.replicas)时按 Balancer 分配
+func (this *Proxy) chooseInstance(ctx reverseproxy.Context) (choice *backendChoice, cookie string) {
+	choice = &backendChoice{proxy: this, inst: this.App.Instance(), len: 1}
+	if this.App.Replicas <= 1 {
+		return
+	}
+	instances := this.App.Serving()
+	inst, idx, cookie := this.Balancer.Choose(ctx, instances)
+	if inst != nil {
+		choice.inst, choice.idx, choice.len = inst, idx, len(instances)
+	}
+	return choice, cookie
+}
+
+// usesHandoff 是否需要将 ResponseBefore 中的选择交给 ChooseBackend(ChooseBackend 只能获得 host)
+func (this *Proxy) usesHandoff() bool {
+	return len(this.Routes) > 0 || len(this.PathRoutes) > 0 || this.App.Replicas > 1
+}
+
+// building 是否正在编译或重启(包括监控到文件变化后等待编译的期间)
+func (this *Proxy) building() bool {
+	return this.Watcher.compiling.Load() || this.App.Busy()
+}
+
+// holdRequest 编译或重启期间暂缓转发请求，直到新的实例就绪。超过 HoldTimeout 时返回 false
+func (this *Proxy) holdRequest() bool {
+	ticker := time.NewTicker(HoldCheckInterval)
+	defer ticker.Stop()
+	deadline := time.Now().Add(this.HoldTimeout)
+	for this.building() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		<-ticker.C
+	}
+	return true
+}
+
+// restartQuitApp 重启意外退出的应用，并发的请求只会触发一次重启
+func (this *Proxy) restartQuitApp() error {
+	return this.restartCall.Do(func() (err error) {
+		if !this.App.IsQuit() {
+			return nil
+		}
+		err = errAppQuit
+		for ; this.autoRestartTimes < this.AutoRestartMaxTimes; this.autoRestartTimes++ {
+			this.App.Stop(this.App.Port())
+			this.App.Clean()
+			var port string
+			port, err = getPort(this.App)
+			if err == nil {
+				err = this.App.Start(this.ctx, true, port)
+			}
+			if err == nil {
+				this.autoRestartTimes = 0
+				break
+			}
+			log.Error(err)
+		}
+		return
+	})
+}
+
+// wake 启动因为空闲(app.idleTimeout)而停止的应用
+func (this *Proxy) wake() {
+	if err := this.App.Wake(this.ctx); err != nil {
+		log.Error(err)
+	}
+}
+
+// watchHang 在请求超过慢请求阈值时获取处理请求的实例(监听 port)的 goroutine 信息并记录到日志。
+// abort 不为 nil 时随后中止转发，由 responseAfter 显示 goroutine 信息
+func (this *Proxy) watchHang(port string, req *RequestSnapshot, abort context.CancelFunc) *hangReport {
+	h := &hangReport{done: make(chan struct{})}
+	h.timer = time.AfterFunc(this.App.SlowRequest, func() {
+		defer close(h.done)
+		h.elapsed = this.App.SlowRequest
+		log.Warnf(`== Slow request (>%v): %s %s`, h.elapsed, req.Method, req.URI)
+		var quit bool
+		h.dump, quit, h.err = this.App.DumpGoroutines(port)
+		if h.err != nil {
+			log.Error(`== Failed to get the goroutine dump: `, h.err)
+		} else {
+			log.Warn(h.dump)
+		}
+		if abort != nil {
+			h.aborted = true
+			abort()
+		}
+		if quit {
+			go func() {
+				if err := this.restartQuitApp(); err != nil {
+					log.Error(err)
+				}
+			}()
+		}
+	})
+	return h
+}
+
+// watchesHang 是否有服务开启了慢请求检测(app.slowRequest)
+func (this *Proxy) watchesHang() bool {
+	if this.App.SlowRequest > 0 {
+		return true
+	}
+	for _, route := range this.Routes {
+		if route.Proxy.App.SlowRequest > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// handleHang 显示慢请求超过阈值时应用的 goroutine 信息
+func (this *Proxy) handleHang(ctx reverseproxy.Context, hang *hangReport, req *RequestSnapshot) {
+	RenderAppHang(ctx, this.App, hang.elapsed, hang.dump, hang.err, req)
+}
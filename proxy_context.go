@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/webx-top/reverseproxy"
+)
+
+// RequestIDHeader 代理为每个请求设置的请求 ID 头
+const RequestIDHeader = "X-Request-ID"
+
+// ClientRequestIDHeader 保存客户端发送的 X-Request-ID
+const ClientRequestIDHeader = "X-Client-Request-ID"
+
+func requestHeader(ctx reverseproxy.Context, key string) string {
+	switch r := ctx.(type) {
+	case *reverseproxy.NativeResponse:
+		return r.Request.Header.Get(key)
+	case *reverseproxy.FastResponse:
+		return string(r.Request.Header.Peek(key))
+	}
+	return ``
+}
+
+func setRequestHeader(ctx reverseproxy.Context, key string, value string) {
+	switch r := ctx.(type) {
+	case *reverseproxy.NativeResponse:
+		r.Request.Header.Set(key, value)
+	case *reverseproxy.FastResponse:
+		r.Request.Header.Set(key, value)
+	}
+}
+
+func delRequestHeader(ctx reverseproxy.Context, key string) {
+	switch r := ctx.(type) {
+	case *reverseproxy.NativeResponse:
+		r.Request.Header.Del(key)
+	case *reverseproxy.FastResponse:
+		r.Request.Header.Del(key)
+	}
+}
+
+// setRequestPath 改写转发的请求的路径(查询参数不变)
+func setRequestPath(ctx reverseproxy.Context, path string) {
+	switch r := ctx.(type) {
+	case *reverseproxy.NativeResponse:
+		r.Request.URL.Path = path
+		r.Request.URL.RawPath = ``
+	case *reverseproxy.FastResponse:
+		r.Request.URI().SetPath(path)
+	}
+}
+
+// dropConnection 断开客户端的连接，不返回响应
+func dropConnection(ctx reverseproxy.Context) {
+	switch r := ctx.(type) {
+	case *reverseproxy.NativeResponse:
+		// net/http 会关闭连接(HTTP/2 时重置流)，不输出错误日志
+		panic(http.ErrAbortHandler)
+	case *reverseproxy.FastResponse:
+		r.HijackSetNoResponse(true)
+		r.Hijack(func(net.Conn) {})
+	}
+}
+
+// addResponseHeader 添加响应头(可以有多个同名的响应头，例如 Set-Cookie)
+func addResponseHeader(ctx reverseproxy.Context, key string, value string) {
+	switch r := ctx.(type) {
+	case *reverseproxy.NativeResponse:
+		r.RespWriter.Header().Add(key, value)
+	case *reverseproxy.FastResponse:
+		r.Response.Header.Add(key, value)
+	}
+}
+
+// requestScheme 返回客户端访问代理使用的协议: https 或 http
+func requestScheme(ctx reverseproxy.Context) string {
+	switch r := ctx.(type) {
+	case *reverseproxy.NativeResponse:
+		if r.Request.TLS != nil {
+			return `https`
+		}
+	case *reverseproxy.FastResponse:
+		if r.IsTLS() {
+			return `https`
+		}
+	}
+	return `http`
+}
+
+// setForwardedProto 设置转发给应用的 X-Forwarded-Proto 头。
+// fast 引擎中 HTTPS 请求的 URI 为 https 协议，需要改为 http 才能转发给应用。
+// 读取 Request.RequestURI() 会重新解析 URI，所以需要在转发前最后调用
+func setForwardedProto(ctx reverseproxy.Context) {
+	scheme := requestScheme(ctx)
+	setRequestHeader(ctx, `X-Forwarded-Proto`, scheme)
+	if r, ok := ctx.(*reverseproxy.FastResponse); ok && scheme == `https` {
+		r.Request.URI().SetScheme(`http`)
+	}
+}
+
+// assignRequestID 为请求生成新的请求 ID(用于关联 panic，不能使用客户端发送的值)，
+// 客户端发送的请求 ID 保存在 ClientRequestIDHeader 中，只用于显示
+func assignRequestID(ctx reverseproxy.Context) string {
+	if client := requestHeader(ctx, RequestIDHeader); len(client) > 0 {
+		setRequestHeader(ctx, ClientRequestIDHeader, client)
+	} else {
+		delRequestHeader(ctx, ClientRequestIDHeader)
+	}
+	id := NewRequestID()
+	setRequestHeader(ctx, RequestIDHeader, id)
+	return id
+}
+
+// requestID returns the request ID assigned by assignRequestID.
+func requestID(ctx reverseproxy.Context) string {
+	return requestHeader(ctx, RequestIDHeader)
+}
+
+// isUpgradeRequest 请求是否会被升级为长连接(websocket)，这类请求不会经过 ResponseAfter
+func isUpgradeRequest(ctx reverseproxy.Context) bool {
+	return strings.EqualFold(requestHeader(ctx, `Upgrade`), `websocket`)
+}
+
+// isNavigation 请求是否是浏览器打开页面(而不是 XHR、资源文件等)
+func isNavigation(ctx reverseproxy.Context) bool {
+	if ctx.RequestMethod() != `GET` || isUpgradeRequest(ctx) {
+		return false
+	}
+	if mode := requestHeader(ctx, `Sec-Fetch-Mode`); len(mode) > 0 {
+		return mode == `navigate`
+	}
+	return strings.Contains(requestHeader(ctx, `Accept`), `text/html`)
+}
+
+// responseStatus 返回应用响应的状态码，无法获取时(standard 引擎已经写出响应)返回 0
+func responseStatus(ctx reverseproxy.Context) int {
+	if r, ok := ctx.(*reverseproxy.FastResponse); ok {
+		return r.Response.StatusCode()
+	}
+	return 0
+}
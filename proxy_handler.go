@@ -1,7 +1,12 @@
 package main
 
 import (
+	"cmp"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/webx-top/reverseproxy"
 )
@@ -24,6 +29,32 @@ func (this *Proxy) handleWatchRestart(ctx reverseproxy.Context) error {
 	return nil
 }
 
+// handleWatchReload 向提供服务的实例发送信号(参数 signal，默认为 app.reloadSignal)，不重新编译也不切换端口
+func (this *Proxy) handleWatchReload(ctx reverseproxy.Context) error {
+	status := `done`
+	code := 200
+	if !this.authAdmin(ctx) {
+		code = http.StatusUnauthorized
+		status = `Authentication failed`
+	} else {
+		sig := this.App.ReloadSignal
+		var err error
+		if name := ctx.QueryValue(`signal`); len(name) > 0 || sig == nil {
+			sig, err = parseSignal(cmp.Or(name, DefaultReloadSignal))
+		}
+		if err == nil {
+			err = this.App.Signal(sig)
+		}
+		if err != nil {
+			code = http.StatusInternalServerError
+			status = err.Error()
+		}
+	}
+	ctx.SetStatusCode(code)
+	ctx.SetBody([]byte(status))
+	return nil
+}
+
 func (this *Proxy) handleWatchPause(ctx reverseproxy.Context) error {
 	status := `done`
 	code := 200
@@ -61,3 +92,229 @@ func (this *Proxy) handleWatchStatus(ctx reverseproxy.Context) error {
 	ctx.SetBody([]byte(`Watcher Status: ` + status))
 	return nil
 }
+
+func (this *Proxy) handleReplay(ctx reverseproxy.Context) error {
+	code := 200
+	var body string
+	req := this.App.Requests.Failed(ctx.QueryValue(`id`))
+	switch {
+	case !this.authAdmin(ctx):
+		code = http.StatusUnauthorized
+		body = `Authentication failed`
+	case req == nil:
+		code = http.StatusNotFound
+		body = `Request not found`
+	case !req.Replayable():
+		code = http.StatusRequestEntityTooLarge
+		body = `The request body is too large to replay`
+	default:
+		id := NewRequestID()
+		port := this.App.Port()
+		this.App.Requests.Begin(id, port)
+		out, err := req.Replay(port, id)
+		message, _ := this.App.Requests.End(id)
+		if err != nil {
+			code = http.StatusBadGateway
+			body = err.Error()
+		} else {
+			body = out
+		}
+		if len(message) > 0 {
+			body += "\n\n----------- Application Error -----------\n" + message
+		}
+	}
+	ctx.SetHeader(`Content-Type`, `text/plain;charset=utf-8`)
+	ctx.SetStatusCode(code)
+	ctx.SetBody([]byte(body))
+	return nil
+}
+
+// handleFaults 列出故障注入规则及其状态
+func (this *Proxy) handleFaults(ctx reverseproxy.Context) error {
+	if !this.authAdmin(ctx) {
+		ctx.SetStatusCode(http.StatusUnauthorized)
+		ctx.SetBody([]byte(`Authentication failed`))
+		return nil
+	}
+	var b strings.Builder
+	if this.Faults != nil {
+		for _, r := range this.Faults.Rules {
+			b.WriteString(r.String() + "\n")
+		}
+	}
+	ctx.SetHeader(`Content-Type`, `text/plain;charset=utf-8`)
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetBody([]byte(b.String()))
+	return nil
+}
+
+// handleFaultsToggle 开启或关闭故障注入规则(参数 name，为空时为所有规则)
+func (this *Proxy) handleFaultsToggle(ctx reverseproxy.Context, enabled bool) error {
+	status := `done`
+	code := 200
+	switch {
+	case !this.authAdmin(ctx):
+		code = http.StatusUnauthorized
+		status = `Authentication failed`
+	case this.Faults == nil:
+		code = http.StatusNotFound
+		status = `No faults configured`
+	default:
+		if err := this.Faults.SetEnabled(ctx.QueryValue(`name`), enabled); err != nil {
+			code = http.StatusNotFound
+			status = err.Error()
+		}
+	}
+	ctx.SetStatusCode(code)
+	ctx.SetBody([]byte(status))
+	return nil
+}
+
+// handleBuildProgress 以 server-sent events 推送编译和启动的输出，结束后发送 ready 或 failed 事件。
+// 和 /tower-proxy/logs 一样只允许管理员访问，其它客户端的编译中页面会定时刷新
+func (this *Proxy) handleBuildProgress(ctx reverseproxy.Context) error {
+	if !this.authAdmin(ctx) {
+		ctx.SetStatusCode(http.StatusUnauthorized)
+		ctx.SetBody([]byte(`Authentication failed`))
+		return nil
+	}
+	lines, events, cancel := this.App.BuildLog.Subscribe()
+	streamEvents(ctx, func(w io.Writer, flush func() error) {
+		defer cancel()
+		for _, line := range lines {
+			writeEvent(w, ``, line)
+		}
+		if flush() != nil {
+			return
+		}
+		ticker := time.NewTicker(HoldCheckInterval)
+		defer ticker.Stop()
+		lastWrite := time.Now()
+		var done *BuildEvent
+		for {
+			select {
+			case e := <-events:
+				switch {
+				case e.Done:
+					done = &e
+				case e.Reset:
+					done = nil
+					writeEvent(w, `reset`, ``)
+				default:
+					writeEvent(w, ``, e.Line)
+					lastWrite = time.Now()
+				}
+			case <-ticker.C:
+				if time.Since(lastWrite) >= SSEHeartbeatInterval {
+					writeHeartbeat(w)
+					lastWrite = time.Now()
+				}
+			}
+			// 监控到文件变化后，等待执行编译的期间仍然算作编译中
+			if done != nil && !this.building() {
+				if done.Err != nil {
+					writeEvent(w, `failed`, done.Err.Error())
+				} else {
+					writeEvent(w, `ready`, this.App.Port())
+				}
+				flush()
+				return
+			}
+			if flush() != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// logQuery 解析查看应用输出的参数: port、instance、tail(最后多少行)
+func logQuery(ctx reverseproxy.Context) (filter LogFilter, tail int) {
+	filter.Port = ctx.QueryValue(`port`)
+	filter.Instance = ctx.QueryValue(`instance`)
+	filter.Source = ctx.QueryValue(`source`)
+	tail, _ = strconv.Atoi(ctx.QueryValue(`tail`))
+	return
+}
+
+// handleLogs 以纯文本输出最近的应用输出
+func (this *Proxy) handleLogs(ctx reverseproxy.Context) error {
+	if !this.authAdmin(ctx) {
+		ctx.SetStatusCode(http.StatusUnauthorized)
+		ctx.SetBody([]byte(`Authentication failed`))
+		return nil
+	}
+	filter, tail := logQuery(ctx)
+	var b strings.Builder
+	for _, line := range this.App.Logs.Lines(filter, tail) {
+		b.WriteString(line.String() + "\n")
+	}
+	ctx.SetHeader(`Content-Type`, `text/plain;charset=utf-8`)
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetBody([]byte(b.String()))
+	return nil
+}
+
+// handleLogStream 以 server-sent events 推送应用输出，事件 ID 为行号，重新连接时从 Last-Event-ID 之后继续
+func (this *Proxy) handleLogStream(ctx reverseproxy.Context) error {
+	if !this.authAdmin(ctx) {
+		ctx.SetStatusCode(http.StatusUnauthorized)
+		ctx.SetBody([]byte(`Authentication failed`))
+		return nil
+	}
+	filter, tail := logQuery(ctx)
+	since, _ := strconv.ParseInt(requestHeader(ctx, `Last-Event-ID`), 10, 64)
+	if since > 0 {
+		tail = 0
+	}
+	lines, events, cancel := this.App.Logs.Subscribe(filter, since, tail)
+	streamEvents(ctx, func(w io.Writer, flush func() error) {
+		defer cancel()
+		for _, line := range lines {
+			writeLogEvent(w, line)
+		}
+		if flush() != nil {
+			return
+		}
+		heartbeat := time.NewTicker(SSEHeartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case line := <-events:
+				if !filter.Match(line) {
+					continue
+				}
+				writeLogEvent(w, line)
+			case <-heartbeat.C:
+				writeHeartbeat(w)
+			}
+			if flush() != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func writeLogEvent(w io.Writer, line LogLine) error {
+	_, err := io.WriteString(w, `id: `+strconv.FormatInt(line.Seq, 10)+"\n")
+	if err != nil {
+		return err
+	}
+	return writeEvent(w, ``, line.String())
+}
+
+// handleMetrics 以 Prometheus 文本格式输出所有服务的实例和 sidecar 的资源占用
+func (this *Proxy) handleMetrics(ctx reverseproxy.Context) error {
+	if !this.authAdmin(ctx) {
+		ctx.SetStatusCode(http.StatusUnauthorized)
+		ctx.SetBody([]byte(`Authentication failed`))
+		return nil
+	}
+	var b strings.Builder
+	writeMetrics(&b, this.App.Console.Apps(), this.App.Console.Sidecars.List())
+	ctx.SetHeader(`Content-Type`, `text/plain; version=0.0.4; charset=utf-8`)
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetBody([]byte(b.String()))
+	return nil
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"sync"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/admpub/log"
@@ -11,51 +12,119 @@ import (
 
 type ProxyRouter struct {
 	*Proxy
-	dst           string //目标网址
-	resultHost    string //最终操作的主机
-	resultReqData *reverseproxy.RequestData
-	resultIsDead  bool
-	logEntry      *rlog.LogEntry
+}
+
+// dst 目标网址
+func (r *ProxyRouter) dst() string {
+	return "http://localhost:" + r.Proxy.App.Port()
 }
 
 func (r *ProxyRouter) ChooseBackend(host string) (*reverseproxy.RequestData, error) {
 	this := r.Proxy
+	var choice *backendChoice
+	if this.usesHandoff() {
+		// 由 ResponseBefore 选择的服务和实例
+		if choice = this.handoff.Take(); choice != nil {
+			if len(choice.backend) > 0 {
+				return &reverseproxy.RequestData{
+					Backend:    choice.backend,
+					BackendKey: host,
+					BackendLen: 1,
+					Host:       host,
+					StartTime:  time.Now(),
+				}, nil
+			}
+			this = choice.proxy
+		}
+	}
 	app := this.App
 	var err error
-	if app.SwitchToNewPort {
-		this.FirstRequest.Do(func() {
-			log.Info(`== Switch port: `, this.appOldPort, ` => `, app.Port)
-			app.SwitchToNewPort = false
-			this.upgraded = time.Now().Unix()
-			go this.App.Clean()
-			r.dst = "http://localhost:" + app.Port
-			log.Info("== Listening to " + r.dst)
-			this.FirstRequest = &sync.Once{}
-		})
-	} else if !app.IsRunning() && !this.Watcher.compiling.Load() {
-		this.FirstRequest.Do(func() {
+	if !app.IsRunning() && !this.building() {
+		if app.Idle() {
+			err = app.Wake(this.ctx)
+		} else {
 			err = app.Restart(this.ctx)
-			this.FirstRequest = &sync.Once{}
-		})
+		}
 	}
 
-	r.resultHost = host
-	return &reverseproxy.RequestData{
-		Backend:    r.dst,
+	reqData := &reverseproxy.RequestData{
+		Backend:    "http://localhost:" + app.Port(),
 		BackendIdx: 0,
 		BackendKey: host,
 		BackendLen: 1,
 		Host:       host,
 		StartTime:  time.Now(),
-	}, err
+	}
+	if choice != nil && choice.inst.Running() {
+		reqData.Backend = "http://localhost:" + choice.inst.Port
+		reqData.BackendIdx = choice.idx
+		reqData.BackendLen = choice.len
+	}
+	return reqData, err
 }
 
 func (r *ProxyRouter) EndRequest(reqData *reverseproxy.RequestData, isDead bool, fn func() *rlog.LogEntry) error {
-	r.resultReqData = reqData
-	r.logEntry = fn()
-	r.resultIsDead = isDead
 	if !r.Proxy.App.DisabledLogRequest {
-		log.Infof("== Request: %7s %s => Completed %d in %vs", r.logEntry.Method, r.logEntry.Path, r.logEntry.StatusCode, r.logEntry.TotalDuration.Seconds())
+		logEntry := fn()
+		log.Infof("== Request: %7s %s => Completed %d in %vs%s", logEntry.Method, logEntry.Path, logEntry.StatusCode, logEntry.TotalDuration.Seconds(), r.Proxy.faultLog(logEntry.RequestID))
 	}
 	return nil
 }
+
+// ProxyRoute 将主机名或路径前缀匹配的请求转发给 apps 中的其它服务
+type ProxyRoute struct {
+	Host  string //不含端口
+	Path  string //路径前缀，例如: /api
+	Proxy *Proxy
+}
+
+// Match 请求是否匹配此路由，Host 和 Path 都设置时需要同时匹配
+func (r *ProxyRoute) Match(host string, path string) bool {
+	if len(r.Host) == 0 && len(r.Path) == 0 {
+		return false
+	}
+	if len(r.Host) > 0 {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.EqualFold(host, r.Host) {
+			return false
+		}
+	}
+	if len(r.Path) > 0 {
+		prefix := strings.TrimSuffix(r.Path, `/`)
+		if path != prefix && !strings.HasPrefix(path, prefix+`/`) {
+			return false
+		}
+	}
+	return true
+}
+
+// route 返回处理请求的服务: 匹配的路由中最具体的(同时指定主机名和路径的优先，然后是路径前缀较长的)，都不匹配时为 this
+func (this *Proxy) route(ctx reverseproxy.Context) *Proxy {
+	if len(this.Routes) == 0 {
+		return this
+	}
+	host, path := ctx.RequestHost(), ctx.RequestPath()
+	var matched *ProxyRoute
+	for _, r := range this.Routes {
+		if !r.Match(host, path) {
+			continue
+		}
+		if matched == nil || routeScore(r) > routeScore(matched) {
+			matched = r
+		}
+	}
+	if matched == nil {
+		return this
+	}
+	return matched.Proxy
+}
+
+func routeScore(r *ProxyRoute) int {
+	score := len(strings.TrimSuffix(r.Path, `/`))
+	if len(r.Host) > 0 {
+		score += 1 << 16
+	}
+	return score
+}
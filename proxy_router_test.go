@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/webx-top/reverseproxy"
+)
+
+func TestServiceRoutes(t *testing.T) {
+	main, api, admin, adminAPI := &Proxy{}, &Proxy{}, &Proxy{}, &Proxy{}
+	main.Routes = []*ProxyRoute{
+		{Path: `/api/`, Proxy: api},
+		{Host: `admin.localhost`, Proxy: admin},
+		{Host: `admin.localhost`, Path: `/api`, Proxy: adminAPI},
+	}
+	route := func(host string, path string) *Proxy {
+		return main.route(&reverseproxy.NativeResponse{Request: httptest.NewRequest(`GET`, `http://`+host+path, nil)})
+	}
+	assert.Equal(t, api, route(`localhost:8080`, `/api`))
+	assert.Equal(t, api, route(`localhost:8080`, `/api/users`))
+	assert.Equal(t, main, route(`localhost:8080`, `/apis`))
+	assert.Equal(t, admin, route(`admin.localhost:8080`, `/`))
+	assert.Equal(t, adminAPI, route(`admin.localhost`, `/api/users`))
+
+	app := NewApp(context.Background(), `test/dev/server1.go`, `6001`, ``, ``)
+	assert.True(t, app.DependsOn(`test/dev/server1.go`))
+	assert.False(t, app.DependsOn(`balancer.go`))
+	assert.True(t, app.DependsOn(`templates/index.html`))
+}
+
+// serveApp 为 app 添加一个就绪的实例，由返回 name 的 upstream 处理请求
+func serveApp(t *testing.T, name string) *App {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(upstream.Close)
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	app := NewApp(context.Background(), name+`.go`, port, ``, `--port`)
+	app.port = port
+	app.instances[port] = newInstance(app, port, StateReady)
+	app.DisabledLogRequest = true
+	return app
+}
+
+func TestServiceRoutesConcurrent(t *testing.T) {
+	for _, engine := range []string{`standard`, `fast`} {
+		main := NewProxy(context.Background(), serveApp(t, `main`), &Watcher{})
+		api := NewProxy(context.Background(), serveApp(t, `api`), &Watcher{})
+		main.Routes = []*ProxyRoute{{Path: `/api/`, Proxy: api}}
+		main.Engine = engine
+		port, err := kernelFreePort()
+		assert.NoError(t, err)
+		main.Port = `127.0.0.1:` + port
+		go main.Listen()
+		assert.NoError(t, dialAddress(main.Port, 10, nil))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			expected, path := `main`, `/`
+			if i%2 == 1 {
+				expected, path = `api`, `/api/users`
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := http.Get(`http://` + main.Port + path)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer resp.Body.Close()
+				b, _ := io.ReadAll(resp.Body)
+				assert.Equal(t, expected, string(b), engine+` `+path)
+			}()
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/webx-top/reverseproxy"
+	c "github.com/webx-top/tower/config"
+)
+
+// PathRoute 是 proxy.routes 中的一条路由
+type PathRoute struct {
+	Prefix  string //路径前缀(不含末尾的 / 和 /*)
+	Method  string
+	Proxy   *Proxy //转发给 apps 中的服务
+	Dir     string //返回此目录中的静态文件
+	URL     string //转发给其它服务器
+	Mock    string //以此文件的内容作为响应
+	Status  int
+	Headers map[string]string
+	Rewrite *string //替换匹配的路径前缀，为 nil 时不改写
+}
+
+// NewPathRoute 解析 proxy.routes 中的一条路由。proxies 为 apps 中各服务的代理，第一个为默认的服务
+func NewPathRoute(conf c.Route, proxies []*Proxy) (*PathRoute, error) {
+	if !strings.HasPrefix(conf.Path, `/`) {
+		return nil, fmt.Errorf(`invalid path: %q (must start with /)`, conf.Path)
+	}
+	r := &PathRoute{
+		Prefix:  strings.TrimSuffix(strings.TrimSuffix(conf.Path, `*`), `/`),
+		Method:  strings.ToUpper(conf.Method),
+		Dir:     conf.Dir,
+		URL:     conf.URL,
+		Mock:    conf.Mock,
+		Status:  conf.Status,
+		Headers: conf.Headers,
+	}
+	targets := 0
+	for _, v := range []string{conf.App, conf.Dir, conf.URL, conf.Mock} {
+		if len(v) > 0 {
+			targets++
+		}
+	}
+	if targets > 1 {
+		return nil, fmt.Errorf(`%s: only one of app, dir, url and mock can be set`, conf.Path)
+	}
+	switch {
+	case conf.StripPrefix && len(conf.Rewrite) > 0:
+		return nil, fmt.Errorf(`%s: stripPrefix and rewrite cannot be used together`, conf.Path)
+	case conf.StripPrefix:
+		rewrite := `/`
+		r.Rewrite = &rewrite
+	case len(conf.Rewrite) > 0:
+		r.Rewrite = &conf.Rewrite
+	}
+	switch {
+	case len(r.Dir) > 0:
+		if fi, err := os.Stat(r.Dir); err != nil {
+			return nil, err
+		} else if !fi.IsDir() {
+			return nil, fmt.Errorf(`%s: not a directory`, r.Dir)
+		}
+	case len(r.URL) > 0:
+		u, err := url.Parse(r.URL)
+		if err != nil {
+			return nil, err
+		}
+		if (u.Scheme != `http` && u.Scheme != `https`) || len(u.Host) == 0 {
+			return nil, fmt.Errorf(`invalid url: %q (use http://host:port)`, r.URL)
+		}
+		if len(strings.Trim(u.Path, `/`)) > 0 {
+			return nil, fmt.Errorf(`invalid url: %q (use rewrite to change the path)`, r.URL)
+		}
+		r.URL = u.Scheme + `://` + u.Host
+	case len(r.Mock) > 0:
+		if _, err := os.Stat(r.Mock); err != nil {
+			return nil, err
+		}
+		if r.Status == 0 {
+			r.Status = http.StatusOK
+		}
+	default:
+		if len(proxies) == 0 {
+			return nil, errors.New(`no app to route to`)
+		}
+		r.Proxy = proxies[0]
+		if len(conf.App) > 0 {
+			r.Proxy = nil
+			for _, p := range proxies {
+				if p.App.Name == conf.App {
+					r.Proxy = p
+					break
+				}
+			}
+			if r.Proxy == nil {
+				return nil, fmt.Errorf(`%s: app %q not found in apps`, conf.Path, conf.App)
+			}
+		}
+	}
+	return r, nil
+}
+
+// Match 请求是否匹配此路由
+func (r *PathRoute) Match(method string, path string) bool {
+	if len(r.Method) > 0 && r.Method != method {
+		return false
+	}
+	return hasPathPrefix(path, r.Prefix)
+}
+
+// hasPathPrefix path 是否为 prefix 或以 prefix/ 开头，prefix 为空时匹配所有路径
+func hasPathPrefix(path string, prefix string) bool {
+	return len(prefix) == 0 || path == prefix || strings.HasPrefix(path, prefix+`/`)
+}
+
+// RewritePath 返回改写后的路径
+func (r *PathRoute) RewritePath(p string) string {
+	if r.Rewrite == nil {
+		return p
+	}
+	rest := strings.TrimPrefix(p, r.Prefix)
+	p = strings.TrimSuffix(*r.Rewrite, `/`) + rest
+	if !strings.HasPrefix(p, `/`) {
+		p = `/` + p
+	}
+	return p
+}
+
+// String 返回用于日志的简要说明
+func (r *PathRoute) String() string {
+	prefix := r.Prefix + `/*`
+	if len(r.Method) > 0 {
+		prefix = r.Method + ` ` + prefix
+	}
+	switch {
+	case len(r.Dir) > 0:
+		return prefix + ` => dir ` + r.Dir
+	case len(r.URL) > 0:
+		return prefix + ` => ` + r.URL
+	case len(r.Mock) > 0:
+		return prefix + ` => mock ` + r.Mock
+	default:
+		return prefix + ` => app ` + r.Proxy.App.Name
+	}
+}
+
+// pathRoute 返回请求匹配的第一条 proxy.routes 路由，没有时返回 nil
+func (this *Proxy) pathRoute(ctx reverseproxy.Context) *PathRoute {
+	method, path := ctx.RequestMethod(), ctx.RequestPath()
+	for _, r := range this.PathRoutes {
+		if r.Match(method, path) {
+			return r
+		}
+	}
+	return nil
+}
+
+// servePathRoute 处理匹配 proxy.routes 的请求: 改写路径后返回静态文件或 mock 响应(handled 为 true)，否则返回转发的目标
+func (this *Proxy) servePathRoute(ctx reverseproxy.Context, route *PathRoute) (choice *backendChoice, handled bool) {
+	if route.Rewrite != nil {
+		setRequestPath(ctx, route.RewritePath(ctx.RequestPath()))
+	}
+	switch {
+	case len(route.Mock) > 0:
+		serveMock(ctx, route)
+		return nil, true
+	case len(route.Dir) > 0:
+		serveStatic(ctx, route.Dir, ctx.RequestPath())
+		return nil, true
+	case len(route.URL) > 0:
+		choice = &backendChoice{backend: route.URL}
+	default:
+		if choice, handled = route.Proxy.responseBefore(ctx); handled {
+			return nil, true
+		}
+	}
+	// 升级后的连接(websocket)不会经过 ResponseAfter
+	if !isUpgradeRequest(ctx) {
+		this.routed.Store(requestID(ctx), route)
+	}
+	return choice, false
+}
+
+// serveStatic 返回 dir 中的文件，目录返回其中的 index.html
+func serveStatic(ctx reverseproxy.Context, dir string, urlPath string) {
+	file := filepath.Join(dir, filepath.FromSlash(path.Clean(`/`+urlPath)))
+	if fi, err := os.Stat(file); err == nil && fi.IsDir() {
+		file = filepath.Join(file, `index.html`)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+			status = http.StatusNotFound
+		}
+		writeText(ctx, status, http.StatusText(status))
+		return
+	}
+	ctx.SetHeader(`Content-Type`, contentType(file, b))
+	ctx.SetHeader(`Cache-Control`, `no-cache`)
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetBody(b)
+}
+
+// serveMock 以 route.Mock 文件的内容作为响应
+func serveMock(ctx reverseproxy.Context, route *PathRoute) {
+	b, err := os.ReadFile(route.Mock)
+	if err != nil {
+		writeText(ctx, http.StatusInternalServerError, `Failed to read mock file: `+err.Error())
+		return
+	}
+	ctx.SetHeader(`Content-Type`, contentType(route.Mock, b))
+	for k, v := range route.Headers {
+		ctx.SetHeader(k, v)
+	}
+	ctx.SetStatusCode(route.Status)
+	ctx.SetBody(b)
+}
+
+func writeText(ctx reverseproxy.Context, status int, text string) {
+	ctx.SetHeader(`Content-Type`, `text/plain; charset=utf-8`)
+	ctx.SetStatusCode(status)
+	ctx.SetBody([]byte(text))
+}
+
+func contentType(file string, content []byte) string {
+	if t := mime.TypeByExtension(filepath.Ext(file)); len(t) > 0 {
+		return t
+	}
+	return http.DetectContentType(content)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/webx-top/reverseproxy"
+	c "github.com/webx-top/tower/config"
+)
+
+func TestPathRoutes(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, `public`, `js`), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, `public`, `index.html`), []byte(`<html></html>`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, `public`, `js`, `app.js`), []byte(`alert(1)`), 0644))
+	mock := filepath.Join(dir, `me.json`)
+	assert.NoError(t, os.WriteFile(mock, []byte(`{"id":1}`), 0644))
+
+	main, api := &Proxy{App: &App{Name: `web`}}, &Proxy{App: &App{Name: `api`}}
+	proxies := []*Proxy{main, api}
+	routes := []c.Route{
+		{Path: `/users/me`, Method: `get`, Mock: mock, Status: 201, Headers: map[string]string{`X-Mock`: `1`}},
+		{Path: `/api/*`, App: `api`, StripPrefix: true},
+		{Path: `/assets/*`, Dir: filepath.Join(dir, `public`), StripPrefix: true},
+		{Path: `/vite/`, URL: `http://127.0.0.1:5173/`},
+		{Path: `/app`, Rewrite: `/base`},
+	}
+	for _, conf := range routes {
+		route, err := NewPathRoute(conf, proxies)
+		assert.NoError(t, err)
+		main.PathRoutes = append(main.PathRoutes, route)
+	}
+	assert.Equal(t, api, main.PathRoutes[1].Proxy)
+	assert.Equal(t, main, main.PathRoutes[4].Proxy)
+	assert.Equal(t, `http://127.0.0.1:5173`, main.PathRoutes[3].URL)
+	assert.Equal(t, `GET /users/me/* => mock `+mock, main.PathRoutes[0].String())
+
+	match := func(method string, path string) *PathRoute {
+		return main.pathRoute(&reverseproxy.NativeResponse{Request: httptest.NewRequest(method, path, nil)})
+	}
+	assert.Equal(t, main.PathRoutes[0], match(`GET`, `/users/me`))
+	assert.Nil(t, match(`POST`, `/users/me`))
+	assert.Equal(t, main.PathRoutes[1], match(`POST`, `/api`))
+	assert.Nil(t, match(`GET`, `/apis`))
+	assert.Equal(t, `/`, main.PathRoutes[1].RewritePath(`/api`))
+	assert.Equal(t, `/users/1`, main.PathRoutes[1].RewritePath(`/api/users/1`))
+	assert.Equal(t, `/base/login`, main.PathRoutes[4].RewritePath(`/app/login`))
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		ctx := &reverseproxy.NativeResponse{RespWriter: rec, Request: httptest.NewRequest(`GET`, path, nil)}
+		_, handled := main.servePathRoute(ctx, main.pathRoute(ctx))
+		assert.True(t, handled)
+		return rec
+	}
+	rec := serve(`/users/me`)
+	assert.Equal(t, 201, rec.Code)
+	assert.Equal(t, `application/json`, rec.Header().Get(`Content-Type`))
+	assert.Equal(t, `1`, rec.Header().Get(`X-Mock`))
+	assert.Equal(t, `{"id":1}`, rec.Body.String())
+	rec = serve(`/assets/`)
+	assert.Equal(t, `<html></html>`, rec.Body.String())
+	rec = serve(`/assets/js/app.js`)
+	assert.Contains(t, rec.Header().Get(`Content-Type`), `javascript`)
+	assert.Equal(t, `alert(1)`, rec.Body.String())
+	assert.Equal(t, 404, serve(`/assets/../me.json`).Code)
+	assert.Equal(t, 404, serve(`/assets/missing.js`).Code)
+
+	for _, conf := range []c.Route{
+		{Path: `api`},
+		{Path: `/api`, App: `api`, Dir: dir},
+		{Path: `/api`, StripPrefix: true, Rewrite: `/v1`},
+		{Path: `/api`, App: `admin`},
+		{Path: `/api`, URL: `ftp://127.0.0.1`},
+		{Path: `/api`, URL: `http://127.0.0.1:8000/v1`},
+		{Path: `/api`, Dir: mock},
+		{Path: `/api`, Mock: filepath.Join(dir, `missing.json`)},
+	} {
+		_, err := NewPathRoute(conf, proxies)
+		assert.Error(t, err, conf.Path)
+	}
+}
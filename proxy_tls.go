@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	stdlog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admpub/fasthttp"
+	"github.com/admpub/log"
+	"github.com/webx-top/reverseproxy"
+)
+
+var regexHostname = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+
+const (
+	// CACertFile 本地 CA 证书的文件名(需要添加到系统或浏览器的受信任根证书中)
+	CACertFile = `rootCA.pem`
+	// CAKeyFile 本地 CA 私钥的文件名
+	CAKeyFile = `rootCA-key.pem`
+	// CAValidity 本地 CA 证书的有效期
+	CAValidity = 10 * 365 * 24 * time.Hour
+	// CertValidity 主机名证书的有效期(不超过浏览器允许的 825 天)
+	CertValidity = 825 * 24 * time.Hour
+	// CertRenewBefore 主机名证书在到期前多久重新生成
+	CertRenewBefore = 7 * 24 * time.Hour
+)
+
+// DefaultTLSDir 返回默认保存本地 CA 和证书的目录
+func DefaultTLSDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.Join(StateDir, `tls`)
+	}
+	return filepath.Join(dir, `tower`, `tls`)
+}
+
+// LocalCA 是保存在 Dir 中的本地 CA，按需为 localhost、*.localhost 和 Hosts 中的主机名签发证书
+type LocalCA struct {
+	Dir   string
+	Hosts []string //除 localhost 之外允许签发证书的主机名，支持 *.example.test 格式
+	cert  *x509.Certificate
+	key   crypto.Signer
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// NewLocalCA 读取 dir 中的 CA，不存在时生成新的 CA
+func NewLocalCA(dir string, hosts []string) (*LocalCA, error) {
+	ca := &LocalCA{Dir: dir, certs: map[string]*tls.Certificate{}}
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if len(host) > 0 && !slices.Contains(ca.Hosts, host) {
+			ca.Hosts = append(ca.Hosts, host)
+		}
+	}
+	certFile := filepath.Join(dir, CACertFile)
+	keyFile := filepath.Join(dir, CAKeyFile)
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		ca.cert, err = x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if ca.key, ok = pair.PrivateKey.(crypto.Signer); !ok {
+			return nil, fmt.Errorf(`%s: unsupported private key`, keyFile)
+		}
+		return ca, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err = ca.generate(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	log.Info(`== Generated local CA: `, certFile)
+	log.Info(`== Add it to the trusted root certificates of your system or browser to avoid certificate warnings`)
+	return ca, nil
+}
+
+func (ca *LocalCA) generate(certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{Organization: []string{`tower development CA`}, CommonName: `tower ` + hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(CAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		return err
+	}
+	ca.key = key
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(ca.Dir, 0700); err != nil {
+		return err
+	}
+	if err = os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: der}), 0644)
+}
+
+// Allowed 是否可以为 host 签发证书
+func (ca *LocalCA) Allowed(host string) bool {
+	if host == `localhost` || strings.HasSuffix(host, `.localhost`) {
+		return true
+	}
+	for _, h := range ca.Hosts {
+		if h == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(h, `*`); ok && strings.HasSuffix(host, suffix) && !strings.Contains(strings.TrimSuffix(host, suffix), `.`) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertificate 返回客户端请求的主机名(SNI)的证书。没有 SNI(使用 IP 访问)或不允许的主机名使用 localhost 的证书
+func (ca *LocalCA) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(strings.TrimSuffix(hello.ServerName, `.`))
+	if !regexHostname.MatchString(host) || !ca.Allowed(host) {
+		host = `localhost`
+	}
+	return ca.Certificate(host)
+}
+
+// Certificate 返回 host 的证书，依次从内存、Dir/certs 中读取，不存在或即将到期时重新签发
+func (ca *LocalCA) Certificate(host string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if cert, ok := ca.certs[host]; ok && ca.valid(cert) {
+		return cert, nil
+	}
+	file := filepath.Join(ca.Dir, `certs`, host+`.pem`)
+	if b, err := os.ReadFile(file); err == nil {
+		if cert, err := tls.X509KeyPair(b, b); err == nil && ca.valid(&cert) {
+			ca.certs[host] = &cert
+			return &cert, nil
+		}
+	}
+	cert, b, err := ca.issue(host)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(file), 0700); err == nil {
+		err = os.WriteFile(file, b, 0600)
+	}
+	if err != nil {
+		log.Warn(`== Failed to save certificate: `, err)
+	}
+	ca.certs[host] = cert
+	return cert, nil
+}
+
+// valid 证书是否由当前的 CA 签发并且不会很快到期
+func (ca *LocalCA) valid(cert *tls.Certificate) bool {
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return false
+		}
+		cert.Leaf = leaf
+	}
+	return time.Until(cert.Leaf.NotAfter) > CertRenewBefore && cert.Leaf.CheckSignatureFrom(ca.cert) == nil
+}
+
+// issue 为 host 签发证书，返回证书和 PEM 格式的证书及私钥
+func (ca *LocalCA) issue(host string) (*tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{Organization: []string{`tower development certificate`}, CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(CertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{host},
+	}
+	if host == `localhost` {
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	b := append(pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: der}), keyPEM...)
+	cert, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(der)
+	return &cert, b, err
+}
+
+// TLSConfig 返回代理使用的 TLS 配置，http2 为 false 时只支持 HTTP/1.1
+func (ca *LocalCA) TLSConfig(http2 bool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{`http/1.1`},
+		GetCertificate: ca.GetCertificate,
+	}
+	if http2 {
+		config.NextProtos = []string{`h2`, `http/1.1`}
+	}
+	return config
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: `PRIVATE KEY`, Bytes: der}), nil
+}
+
+func serialNumber() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return n
+}
+
+// listenTLS 在 TLSPort 上提供 HTTPS，与 HTTP 端口使用同一个反向代理。standard 引擎支持 HTTP/2
+func (this *Proxy) listenTLS() error {
+	listenAddr := this.TLSPort
+	if !strings.Contains(listenAddr, `:`) {
+		listenAddr = `:` + listenAddr
+	}
+	listener, err := net.Listen(`tcp`, listenAddr)
+	if err != nil {
+		return err
+	}
+	listener = this.listener.Wrap(listener)
+	log.Info(`== HTTPS Address `, listenAddr)
+	switch rp := this.ReserveProxy.(type) {
+	case *reverseproxy.FastReverseProxy:
+		server := &fasthttp.Server{Handler: rp.Handler}
+		return server.Serve(tls.NewListener(listener, this.CA.TLSConfig(false)))
+	case *reverseproxy.NativeReverseProxy:
+		server := &http.Server{Handler: this.nativeHandler(rp), ErrorLog: stdlog.New(io.Discard, ``, 0)}
+		return server.Serve(tls.NewListener(listener, this.CA.TLSConfig(true)))
+	default:
+		listener.Close()
+		return fmt.Errorf(`unsupported engine: %T`, rp)
+	}
+}
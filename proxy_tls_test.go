@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := NewLocalCA(dir, []string{`Dev.Example.Test`, `*.example.org`})
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, CACertFile))
+	assert.True(t, ca.Allowed(`api.localhost`))
+	assert.True(t, ca.Allowed(`dev.example.test`))
+	assert.True(t, ca.Allowed(`www.example.org`))
+	assert.False(t, ca.Allowed(`a.b.example.org`))
+	assert.False(t, ca.Allowed(`example.com`))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	cert, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: `api.localhost`})
+	assert.NoError(t, err)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: `api.localhost`, Roots: pool})
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, `certs`, `api.localhost.pem`))
+	cert, _ = ca.GetCertificate(&tls.ClientHelloInfo{ServerName: `example.com`})
+	assert.Equal(t, []string{`localhost`}, cert.Leaf.DNSNames)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: `127.0.0.1`, Roots: pool})
+	assert.NoError(t, err)
+
+	// 重新读取已保存的 CA 和证书
+	ca2, err := NewLocalCA(dir, nil)
+	assert.NoError(t, err)
+	assert.True(t, ca.cert.Equal(ca2.cert))
+	cert2, err := ca2.Certificate(`api.localhost`)
+	assert.NoError(t, err)
+	cached, _ := ca.Certificate(`api.localhost`)
+	assert.Equal(t, cached.Certificate[0], cert2.Certificate[0])
+}
+
+func TestListenTLS(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get(`X-Forwarded-Proto`))
+	}))
+	defer upstream.Close()
+	_, appPort, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	app := NewApp(context.Background(), `main.go`, appPort, ``, `--port`)
+	app.port = appPort
+	app.instances[appPort] = newInstance(app, appPort, StateReady)
+	ca, err := NewLocalCA(t.TempDir(), nil)
+	assert.NoError(t, err)
+	httpPort, err := kernelFreePort()
+	assert.NoError(t, err)
+	tlsPort, err := kernelFreePort()
+	assert.NoError(t, err)
+	proxy := NewProxy(context.Background(), app, &Watcher{})
+	proxy.Port = `127.0.0.1:` + httpPort
+	proxy.TLSPort = `127.0.0.1:` + tlsPort
+	proxy.CA = ca
+	go proxy.Listen()
+	assert.NoError(t, dialAddress(proxy.TLSPort, 10, nil))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get(`https://localhost:` + tlsPort + `/`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	// standard 引擎通过 HTTPS 端口提供 HTTP/2
+	assert.Equal(t, `HTTP/2.0`, resp.Proto)
+	assert.Equal(t, `https`, string(b))
+	assert.Equal(t, `localhost`, resp.TLS.PeerCertificates[0].DNSNames[0])
+}
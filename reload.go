@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"regexp"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+const (
+	// DefaultReloadSignal 没有设置 app.reloadSignal 时发送的信号
+	DefaultReloadSignal = `SIGHUP`
+	// ReloadDelay 匹配 watch.reload 的文件更改后等待的时间，期间的多次更改只发送一次信号
+	ReloadDelay = 300 * time.Millisecond
+)
+
+// ReloadRule 匹配的文件更改时向实例发送信号而不重新编译
+type ReloadRule struct {
+	Pattern *regexp.Regexp
+	Signal  os.Signal
+}
+
+// Signal 向提供服务的实例发送信号(例如让应用重新加载模板和配置)，不重新编译也不切换端口
+func (a *App) Signal(sig os.Signal) error {
+	instances := a.Serving()
+	if len(instances) == 0 {
+		return errors.New(a.Name + ` is not running`)
+	}
+	var errs []error
+	for _, inst := range instances {
+		log.Infof(`== Sending %s to %s at port %s`, signalName(sig), a.Name, inst.Port)
+		process := inst.Process()
+		if process == nil {
+			continue
+		}
+		if err := process.Signal(sig); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// forwardSignals 将 tower 收到的 ForwardSignals 转发给提供服务的实例
+func (a *App) forwardSignals(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, a.ForwardSignals...)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case sig := <-ch:
+			if err := a.Signal(sig); err != nil {
+				log.Error(`== Forward `+signalName(sig)+`: `, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
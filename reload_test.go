@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadRules(t *testing.T) {
+	sig, err := parseSignal(`usr1`)
+	if runtime.GOOS == `windows` {
+		assert.Error(t, err)
+		return
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, `SIGUSR1`, signalName(sig))
+	_, err = parseSignal(`SIGFOO`)
+	assert.Error(t, err)
+
+	hup, _ := parseSignal(DefaultReloadSignal)
+	w := &Watcher{OnReload: func(os.Signal) {}}
+	w.Reloads = []*ReloadRule{{Pattern: regexp.MustCompile(`/templates/.*\.html$`), Signal: hup}}
+	if rule := w.reloadRule(`/app/templates/index.html`); assert.NotNil(t, rule) {
+		assert.Equal(t, hup, rule.Signal)
+	}
+	assert.Nil(t, w.reloadRule(`/app/main.go`))
+	w.OnlyWatchBin = true
+	assert.Nil(t, w.reloadRule(`/app/templates/index.html`))
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/webx-top/reverseproxy"
+)
+
+const (
+	// RequestBodyDisplaySize 错误页面上显示的请求正文的最大字节数
+	RequestBodyDisplaySize = 4 * 1024
+	// RequestBodyReplaySize 为重放请求保存的请求正文的最大字节数
+	RequestBodyReplaySize = 1024 * 1024
+	// ReplayTimeout 重放请求的超时时间
+	ReplayTimeout = time.Minute
+	// MaskedValue 敏感值的替代文本
+	MaskedValue = `******`
+)
+
+var (
+	regexSensitiveHeader = regexp.MustCompile(`(?i)^(authorization|proxy-authorization|cookie|set-cookie)$|token|secret|passw|api-?key|session`)
+	regexSensitiveField  = regexp.MustCompile(`(?i)passw|pwd|secret|token|api-?key`)
+)
+
+type KV struct {
+	Key   string
+	Value string
+}
+
+// RequestSnapshot 记录经过代理的请求，用于在错误页面上显示和重放
+type RequestSnapshot struct {
+	ID     string
+	Method string
+	Scheme string
+	Host   string
+	URI    string
+	Header http.Header
+	Body   []byte
+	// BodyIncomplete 为 true 时表示请求正文超过 RequestBodyReplaySize 或没有被完整读取，无法重放
+	BodyIncomplete bool
+
+	mu       sync.Mutex
+	overflow bool
+}
+
+func NewRequestSnapshot(ctx reverseproxy.Context, id string) *RequestSnapshot {
+	r := &RequestSnapshot{
+		ID:     id,
+		Method: ctx.RequestMethod(),
+		Scheme: `http`,
+		Host:   ctx.RequestHost(),
+		Header: http.Header{},
+	}
+	switch v := ctx.(type) {
+	case *reverseproxy.NativeResponse:
+		r.URI = v.Request.URL.RequestURI()
+		r.Header = v.Request.Header.Clone()
+		if v.Request.TLS != nil {
+			r.Scheme = `https`
+		}
+		if v.Request.Body != nil && v.Request.Body != http.NoBody {
+			// 转发时记录请求正文，读取到结尾之前无法重放
+			r.BodyIncomplete = true
+			v.Request.Body = &requestBodyRecorder{ReadCloser: v.Request.Body, snapshot: r}
+		}
+	case *reverseproxy.FastResponse:
+		r.URI = string(v.Request.RequestURI())
+		v.Request.Header.VisitAll(func(key, value []byte) {
+			r.Header.Add(string(key), string(value))
+		})
+		if v.IsTLS() {
+			r.Scheme = `https`
+		}
+		r.setBody(v.Request.Body())
+	}
+	return r
+}
+
+func (r *RequestSnapshot) setBody(b []byte) {
+	if len(b) > RequestBodyReplaySize {
+		b = b[:RequestBodyReplaySize]
+		r.BodyIncomplete = true
+	}
+	r.Body = append([]byte{}, b...)
+}
+
+// recordBody 追加转发时读取到的请求正文，最多保存 RequestBodyReplaySize 字节
+func (r *RequestSnapshot) recordBody(p []byte, eof bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if free := RequestBodyReplaySize - len(r.Body); len(p) > free {
+		r.Body = append(r.Body, p[:free]...)
+		r.BodyIncomplete = true
+		r.overflow = true
+		return
+	}
+	r.Body = append(r.Body, p...)
+	if eof && !r.overflow {
+		r.BodyIncomplete = false
+	}
+}
+
+// body returns the recorded request body and whether it is incomplete.
+func (r *RequestSnapshot) body() ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Body, r.BodyIncomplete
+}
+
+// requestBodyRecorder 在请求正文被转发给应用的同时将其记录到 RequestSnapshot
+type requestBodyRecorder struct {
+	io.ReadCloser
+	snapshot *RequestSnapshot
+}
+
+func (b *requestBodyRecorder) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.snapshot.recordBody(p[:n], err == io.EOF)
+	return
+}
+
+// URL returns the request URL with sensitive query values masked.
+func (r *RequestSnapshot) URL() string {
+	uri := r.URI
+	if p := strings.Index(uri, `?`); p > -1 {
+		uri = uri[:p+1] + maskQuery(uri[p+1:])
+	}
+	return r.Scheme + `://` + r.Host + uri
+}
+
+// MaskedHeaders returns the headers sorted by name with sensitive values masked.
+func (r *RequestSnapshot) MaskedHeaders() []KV {
+	var headers []KV
+	for key, values := range r.Header {
+		for _, value := range values {
+			if regexSensitiveHeader.MatchString(key) {
+				value = MaskedValue
+			}
+			headers = append(headers, KV{Key: key, Value: value})
+		}
+	}
+	sort.SliceStable(headers, func(i, j int) bool {
+		return headers[i].Key < headers[j].Key
+	})
+	return headers
+}
+
+func (r *RequestSnapshot) Query() []KV {
+	var query string
+	if p := strings.Index(r.URI, `?`); p > -1 {
+		query = r.URI[p+1:]
+	}
+	return maskValues(query)
+}
+
+// Form returns the values of an urlencoded request body.
+func (r *RequestSnapshot) Form() []KV {
+	if !r.isForm() {
+		return nil
+	}
+	b, _ := r.body()
+	return maskValues(string(b))
+}
+
+func (r *RequestSnapshot) isForm() bool {
+	return strings.HasPrefix(r.Header.Get(`Content-Type`), `application/x-www-form-urlencoded`)
+}
+
+// DisplayBody returns the request body truncated to RequestBodyDisplaySize. Sensitive values of an urlencoded body are masked.
+func (r *RequestSnapshot) DisplayBody() (body string, truncated bool) {
+	b, incomplete := r.body()
+	if r.isForm() {
+		b = []byte(maskQuery(string(b)))
+	}
+	if len(b) > RequestBodyDisplaySize {
+		b = b[:RequestBodyDisplaySize]
+		truncated = true
+	}
+	return string(b), truncated || incomplete
+}
+
+// Curl returns a curl command line for the request. Sensitive headers, query and form values are masked.
+func (r *RequestSnapshot) Curl() string {
+	cmd := `curl `
+	if r.Method != http.MethodGet {
+		cmd += `-X ` + r.Method + ` `
+	}
+	args := []string{cmd + shellQuote(r.URL())}
+	for _, kv := range r.MaskedHeaders() {
+		if skipReplayHeader(kv.Key) {
+			continue
+		}
+		args = append(args, `-H `+shellQuote(kv.Key+`: `+kv.Value))
+	}
+	if body, _ := r.DisplayBody(); len(body) > 0 {
+		args = append(args, `--data-binary `+shellQuote(body))
+	}
+	return strings.Join(args, " \\\n  ")
+}
+
+// Replayable returns true if the whole request body has been recorded.
+func (r *RequestSnapshot) Replayable() bool {
+	_, incomplete := r.body()
+	return !incomplete
+}
+
+// Replay sends the request again to the app instance listening on port and returns the response dump.
+func (r *RequestSnapshot) Replay(port string, id string) (string, error) {
+	body, _ := r.body()
+	req, err := http.NewRequest(r.Method, `http://127.0.0.1:`+port+r.URI, bytes.NewReader(body))
+	if err != nil {
+		return ``, err
+	}
+	for key, values := range r.Header {
+		if skipReplayHeader(key) {
+			continue
+		}
+		req.Header[key] = values
+	}
+	req.Host = r.Host
+	req.Header.Set(RequestIDHeader, id)
+	client := &http.Client{
+		Timeout: ReplayTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ``, err
+	}
+	defer resp.Body.Close()
+	resp.Body = io.NopCloser(io.LimitReader(resp.Body, RequestBodyDisplaySize))
+	b, err := httputil.DumpResponse(resp, true)
+	return string(b), err
+}
+
+func skipReplayHeader(key string) bool {
+	switch http.CanonicalHeaderKey(key) {
+	case `Host`, `Content-Length`, http.CanonicalHeaderKey(RequestIDHeader):
+		return true
+	}
+	return false
+}
+
+func maskValues(query string) []KV {
+	values, _ := url.ParseQuery(query)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var list []KV
+	for _, key := range keys {
+		for _, value := range values[key] {
+			if regexSensitiveField.MatchString(key) {
+				value = MaskedValue
+			}
+			list = append(list, KV{Key: key, Value: value})
+		}
+	}
+	return list
+}
+
+// maskQuery 隐藏 urlencoded 格式的 query 中敏感字段的值，其它部分保持原样
+func maskQuery(query string) string {
+	pairs := strings.Split(query, `&`)
+	for i, pair := range pairs {
+		key, _, ok := strings.Cut(pair, `=`)
+		if !ok {
+			continue
+		}
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if regexSensitiveField.MatchString(name) {
+			pairs[i] = key + `=` + MaskedValue
+		}
+	}
+	return strings.Join(pairs, `&`)
+}
+
+func shellQuote(s string) string {
+	return `'` + strings.Replace(s, `'`, `'\''`, -1) + `'`
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/webx-top/reverseproxy"
+)
+
+func TestRequestInfo(t *testing.T) {
+	req := &RequestSnapshot{
+		ID:     `abc`,
+		Method: `POST`,
+		Scheme: `http`,
+		Host:   `127.0.0.1:8080`,
+		URI:    `/login?next=/home&token=123`,
+		Header: http.Header{
+			`Content-Type`:  {`application/x-www-form-urlencoded`},
+			`Cookie`:        {`session=secret`},
+			RequestIDHeader: {`abc`},
+		},
+		Body: []byte(`user=admin&password=it's`),
+	}
+	info := NewRequestInfo(req)
+	assert.Equal(t, `http://127.0.0.1:8080/login?next=/home&token=******`, info.URL)
+	assert.Equal(t, []KV{{`next`, `/home`}, {`token`, MaskedValue}}, info.Query)
+	assert.Equal(t, []KV{{`password`, MaskedValue}, {`user`, `admin`}}, info.Form)
+	assert.Contains(t, info.Headers, KV{`Cookie`, MaskedValue})
+	assert.True(t, info.Replayable)
+	assert.NoError(t, errorTemplate.Execute(io.Discard, ErrorInfo{Request: info, ShowRequest: true}))
+	assert.Equal(t, `user=admin&password=******`, info.Body)
+	assert.Equal(t, "curl -X POST 'http://127.0.0.1:8080/login?next=/home&token=******' \\\n"+
+		"  -H 'Content-Type: application/x-www-form-urlencoded' \\\n"+
+		"  -H 'Cookie: ******' \\\n"+
+		"  --data-binary 'user=admin&password=******'", info.Curl)
+}
+
+func TestRequestInfoMasked(t *testing.T) {
+	req := &RequestSnapshot{
+		ID:     `abc`,
+		Method: `POST`,
+		Scheme: `http`,
+		Host:   `127.0.0.1:8080`,
+		URI:    `/login?next=/home&access_token=query-secret&Api%2DKey=key-secret`,
+		Header: http.Header{
+			`Content-Type`:  {`application/x-www-form-urlencoded`},
+			`Authorization`: {`Bearer header-secret`},
+			`Cookie`:        {`session=cookie-secret`},
+		},
+		Body: []byte(`user=admin&password=form-secret&pwd=pwd-secret`),
+	}
+	var b strings.Builder
+	assert.NoError(t, errorTemplate.Execute(&b, ErrorInfo{Request: NewRequestInfo(req), ShowRequest: true}))
+	page := b.String()
+	assert.Contains(t, page, `admin`)
+	// 敏感的值不能出现在页面的任何位置(URL、请求头、query、表单、请求正文和 curl 命令)
+	for _, secret := range []string{`query-secret`, `key-secret`, `header-secret`, `cookie-secret`, `form-secret`, `pwd-secret`} {
+		assert.NotContains(t, page, secret)
+	}
+}
+
+func TestRequestBodyRecorder(t *testing.T) {
+	body := strings.Repeat(`a`, 100)
+	req := httptest.NewRequest(`POST`, `/upload`, strings.NewReader(body))
+	snapshot := NewRequestSnapshot(&reverseproxy.NativeResponse{Request: req}, `abc`)
+	assert.False(t, snapshot.Replayable())
+
+	// 请求正文在转发时才被读取和记录
+	b, err := io.ReadAll(io.LimitReader(req.Body, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, body[:10], string(b))
+	assert.Equal(t, body[:10], string(snapshot.Body))
+	assert.False(t, snapshot.Replayable())
+
+	b, err = io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body[10:], string(b))
+	assert.Equal(t, body, string(snapshot.Body))
+	assert.True(t, snapshot.Replayable())
+
+	large := strings.Repeat(`b`, RequestBodyReplaySize+1)
+	req = httptest.NewRequest(`POST`, `/upload`, strings.NewReader(large))
+	snapshot = NewRequestSnapshot(&reverseproxy.NativeResponse{Request: req}, `abc`)
+	b, err = io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, large, string(b))
+	assert.Len(t, snapshot.Body, RequestBodyReplaySize)
+	assert.False(t, snapshot.Replayable())
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/webx-top/com"
+	c "github.com/webx-top/tower/config"
+)
+
+// ResourceSampleInterval 采集进程资源占用的间隔
+const ResourceSampleInterval = 2 * time.Second
+
+var errResourceUnsupported = errors.New(`resource monitoring is only supported on Linux`)
+
+// ProcessStats 是进程的资源占用
+type ProcessStats struct {
+	PID     int
+	RSS     uint64        //常驻内存(字节)
+	CPUTime time.Duration //累计占用的 CPU 时间(用户态和内核态)
+	CPU     float64       //与上一次采集之间的 CPU 使用率(%)
+	Threads int
+	FDs     int //打开的文件(包括网络连接)数量
+	Time    time.Time
+}
+
+// String 返回用于状态输出的简要信息
+func (s *ProcessStats) String() string {
+	if s == nil {
+		return ``
+	}
+	return fmt.Sprintf(`rss %s  cpu %.1f%%  threads %d  fds %d`, com.HumaneFileSize(s.RSS), s.CPU, s.Threads, s.FDs)
+}
+
+// sampleProcess 采集进程的资源占用，根据上一次的结果 prev 计算 CPU 使用率
+func sampleProcess(pid int, prev *ProcessStats) (*ProcessStats, error) {
+	stats, err := readProcessStats(pid)
+	if err != nil {
+		return nil, err
+	}
+	stats.PID = pid
+	stats.Time = time.Now()
+	if prev != nil {
+		if elapsed := stats.Time.Sub(prev.Time); elapsed > 0 {
+			stats.CPU = float64(stats.CPUTime-prev.CPUTime) / float64(elapsed) * 100
+		}
+	}
+	return stats, nil
+}
+
+// ResourceLimits 是应用实例的资源限制
+type ResourceLimits struct {
+	MaxRSS          uint64 //常驻内存上限(0为不限制)
+	RestartOnMaxRSS bool   //超过 MaxRSS 时重启应用，否则只输出警告
+	NoFile          uint64 //启动时设置的 RLIMIT_NOFILE(0为不设置)
+	AS              uint64 //启动时设置的 RLIMIT_AS(0为不设置)
+}
+
+// NewResourceLimits 解析配置中的资源限制
+func NewResourceLimits(conf c.Limits) (limits ResourceLimits, err error) {
+	if len(conf.MaxRSS) > 0 {
+		if limits.MaxRSS, err = parseSize(conf.MaxRSS); err != nil {
+			return limits, fmt.Errorf(`invalid limits.maxRSS: %w`, err)
+		}
+	}
+	switch conf.OnMaxRSS {
+	case ``, `warn`:
+	case `restart`:
+		limits.RestartOnMaxRSS = true
+	default:
+		return limits, fmt.Errorf(`invalid limits.onMaxRSS: %q (use warn or restart)`, conf.OnMaxRSS)
+	}
+	limits.NoFile = conf.NoFile
+	if len(conf.AS) > 0 {
+		if limits.AS, err = parseSize(conf.AS); err != nil {
+			return limits, fmt.Errorf(`invalid limits.as: %w`, err)
+		}
+	}
+	return limits, nil
+}
+
+// HasRlimits 是否需要在启动时设置 rlimit
+func (l ResourceLimits) HasRlimits() bool {
+	return l.NoFile > 0 || l.AS > 0
+}
+
+// monitorResources 定期采集各实例(第一个服务还包括 sidecar)的资源占用，并检查 limits.maxRSS
+func (a *App) monitorResources(ctx context.Context) {
+	ticker := time.NewTicker(ResourceSampleInterval)
+	defer ticker.Stop()
+	for {
+		for _, inst := range a.Instances() {
+			process := inst.Process()
+			if !inst.Running() || process == nil {
+				continue
+			}
+			stats, err := sampleProcess(process.Pid, inst.Stats())
+			if err != nil {
+				if errors.Is(err, errResourceUnsupported) {
+					log.Debug(`== `, err)
+					return
+				}
+				continue
+			}
+			inst.stats.Store(stats)
+			a.checkMaxRSS(inst, stats)
+		}
+		if a.Console.App == a {
+			for _, s := range a.Console.Sidecars.List() {
+				s.sample()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkMaxRSS 实例的常驻内存超过 limits.maxRSS 时输出警告或重启应用，每个实例只处理一次
+func (a *App) checkMaxRSS(inst *Instance, stats *ProcessStats) {
+	if a.Limits.MaxRSS == 0 || stats.RSS <= a.Limits.MaxRSS || !inst.overLimit.CompareAndSwap(false, true) {
+		return
+	}
+	log.Warnf(`== App at port %s uses %s of memory, exceeding limits.maxRSS (%s)`, inst.Port, com.HumaneFileSize(stats.RSS), com.HumaneFileSize(a.Limits.MaxRSS))
+	if !a.Limits.RestartOnMaxRSS || a.Busy() || inst.State() != StateReady {
+		return
+	}
+	go func() {
+		if err := a.Restart(a.ctx); err != nil {
+			log.Error(err)
+		}
+	}()
+}
+
+// applyRlimits 为刚启动的实例设置 limits.nofile 和 limits.as
+func (a *App) applyRlimits(inst *Instance) {
+	process := inst.Process()
+	if !a.Limits.HasRlimits() || process == nil {
+		return
+	}
+	if err := setRlimits(process.Pid, a.Limits); err != nil {
+		log.Warn(`== Failed to set rlimits: `, err)
+	}
+}
+
+// writeMetrics 以 Prometheus 文本格式输出各实例和 sidecar 的资源占用
+func writeMetrics(w io.Writer, apps []*App, sidecars []*Sidecar) {
+	type sample struct {
+		labels string
+		stats  *ProcessStats
+	}
+	var samples []sample
+	for _, app := range apps {
+		instances := app.Instances()
+		sort.Slice(instances, func(i, j int) bool { return instances[i].Port < instances[j].Port })
+		for _, inst := range instances {
+			if stats := inst.Stats(); stats != nil && inst.Running() {
+				labels := fmt.Sprintf(`app=%q,port=%q,instance=%q,build=%q`, app.Name, inst.Port, inst.ID, inst.BuildID)
+				samples = append(samples, sample{labels: labels, stats: stats})
+			}
+		}
+	}
+	for _, s := range sidecars {
+		if stats := s.Stats(); stats != nil {
+			samples = append(samples, sample{labels: fmt.Sprintf(`sidecar=%q`, s.Name), stats: stats})
+		}
+	}
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(*ProcessStats) string
+	}{
+		{`tower_process_resident_memory_bytes`, `gauge`, `Resident memory size in bytes.`, func(s *ProcessStats) string {
+			return strconv.FormatUint(s.RSS, 10)
+		}},
+		{`tower_process_cpu_seconds_total`, `counter`, `Total user and system CPU time spent in seconds.`, func(s *ProcessStats) string {
+			return strconv.FormatFloat(s.CPUTime.Seconds(), 'f', -1, 64)
+		}},
+		{`tower_process_threads`, `gauge`, `Number of OS threads.`, func(s *ProcessStats) string {
+			return strconv.Itoa(s.Threads)
+		}},
+		{`tower_process_open_fds`, `gauge`, `Number of open file descriptors.`, func(s *ProcessStats) string {
+			return strconv.Itoa(s.FDs)
+		}},
+	}
+	var b strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, s := range samples {
+			fmt.Fprintf(&b, "%s{%s} %s\n", m.name, s.labels, m.value(s.stats))
+		}
+	}
+	io.WriteString(w, b.String())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// clockTicks 是 /proc/<pid>/stat 中 CPU 时间的单位(sysconf(_SC_CLK_TCK)，Linux 上为 100)
+const clockTicks = 100
+
+var errProcStat = errors.New(`unexpected format of /proc/<pid>/stat`)
+
+// readProcessStats 从 /proc/<pid>/stat 和 /proc/<pid>/fd 读取进程的资源占用
+func readProcessStats(pid int) (*ProcessStats, error) {
+	dir := `/proc/` + strconv.Itoa(pid)
+	b, err := os.ReadFile(dir + `/stat`)
+	if err != nil {
+		return nil, err
+	}
+	// 进程名(第 2 项)可能包含空格和括号，从最后一个 ")" 之后开始解析，fields[0] 为第 3 项(state)
+	end := bytes.LastIndexByte(b, ')')
+	if end < 0 {
+		return nil, errProcStat
+	}
+	fields := bytes.Fields(b[end+1:])
+	if len(fields) < 22 {
+		return nil, errProcStat
+	}
+	field := func(n int) uint64 {
+		v, _ := strconv.ParseUint(string(fields[n-3]), 10, 64)
+		return v
+	}
+	stats := &ProcessStats{
+		CPUTime: time.Duration(field(14)+field(15)) * time.Second / clockTicks,
+		Threads: int(field(20)),
+		RSS:     field(24) * uint64(os.Getpagesize()),
+	}
+	if entries, err := os.ReadDir(dir + `/fd`); err == nil {
+		stats.FDs = len(entries)
+	}
+	return stats, nil
+}
+
+// setRlimits 使用 prlimit 设置已启动进程的 RLIMIT_NOFILE 和 RLIMIT_AS
+func setRlimits(pid int, limits ResourceLimits) error {
+	if limits.NoFile > 0 {
+		rlimit := &unix.Rlimit{Cur: limits.NoFile, Max: limits.NoFile}
+		if err := unix.Prlimit(pid, unix.RLIMIT_NOFILE, rlimit, nil); err != nil {
+			return errors.New(`RLIMIT_NOFILE: ` + err.Error())
+		}
+	}
+	if limits.AS > 0 {
+		rlimit := &unix.Rlimit{Cur: limits.AS, Max: limits.AS}
+		if err := unix.Prlimit(pid, unix.RLIMIT_AS, rlimit, nil); err != nil {
+			return errors.New(`RLIMIT_AS: ` + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+func readProcessStats(pid int) (*ProcessStats, error) {
+	return nil, errResourceUnsupported
+}
+
+func setRlimits(pid int, limits ResourceLimits) error {
+	return errResourceUnsupported
+}
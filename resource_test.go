@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	c "github.com/webx-top/tower/config"
+)
+
+func TestResourceLimits(t *testing.T) {
+	for s, want := range map[string]uint64{`1024`: 1024, `512MB`: 512 << 20, `1.5GiB`: 3 << 29, `64 kb`: 64 << 10} {
+		n, err := parseSize(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, want, n, s)
+	}
+	for _, s := range []string{``, `MB`, `12X`, `-1MB`} {
+		_, err := parseSize(s)
+		assert.Error(t, err, s)
+	}
+	limits, err := NewResourceLimits(c.Limits{MaxRSS: `256MB`, OnMaxRSS: `restart`, NoFile: 4096})
+	assert.NoError(t, err)
+	assert.Equal(t, ResourceLimits{MaxRSS: 256 << 20, RestartOnMaxRSS: true, NoFile: 4096}, limits)
+	assert.True(t, limits.HasRlimits())
+	_, err = NewResourceLimits(c.Limits{OnMaxRSS: `kill`})
+	assert.Error(t, err)
+
+	stats, err := sampleProcess(os.Getpid(), nil)
+	if runtime.GOOS != `linux` {
+		assert.ErrorIs(t, err, errResourceUnsupported)
+		return
+	}
+	assert.NoError(t, err)
+	assert.Greater(t, stats.RSS, uint64(0))
+	assert.Greater(t, stats.Threads, 0)
+	assert.Greater(t, stats.FDs, 0)
+	next, err := sampleProcess(os.Getpid(), stats)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, next.CPU, 0.0)
+
+	app := NewApp(context.Background(), `main.go`, `6001`, ``, ``)
+	inst := newInstance(app, `6001`, StateReady)
+	inst.BuildID = `1`
+	inst.stats.Store(next)
+	app.instances[`6001`] = inst
+	var b strings.Builder
+	writeMetrics(&b, []*App{app}, nil)
+	assert.Contains(t, b.String(), `# TYPE tower_process_resident_memory_bytes gauge`)
+	assert.Contains(t, b.String(), `tower_process_threads{app="`+app.Name+`",port="6001",instance="`+inst.ID+`",build="1"} `)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+const (
+	SidecarRestartNo        = `no`         // 意外退出后不重启
+	SidecarRestartOnFailure = `on-failure` // 以非 0 状态退出时重启
+	SidecarRestartAlways    = `always`     // 意外退出后总是重启
+	// DefaultSidecarReadyTimeout 等待 sidecar 就绪的默认最长时间
+	DefaultSidecarReadyTimeout = time.Minute
+	// SidecarStopTimeout 停止 sidecar 时等待其退出的最长时间，超时后强制结束
+	SidecarStopTimeout = 5 * time.Second
+	// sidecarRestartDelay 意外退出后第一次重启前等待的时间，之后每次加倍，最长为 sidecarRestartMaxDelay
+	sidecarRestartDelay    = time.Second
+	sidecarRestartMaxDelay = 30 * time.Second
+	// sidecarProbeInterval 检查 sidecar 是否就绪的间隔
+	sidecarProbeInterval = 200 * time.Millisecond
+)
+
+// Sidecar 是随应用一起启动和停止的其它进程，输出与应用实例一样记录在 AppLog 中(以名称标明来源)
+type Sidecar struct {
+	Name         string
+	Args         []string //命令及参数
+	Dir          string
+	Env          []string
+	Ready        string //就绪检查: tcp://host:port、http(s)://... 或 log:<正则表达式>
+	ReadyTimeout time.Duration
+	Restart      string
+	DependsOn    []string
+
+	logs     *AppLog
+	state    *StateFile
+	readyLog *regexp.Regexp
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	stopping bool
+	ready    bool
+	restarts int
+	stats    atomic.Pointer[ProcessStats] //最近一次采集的资源占用
+}
+
+// validate 检查设置并解析日志就绪检查的正则表达式
+func (s *Sidecar) validate() error {
+	if len(s.Name) == 0 {
+		return errors.New(`sidecar name is required`)
+	}
+	if len(s.Args) == 0 {
+		return fmt.Errorf(`sidecar %s: command is required`, s.Name)
+	}
+	switch s.Restart {
+	case ``:
+		s.Restart = SidecarRestartNo
+	case SidecarRestartNo, SidecarRestartOnFailure, SidecarRestartAlways:
+	default:
+		return fmt.Errorf(`sidecar %s: invalid restart policy %q`, s.Name, s.Restart)
+	}
+	if s.ReadyTimeout <= 0 {
+		s.ReadyTimeout = DefaultSidecarReadyTimeout
+	}
+	switch {
+	case len(s.Ready) == 0,
+		strings.HasPrefix(s.Ready, `tcp://`),
+		strings.HasPrefix(s.Ready, `http://`),
+		strings.HasPrefix(s.Ready, `https://`):
+	case strings.HasPrefix(s.Ready, `log:`):
+		re, err := regexp.Compile(strings.TrimPrefix(s.Ready, `log:`))
+		if err != nil {
+			return fmt.Errorf(`sidecar %s: invalid ready pattern: %w`, s.Name, err)
+		}
+		s.readyLog = re
+	default:
+		return fmt.Errorf(`sidecar %s: invalid ready check %q (use tcp://, http://, https:// or log:)`, s.Name, s.Ready)
+	}
+	return nil
+}
+
+// Status 返回 sidecar 的状态，例如: "ready (pid 123)"
+func (s *Sidecar) Status() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var status string
+	switch {
+	case s.cmd == nil:
+		status = `not started`
+	case isClosed(s.exited):
+		status = `exited`
+		if s.stopping {
+			status = `stopped`
+		}
+	case s.ready:
+		status = fmt.Sprintf(`ready (pid %d)`, s.cmd.Process.Pid)
+	default:
+		status = fmt.Sprintf(`starting (pid %d)`, s.cmd.Process.Pid)
+	}
+	if s.restarts > 0 {
+		status += fmt.Sprintf(`, restarted %d times`, s.restarts)
+	}
+	return status
+}
+
+// Stats returns the latest resource usage of the running process, or nil.
+func (s *Sidecar) Stats() *ProcessStats {
+	s.mu.Lock()
+	running := s.cmd != nil && !isClosed(s.exited)
+	s.mu.Unlock()
+	if !running {
+		return nil
+	}
+	return s.stats.Load()
+}
+
+// sample 采集正在运行的进程的资源占用
+func (s *Sidecar) sample() {
+	s.mu.Lock()
+	cmd, exited := s.cmd, s.exited
+	s.mu.Unlock()
+	if cmd == nil || isClosed(exited) {
+		return
+	}
+	prev := s.stats.Load()
+	if prev != nil && prev.PID != cmd.Process.Pid {
+		prev = nil
+	}
+	if stats, err := sampleProcess(cmd.Process.Pid, prev); err == nil {
+		s.stats.Store(stats)
+	}
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// run 启动进程并等待它就绪
+func (s *Sidecar) run(ctx context.Context) error {
+	var lines <-chan LogLine
+	if s.readyLog != nil {
+		var cancel func()
+		// 在启动前订阅，避免错过就绪的输出
+		_, lines, cancel = s.logs.Subscribe(LogFilter{Source: s.Name}, s.logs.Seq(), 0)
+		defer cancel()
+	}
+	exited, err := s.start(ctx)
+	if err != nil {
+		return err
+	}
+	err = s.waitReady(ctx, exited, lines)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.ready = true
+	s.mu.Unlock()
+	log.Info(`== Sidecar ` + s.Name + ` is ready`)
+	return nil
+}
+
+func (s *Sidecar) start(ctx context.Context) (<-chan struct{}, error) {
+	cmd := exec.Command(s.Args[0], s.Args[1:]...)
+	cmd.Dir = s.Dir
+	cmd.Env = append(os.Environ(), s.Env...)
+	stdout := s.logs.SourceWriter(s.Name, StreamStdout)
+	stderr := s.logs.SourceWriter(s.Name, StreamStderr)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+	log.Info(`== Starting sidecar ` + s.Name + `: ` + strings.Join(s.Args, ` `))
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf(`sidecar %s: %w`, s.Name, err)
+	}
+	exited := make(chan struct{})
+	s.mu.Lock()
+	s.cmd = cmd
+	s.exited = exited
+	s.ready = false
+	s.mu.Unlock()
+	pid := cmd.Process.Pid
+	s.state.AddSidecar(s.Name, pid, cmd.Path)
+	started := time.Now()
+	go func() {
+		err := cmd.Wait()
+		s.state.RemovePID(pid)
+		stdout.Flush()
+		stderr.Flush()
+		close(exited)
+		s.mu.Lock()
+		stopping := s.stopping
+		s.mu.Unlock()
+		if stopping {
+			return
+		}
+		if err != nil {
+			log.Errorf(`== Sidecar %s exited: %v`, s.Name, err)
+		} else {
+			log.Warnf(`== Sidecar %s exited`, s.Name)
+		}
+		s.restart(ctx, err, time.Since(started))
+	}()
+	return exited, nil
+}
+
+// restart 根据重启策略重新启动意外退出的进程。连续快速退出时重启间隔加倍
+func (s *Sidecar) restart(ctx context.Context, exitErr error, uptime time.Duration) {
+	if s.Restart == SidecarRestartNo || (s.Restart == SidecarRestartOnFailure && exitErr == nil) {
+		return
+	}
+	delay := sidecarRestartDelay
+	if uptime < sidecarRestartMaxDelay {
+		s.mu.Lock()
+		for i := 0; i < s.restarts && delay < sidecarRestartMaxDelay; i++ {
+			delay *= 2
+		}
+		s.mu.Unlock()
+	}
+	delay = min(delay, sidecarRestartMaxDelay)
+	log.Infof(`== Restarting sidecar %s in %v`, s.Name, delay)
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return
+	}
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		return
+	}
+	s.restarts++
+	s.mu.Unlock()
+	if err := s.run(ctx); err != nil {
+		log.Error(`== `, err)
+	}
+}
+
+// waitReady 等待就绪检查通过，进程退出或超过 ReadyTimeout 时返回错误
+func (s *Sidecar) waitReady(ctx context.Context, exited <-chan struct{}, lines <-chan LogLine) error {
+	timeout := time.NewTimer(s.ReadyTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(sidecarProbeInterval)
+	defer ticker.Stop()
+	for {
+		if s.readyLog == nil && s.probe() {
+			return nil
+		}
+		select {
+		case line := <-lines:
+			if s.readyLine(line) {
+				return nil
+			}
+		case <-ticker.C:
+		case <-exited:
+			// 进程退出前输出的行
+			for len(lines) > 0 {
+				if s.readyLine(<-lines) {
+					return nil
+				}
+			}
+			return fmt.Errorf(`sidecar %s exited before it was ready`, s.Name)
+		case <-timeout.C:
+			return fmt.Errorf(`sidecar %s is not ready after %v (%s)`, s.Name, s.ReadyTimeout, s.Ready)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// readyLine 是否是表示就绪的输出(订阅者会收到所有来源的输出)
+func (s *Sidecar) readyLine(line LogLine) bool {
+	return line.Source == s.Name && s.readyLog.MatchString(line.Text)
+}
+
+// probe 检查 tcp 端口是否可以连接或 http 地址是否返回成功的状态码
+func (s *Sidecar) probe() bool {
+	switch {
+	case len(s.Ready) == 0:
+		return true
+	case strings.HasPrefix(s.Ready, `tcp://`):
+		conn, err := net.DialTimeout(`tcp`, strings.TrimPrefix(s.Ready, `tcp://`), time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	default:
+		client := http.Client{Timeout: time.Second}
+		resp, err := client.Get(s.Ready)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode < http.StatusBadRequest
+	}
+}
+
+// stop 结束进程及其子进程，超过 SidecarStopTimeout 时强制结束
+func (s *Sidecar) stop() {
+	s.mu.Lock()
+	s.stopping = true
+	cmd, exited := s.cmd, s.exited
+	s.mu.Unlock()
+	if cmd == nil || isClosed(exited) {
+		return
+	}
+	log.Info(`== Stopping sidecar ` + s.Name)
+	if err := stopProcessGroup(cmd, exited, SidecarStopTimeout); err != nil {
+		log.Error(`== Stop sidecar `+s.Name+`: `, err)
+	}
+}
+
+// Sidecars 按依赖顺序启动 sidecar，并按相反的顺序停止
+type Sidecars struct {
+	list []*Sidecar //启动顺序
+}
+
+// NewSidecars 检查 sidecar 的设置并按依赖关系(dependsOn)排序，依赖不存在或循环依赖时返回错误
+func NewSidecars(sidecars []*Sidecar, logs *AppLog, state *StateFile) (*Sidecars, error) {
+	byName := make(map[string]*Sidecar, len(sidecars))
+	for _, s := range sidecars {
+		if err := s.validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := byName[s.Name]; ok {
+			return nil, fmt.Errorf(`duplicate sidecar %s`, s.Name)
+		}
+		s.logs = logs
+		s.state = state
+		byName[s.Name] = s
+	}
+	ss := &Sidecars{}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make(map[string]int, len(sidecars))
+	var visit func(s *Sidecar, path []string) error
+	visit = func(s *Sidecar, path []string) error {
+		switch marks[s.Name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf(`sidecar dependency cycle: %s`, strings.Join(append(path, s.Name), ` -> `))
+		}
+		marks[s.Name] = visiting
+		for _, name := range s.DependsOn {
+			dep, ok := byName[name]
+			if !ok {
+				return fmt.Errorf(`sidecar %s depends on unknown sidecar %s`, s.Name, name)
+			}
+			if err := visit(dep, append(path, s.Name)); err != nil {
+				return err
+			}
+		}
+		marks[s.Name] = visited
+		ss.list = append(ss.list, s)
+		return nil
+	}
+	for _, s := range sidecars {
+		if err := visit(s, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ss, nil
+}
+
+// List returns the sidecars in start order.
+func (ss *Sidecars) List() []*Sidecar {
+	if ss == nil {
+		return nil
+	}
+	return ss.list
+}
+
+// Start 按顺序启动 sidecar，每个 sidecar 就绪后才启动下一个
+func (ss *Sidecars) Start(ctx context.Context) error {
+	for _, s := range ss.List() {
+		if err := s.run(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop 按启动的相反顺序停止 sidecar
+func (ss *Sidecars) Stop() {
+	list := ss.List()
+	for i := len(list) - 1; i >= 0; i-- {
+		list[i].stop()
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSidecars(t *testing.T) {
+	logs := NewAppLog(nil)
+	_, err := NewSidecars([]*Sidecar{
+		{Name: `a`, Args: []string{`a`}, DependsOn: []string{`b`}},
+		{Name: `b`, Args: []string{`b`}, DependsOn: []string{`a`}},
+	}, logs, nil)
+	assert.ErrorContains(t, err, `cycle: a -> b -> a`)
+	_, err = NewSidecars([]*Sidecar{{Name: `a`, Args: []string{`a`}, DependsOn: []string{`x`}}}, logs, nil)
+	assert.ErrorContains(t, err, `unknown sidecar x`)
+	_, err = NewSidecars([]*Sidecar{{Name: `a`, Args: []string{`a`}, Restart: `sometimes`}}, logs, nil)
+	assert.Error(t, err)
+
+	sidecars, err := NewSidecars([]*Sidecar{
+		{Name: `worker`, Args: []string{os.Args[0], `-test.run=^$`}, DependsOn: []string{`queue`}, Ready: `log:no tests to run`},
+		{Name: `queue`, Args: []string{os.Args[0], `-test.run=^$`}},
+	}, logs, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `queue`, sidecars.List()[0].Name)
+	assert.Equal(t, `worker`, sidecars.List()[1].Name)
+	assert.NoError(t, sidecars.Start(context.Background()))
+	lines := logs.Lines(LogFilter{Source: `worker`}, 0)
+	if assert.NotEmpty(t, lines) {
+		assert.Equal(t, `[worker] `, lines[0].Prefix())
+	}
+	assert.Eventually(t, func() bool {
+		return strings.HasPrefix(sidecars.List()[1].Status(), `exited`)
+	}, 5*time.Second, 10*time.Millisecond)
+	sidecars.Stop()
+
+	// 未通过就绪检查
+	sidecars, _ = NewSidecars([]*Sidecar{{Name: `db`, Args: []string{os.Args[0], `-test.run=^$`}, Ready: `log:accepting connections`}}, logs, nil)
+	assert.ErrorContains(t, sidecars.Start(context.Background()), `exited before it was ready`)
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// setProcessGroup 让 sidecar 及其子进程(例如 npm 启动的 vite)属于同一个进程组，停止时一起结束
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// stopProcessGroup 向进程组发送 SIGTERM，超过 timeout 仍未退出时强制结束
+func stopProcessGroup(cmd *exec.Cmd, exited <-chan struct{}, timeout time.Duration) error {
+	pgid := -cmd.Process.Pid
+	if err := syscall.Kill(pgid, syscall.SIGTERM); err != nil {
+		return cmd.Process.Kill()
+	}
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(timeout):
+		return syscall.Kill(pgid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"time"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// stopProcessGroup 结束进程(Windows 不支持发送 SIGTERM)
+func stopProcessGroup(cmd *exec.Cmd, exited <-chan struct{}, timeout time.Duration) error {
+	if err := cmd.Process.Kill(); err != nil {
+		return err
+	}
+	select {
+	case <-exited:
+	case <-time.After(timeout):
+	}
+	return nil
+}
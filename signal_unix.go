@@ -0,0 +1,34 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// parseSignal 解析信号名称，例如: SIGHUP、HUP、usr1
+func parseSignal(name string) (os.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, `SIG`) {
+		name = `SIG` + name
+	}
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return nil, fmt.Errorf(`unknown signal: %s`, name)
+	}
+	return sig, nil
+}
+
+func signalName(sig os.Signal) string {
+	if s, ok := sig.(syscall.Signal); ok {
+		if name := unix.SignalName(s); len(name) > 0 {
+			return name
+		}
+	}
+	return sig.String()
+}
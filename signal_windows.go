@@ -0,0 +1,14 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func parseSignal(name string) (os.Signal, error) {
+	return nil, errors.New(`sending signals to the application is not supported on Windows`)
+}
+
+func signalName(sig os.Signal) string {
+	return sig.String()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// SocketActivationArg 是 tower 以 socket activation 方式启动应用时使用的内部子命令
+const SocketActivationArg = `__socket-activation`
+
+// socketActivationEnv 与 systemd 相同的环境变量(LISTEN_PID 由子进程设置)
+var socketActivationEnv = []string{`LISTEN_FDS=1`, `LISTEN_FDNAMES=http`}
+
+// socketActivationListener 为实例在本机回环地址上创建监听端口，返回的文件会作为文件描述符 3 传给应用
+func socketActivationListener(port string) (*os.File, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	tcpLn, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil, errors.New(`unsupported listener`)
+	}
+	return tcpLn.File()
+}
+
+// socketActivationCommand 通过 tower 自身启动应用，以便在 exec 前将 LISTEN_PID 设置为应用进程的 PID
+func (a *App) socketActivationCommand(port, bin string, params []string) (*exec.Cmd, *os.File, error) {
+	if !socketActivationSupported {
+		return nil, nil, errors.New(`socket activation is not supported on this platform`)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := socketActivationListener(port)
+	if err != nil {
+		return nil, nil, err
+	}
+	args := append([]string{SocketActivationArg, bin}, params...)
+	cmd := exec.CommandContext(a.ctx, self, args...)
+	cmd.ExtraFiles = []*os.File{file}
+	return cmd, file, nil
+}
+
+// runSocketActivation 在 tower 启动的子进程中运行，设置 LISTEN_PID 后替换为应用进程
+func runSocketActivation(args []string) {
+	if len(args) == 0 {
+		os.Exit(2)
+	}
+	os.Setenv(`LISTEN_PID`, strconv.Itoa(os.Getpid()))
+	err := execApp(args[0], args, os.Environ())
+	os.Stderr.WriteString(`tower: ` + err.Error() + "\n")
+	os.Exit(1)
+}
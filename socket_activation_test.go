@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSocketActivationHelperProcess 是 TestSocketActivation 中运行的进程:
+// exec 阶段相当于 tower 的 __socket-activation 子命令，serve 阶段相当于应用
+func TestSocketActivationHelperProcess(t *testing.T) {
+	switch os.Getenv(`TOWER_TEST_SOCKET`) {
+	case `exec`:
+		os.Setenv(`TOWER_TEST_SOCKET`, `serve`)
+		runSocketActivation([]string{os.Args[0], `-test.run=^TestSocketActivationHelperProcess$`})
+	case `serve`:
+		ln, err := net.FileListener(os.NewFile(3, ``))
+		if err != nil {
+			os.Exit(3)
+		}
+		http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `%s %s %d`, os.Getenv(`LISTEN_FDS`), os.Getenv(`LISTEN_PID`), os.Getpid())
+		}))
+	}
+}
+
+func TestSocketActivation(t *testing.T) {
+	if !socketActivationSupported {
+		t.Skip(`socket activation is not supported on this platform`)
+	}
+	file, err := socketActivationListener(`0`)
+	assert.NoError(t, err)
+	ln, err := net.FileListener(file)
+	assert.NoError(t, err)
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+	assert.True(t, addr.IP.IsLoopback(), addr.String())
+
+	cmd := exec.Command(os.Args[0], `-test.run=^TestSocketActivationHelperProcess$`)
+	cmd.Env = append(append(os.Environ(), `TOWER_TEST_SOCKET=exec`), socketActivationEnv...)
+	cmd.ExtraFiles = []*os.File{file}
+	assert.NoError(t, cmd.Start())
+	file.Close()
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	address := `127.0.0.1:` + strconv.Itoa(addr.Port)
+	assert.NoError(t, waitHTTPResponse(address, 10, func() bool {
+		return cmd.ProcessState == nil
+	}))
+	resp, err := http.Get(`http://` + address + `/`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	pid := strconv.Itoa(cmd.Process.Pid)
+	// LISTEN_PID 是 exec 后的应用进程的 PID
+	assert.Equal(t, `1 `+pid+` `+pid, string(b))
+}
+
+func TestWaitHTTPResponse(t *testing.T) {
+	// 端口可以连接但应用没有处理请求时不算就绪
+	ln, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	assert.NoError(t, err)
+	defer ln.Close()
+	assert.Error(t, waitHTTPResponse(ln.Addr().String(), 1, nil))
+}
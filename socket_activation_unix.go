@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+const socketActivationSupported = true
+
+func execApp(bin string, args []string, env []string) error {
+	return syscall.Exec(bin, args, env)
+}
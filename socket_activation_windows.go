@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "errors"
+
+const socketActivationSupported = false
+
+func execApp(bin string, args []string, env []string) error {
+	return errors.New(`socket activation is not supported on windows`)
+}
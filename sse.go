@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/webx-top/reverseproxy"
+)
+
+// SSEHeartbeatInterval server-sent events 连接空闲时发送注释行的间隔，用于发现已断开的客户端
+const SSEHeartbeatInterval = 15 * time.Second
+
+// streamResponse 以流的方式输出响应。fn 写入内容后调用 flush 发送给客户端，flush 返回错误表示客户端已经断开
+func streamResponse(ctx reverseproxy.Context, fn func(w io.Writer, flush func() error)) {
+	switch r := ctx.(type) {
+	case *reverseproxy.NativeResponse:
+		rc := http.NewResponseController(r.RespWriter)
+		fn(r.RespWriter, func() error {
+			if err := r.Request.Context().Err(); err != nil {
+				return err
+			}
+			return rc.Flush()
+		})
+	case *reverseproxy.FastResponse:
+		r.SetBodyStreamWriter(func(w *bufio.Writer) {
+			fn(w, w.Flush)
+		})
+	}
+}
+
+// streamEvents 以 text/event-stream 格式输出响应
+func streamEvents(ctx reverseproxy.Context, fn func(w io.Writer, flush func() error)) {
+	ctx.SetHeader(`Content-Type`, `text/event-stream`)
+	ctx.SetHeader(`Cache-Control`, `no-cache`)
+	ctx.SetHeader(`X-Accel-Buffering`, `no`)
+	ctx.SetStatusCode(http.StatusOK)
+	streamResponse(ctx, fn)
+}
+
+// writeEvent 写入一个事件，event 为空时客户端触发 message 事件
+func writeEvent(w io.Writer, event string, data string) error {
+	var b strings.Builder
+	if len(event) > 0 {
+		b.WriteString(`event: ` + event + "\n")
+	}
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString(`data: ` + line + "\n")
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeHeartbeat 写入一个注释行，客户端会忽略它
+func writeHeartbeat(w io.Writer) error {
+	_, err := io.WriteString(w, ": ping\n\n")
+	return err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+const (
+	// StateDir 保存 tower 运行状态的目录(位于编译目录下)
+	StateDir = `.tower`
+	// StateFileName 记录 tower 及其启动的实例的进程 ID、端口和可执行文件
+	StateFileName = `state.json`
+	// LockFileName 防止同一个项目同时运行多个 tower
+	LockFileName = `tower.lock`
+	// OrphanStopTimeout 结束遗留的实例时等待其退出的最长时间，超时后强制结束
+	OrphanStopTimeout = 5 * time.Second
+	// ProcessStartTolerance 状态文件中记录的启动时间晚于进程实际启动时间的最大误差
+	ProcessStartTolerance = 2 * time.Second
+)
+
+// ErrTowerRunning 同一个项目已经有 tower 在运行
+var ErrTowerRunning = errors.New(`another tower is already running for this project`)
+
+// StateInstance 是状态文件中记录的一个实例
+type StateInstance struct {
+	PID     int       `json:"pid"`
+	Port    string    `json:"port"`
+	BinFile string    `json:"binFile"`
+	BuildID string    `json:"buildId"`
+	Built   bool      `json:"built"` //可执行文件由 tower 编译生成，结束后可以删除
+	Sidecar string    `json:"sidecar,omitempty"`
+	Started time.Time `json:"started"`
+}
+
+// TowerState 是状态文件的内容
+type TowerState struct {
+	PID       int              `json:"pid"`
+	Started   time.Time        `json:"started"`
+	Instances []*StateInstance `json:"instances"`
+}
+
+// StateFile 记录正在运行的实例，tower 被强制结束后，下次启动时据此清理遗留的进程和可执行文件
+type StateFile struct {
+	dir   string
+	lock  *os.File
+	mu    sync.Mutex
+	state TowerState
+	// invalid 为 true 时上一次运行的状态文件无法解析也无法移走，不再写入状态文件
+	invalid bool
+}
+
+// OpenStateFile 锁定 dir 并返回状态文件。已经有 tower 在使用 dir 时返回 ErrTowerRunning
+func OpenStateFile(dir string) (*StateFile, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(filepath.Join(dir, LockFileName))
+	if err != nil {
+		return nil, err
+	}
+	if err = lock.Truncate(0); err == nil {
+		_, err = lock.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	s := &StateFile{dir: dir, lock: lock}
+	s.state = TowerState{PID: os.Getpid(), Started: time.Now()}
+	return s, nil
+}
+
+func (s *StateFile) path() string {
+	return filepath.Join(s.dir, StateFileName)
+}
+
+// CleanOrphans 结束上一次运行遗留的实例并删除由 tower 编译生成的可执行文件
+func (s *StateFile) CleanOrphans() {
+	b, err := os.ReadFile(s.path())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error(err)
+		}
+		s.save()
+		return
+	}
+	var previous TowerState
+	if err = json.Unmarshal(b, &previous); err != nil {
+		// 保留无法解析的状态文件以便手动检查，不能覆盖它
+		invalid := s.path() + `.invalid`
+		log.Error(`== Invalid state file `+s.path()+` (moved to `+invalid+`): `, err)
+		if err = os.Rename(s.path(), invalid); err != nil {
+			log.Error(err)
+			s.mu.Lock()
+			s.invalid = true
+			s.mu.Unlock()
+			return
+		}
+		s.save()
+		return
+	}
+	for _, inst := range previous.Instances {
+		if inst.PID > 0 && processMatches(inst.PID, inst.BinFile, inst.Started) {
+			if len(inst.Sidecar) > 0 {
+				log.Warnf(`== Stopping orphaned sidecar %s (pid %d)`, inst.Sidecar, inst.PID)
+			} else {
+				log.Warnf(`== Stopping orphaned app at port %s (pid %d)`, inst.Port, inst.PID)
+			}
+			if err := terminateProcess(inst.PID, OrphanStopTimeout); err != nil {
+				log.Error(err)
+			}
+		}
+		if inst.Built && len(inst.BinFile) > 0 {
+			if err := os.Remove(inst.BinFile); err == nil {
+				log.Info(`== Remove stale ` + inst.BinFile)
+			}
+		}
+	}
+	s.save()
+}
+
+// Add 记录已经启动的实例
+func (s *StateFile) Add(inst *Instance, built bool) {
+	process := inst.Process()
+	if s == nil || process == nil {
+		return
+	}
+	s.add(&StateInstance{
+		PID:     process.Pid,
+		Port:    inst.Port,
+		BinFile: inst.BinFile,
+		BuildID: inst.BuildID,
+		Built:   built,
+		Started: time.Now(),
+	})
+}
+
+// AddSidecar 记录已经启动的 sidecar
+func (s *StateFile) AddSidecar(name string, pid int, bin string) {
+	if s == nil {
+		return
+	}
+	s.add(&StateInstance{PID: pid, BinFile: bin, Sidecar: name, Started: time.Now()})
+}
+
+func (s *StateFile) add(inst *StateInstance) {
+	if abs, err := filepath.Abs(inst.BinFile); err == nil {
+		inst.BinFile = abs
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Instances = append(s.state.Instances, inst)
+	s.save()
+}
+
+// Remove 删除已经退出的实例
+func (s *StateFile) Remove(inst *Instance) {
+	process := inst.Process()
+	if s == nil || process == nil {
+		return
+	}
+	s.RemovePID(process.Pid)
+}
+
+// RemovePID 删除已经退出的进程
+func (s *StateFile) RemovePID(pid int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range s.state.Instances {
+		if v.PID == pid {
+			s.state.Instances = append(s.state.Instances[:i], s.state.Instances[i+1:]...)
+			break
+		}
+	}
+	s.save()
+}
+
+// Close 在正常退出时删除状态文件并释放锁
+func (s *StateFile) Close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.invalid {
+		os.Remove(s.path())
+	}
+	s.lock.Close()
+}
+
+// save 先写入临时文件再重命名，避免 tower 被强制结束时留下不完整的文件
+func (s *StateFile) save() {
+	if s.invalid {
+		return
+	}
+	b, err := json.MarshalIndent(s.state, ``, `  `)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	tmp := s.path() + `.tmp`
+	if err = os.WriteFile(tmp, b, 0644); err == nil {
+		err = os.Rename(tmp, s.path())
+	}
+	if err != nil {
+		log.Error(`== Save state file: `, err)
+	}
+}
+
+// lockedBy 返回锁文件中记录的进程 ID
+func lockedBy(f *os.File) string {
+	b := make([]byte, 32)
+	n, _ := f.ReadAt(b, 0)
+	return strings.TrimSpace(string(b[:n]))
+}
+
+func errTowerRunning(pid string) error {
+	if len(pid) == 0 {
+		return ErrTowerRunning
+	}
+	return fmt.Errorf(`%w (pid %s)`, ErrTowerRunning, pid)
+}
+
+// sameExecutable 比较进程的可执行文件和记录的文件的完整路径(可执行文件已被删除时 Linux 会加上 " (deleted)")
+func sameExecutable(exe string, bin string) bool {
+	exe = strings.TrimSuffix(strings.TrimSpace(exe), ` (deleted)`)
+	if len(exe) == 0 || len(bin) == 0 {
+		return false
+	}
+	exe, bin = realPath(exe), realPath(bin)
+	if runtime.GOOS == `windows` {
+		return strings.EqualFold(exe, bin)
+	}
+	return exe == bin
+}
+
+// realPath 返回解析了符号链接的绝对路径，文件已被删除时只解析所在目录
+func realPath(file string) string {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	if real, err := filepath.EvalSymlinks(file); err == nil {
+		return real
+	}
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(file)); err == nil {
+		file = filepath.Join(dir, filepath.Base(file))
+	}
+	return file
+}
+
+// startedAt 进程的实际启动时间 start 是否与状态文件中记录的启动时间 recorded 相符
+func startedAt(start, recorded time.Time) bool {
+	d := recorded.Sub(start)
+	return d > -time.Second && d < ProcessStartTolerance
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateFile(t *testing.T) {
+	dir := t.TempDir()
+	state, err := OpenStateFile(dir)
+	assert.NoError(t, err)
+	_, err = OpenStateFile(dir)
+	assert.ErrorIs(t, err, ErrTowerRunning)
+	assert.Contains(t, err.Error(), strconv.Itoa(os.Getpid()))
+
+	// 上一次运行遗留的状态: 当前进程的可执行文件与记录的不同，不能被结束
+	bin := dir + `/tower-app-1`
+	assert.NoError(t, os.WriteFile(bin, []byte(`bin`), 0755))
+	previous := TowerState{PID: 1, Instances: []*StateInstance{
+		{PID: os.Getpid(), Port: `6001`, BinFile: bin, Built: true},
+	}}
+	b, _ := json.Marshal(previous)
+	assert.NoError(t, os.WriteFile(dir+`/`+StateFileName, b, 0644))
+	state.CleanOrphans()
+	_, err = os.Stat(bin)
+	assert.True(t, os.IsNotExist(err))
+
+	app := NewApp(context.Background(), `main.go`, `6001`, ``, ``)
+	inst := newInstance(app, `6001`, StateStarting)
+	inst.cmd = exec.Command(`go`, `version`)
+	assert.NoError(t, inst.cmd.Start())
+	inst.cmd.Wait()
+	inst.process = inst.cmd.Process
+	state.Add(inst, true)
+	var saved TowerState
+	b, _ = os.ReadFile(dir + `/` + StateFileName)
+	assert.NoError(t, json.Unmarshal(b, &saved))
+	assert.Equal(t, os.Getpid(), saved.PID)
+	if assert.Len(t, saved.Instances, 1) {
+		assert.Equal(t, inst.cmd.Process.Pid, saved.Instances[0].PID)
+		assert.Equal(t, `6001`, saved.Instances[0].Port)
+	}
+	state.Remove(inst)
+	b, _ = os.ReadFile(dir + `/` + StateFileName)
+	saved = TowerState{}
+	json.Unmarshal(b, &saved)
+	assert.Len(t, saved.Instances, 0)
+
+	state.Close()
+	_, err = os.Stat(dir + `/` + StateFileName)
+	assert.True(t, os.IsNotExist(err))
+	state, err = OpenStateFile(dir)
+	assert.NoError(t, err)
+	state.Close()
+	assert.True(t, sameExecutable("/tmp/tower-app-1 (deleted)\n", `/tmp/tower-app-1`))
+	assert.False(t, sameExecutable(`/tmp/tower-app-1`, `/tmp/other/tower-app-1`))
+	assert.False(t, sameExecutable(``, `tower-app-1`))
+}
+
+func TestStateFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+	state, err := OpenStateFile(dir)
+	assert.NoError(t, err)
+	defer state.Close()
+	assert.NoError(t, os.WriteFile(state.path(), []byte(`{"instances":[`), 0644))
+	state.CleanOrphans()
+	// 无法解析的状态文件被移走而不是被覆盖
+	b, err := os.ReadFile(state.path() + `.invalid`)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"instances":[`, string(b))
+	var saved TowerState
+	b, _ = os.ReadFile(state.path())
+	assert.NoError(t, json.Unmarshal(b, &saved))
+	assert.Equal(t, os.Getpid(), saved.PID)
+}
+
+func TestCleanOrphans(t *testing.T) {
+	cmd := exec.Command(os.Args[0], `-test.run=^TestInstanceHelperProcess$`)
+	cmd.Env = append(os.Environ(), `TOWER_TEST_INSTANCE=1`)
+	assert.NoError(t, cmd.Start())
+	started := time.Now()
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	defer cmd.Process.Kill()
+
+	// 启动时间不符: 进程 ID 已经被其它进程重用
+	assert.False(t, processMatches(cmd.Process.Pid, os.Args[0], started.Add(-time.Hour)))
+	assert.False(t, processMatches(cmd.Process.Pid, os.Args[0]+`.other`, started))
+	assert.True(t, processMatches(cmd.Process.Pid, os.Args[0], started))
+
+	dir := t.TempDir()
+	state, err := OpenStateFile(dir)
+	assert.NoError(t, err)
+	defer state.Close()
+	previous := TowerState{PID: 1, Instances: []*StateInstance{
+		{PID: cmd.Process.Pid, Port: `6001`, BinFile: os.Args[0], Started: started},
+	}}
+	b, _ := json.Marshal(previous)
+	assert.NoError(t, os.WriteFile(state.path(), b, 0644))
+	state.CleanOrphans()
+	select {
+	case <-exited:
+	case <-time.After(OrphanStopTimeout + time.Second):
+		t.Fatal(`the orphaned instance was not stopped`)
+	}
+}
@@ -0,0 +1,83 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockFile 以 flock 锁定文件，进程退出(包括被强制结束)时锁会自动释放
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		pid := lockedBy(f)
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errTowerRunning(pid)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// processMatches 进程 pid 是否存在、运行的是 bin 并且在 started 时启动(started 为零值时不比较启动时间)
+func processMatches(pid int, bin string, started time.Time) bool {
+	exe, err := os.Readlink(`/proc/` + strconv.Itoa(pid) + `/exe`)
+	if err != nil {
+		if _, statErr := os.Stat(`/proc/self/exe`); statErr == nil {
+			// 有 /proc 但找不到进程
+			return false
+		}
+		out, err := exec.Command(`ps`, `-p`, strconv.Itoa(pid), `-o`, `comm=`).Output()
+		if err != nil {
+			return false
+		}
+		exe = string(out)
+	}
+	if !sameExecutable(exe, bin) {
+		return false
+	}
+	if started.IsZero() {
+		return true
+	}
+	start, err := processStartTime(pid)
+	return err == nil && startedAt(start, started)
+}
+
+// processStartTime 返回进程 pid 的启动时间(精确到秒)
+func processStartTime(pid int) (time.Time, error) {
+	cmd := exec.Command(`ps`, `-p`, strconv.Itoa(pid), `-o`, `lstart=`)
+	cmd.Env = append(os.Environ(), `LC_ALL=C`)
+	out, err := cmd.Output()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.ParseInLocation(`Mon Jan _2 15:04:05 2006`, strings.TrimSpace(string(out)), time.Local)
+}
+
+// terminateProcess 发送 SIGTERM，超过 timeout 仍未退出时强制结束
+func terminateProcess(pid int, timeout time.Duration) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err = p.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		if p.Signal(syscall.Signal(0)) != nil {
+			return nil
+		}
+	}
+	return p.Kill()
+}
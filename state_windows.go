@@ -0,0 +1,58 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockFile 以独占方式创建锁文件。锁文件已存在但记录的进程已经退出时(tower 被强制结束)接管它
+func lockFile(path string) (*os.File, error) {
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		b, _ := os.ReadFile(path)
+		pid := strings.TrimSpace(string(b))
+		exe, _ := os.Executable()
+		if id, _ := strconv.Atoi(pid); id > 0 && processMatches(id, exe, time.Time{}) {
+			return nil, errTowerRunning(pid)
+		}
+		os.Remove(path)
+	}
+	return nil, errTowerRunning(``)
+}
+
+// processMatches 进程 pid 是否存在、运行的是 bin 并且在 started 时启动(started 为零值时不比较启动时间)
+func processMatches(pid int, bin string, started time.Time) bool {
+	script := `$p = Get-Process -Id ` + strconv.Itoa(pid) + ` -ErrorAction Stop; $p.Path; $p.StartTime.ToUniversalTime().ToString('o')`
+	out, err := exec.Command(`powershell`, `-NoProfile`, `-NonInteractive`, `-Command`, script).Output()
+	if err != nil {
+		return false
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) < 2 || !sameExecutable(lines[0], bin) {
+		return false
+	}
+	if started.IsZero() {
+		return true
+	}
+	start, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(lines[1]))
+	return err == nil && startedAt(start, started)
+}
+
+func terminateProcess(pid int, timeout time.Duration) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
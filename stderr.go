@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// StderrBufferSize 每个实例保留的 stderr 输出的最大字节数
+	StderrBufferSize = 64 * 1024
+	// CrashHeadSize stderr 超过 StderrBufferSize 时保留的 panic 或 fatal error 输出开头的最大字节数
+	CrashHeadSize = 16 * 1024
+	// CrashTailLines 没有找到 panic 信息时，取 stderr 最后多少行作为错误信息(例如 log.Fatal 的输出)
+	CrashTailLines = 20
+)
+
+var regexCrashStart = regexp.MustCompile(`(?m)^(panic: |fatal error: |SIGQUIT: |SIGABRT: |SIGSEGV: )`)
+
+// AppCrash 记录应用进程意外退出时的信息
+type AppCrash struct {
+	Port     string
+	Output   string
+	ExitCode int
+	Signal   string
+	Time     time.Time
+
+	reported sync.Once
+}
+
+// Status returns the exit status in the same form as exec.ExitError.
+func (c *AppCrash) Status() string {
+	if len(c.Signal) > 0 {
+		return `signal: ` + c.Signal
+	}
+	return `exit status ` + strconv.Itoa(c.ExitCode)
+}
+
+// MarkReported returns true only the first time it is called.
+func (c *AppCrash) MarkReported() (first bool) {
+	c.reported.Do(func() {
+		first = true
+	})
+	return
+}
+
+func NewStderrCapturer(app *App, port string) *StderrCapturer {
+	return &StderrCapturer{
+		app:     app,
+		port:    port,
+		scanner: NewPanicScanner(app, port),
+		done:    make(chan struct{}),
+	}
+}
+
+type StderrCapturer struct {
+	app      *App
+	port     string
+	out      *LogWriter //为空时输出到 os.Stdout
+	mu       sync.Mutex
+	buf      []byte
+	crashAt  int  //buf 中第一个 panic 或 fatal error 的位置
+	pinned   bool //是否已经找到 panic 或 fatal error，找到后缓冲区超出时从中间删除
+	scanner  *PanicScanner
+	stopping bool
+	crash    *AppCrash
+	done     chan struct{}
+}
+
+func (a *StderrCapturer) Write(p []byte) (n int, err error) {
+	a.mu.Lock()
+	start := len(a.buf)
+	a.buf = append(a.buf, p...)
+	if !a.pinned {
+		from := bytes.LastIndexByte(a.buf[:start], '\n') + 1
+		if loc := regexCrashStart.FindIndex(a.buf[from:]); loc != nil {
+			a.crashAt = from + loc[0]
+			a.pinned = true
+		}
+	}
+	if over := len(a.buf) - StderrBufferSize; over > 0 {
+		a.trim(over)
+	}
+	a.mu.Unlock()
+	a.scanner.Scan(p)
+
+	s := string(p)
+	httpError := strings.Contains(s, HttpPanicMessage)
+
+	var out io.Writer = os.Stdout
+	if a.out != nil {
+		out = a.out
+	}
+	if httpError {
+		a.app.Requests.Report(a.port, s)
+		out.Write([]byte("----------- Application Error -----------\n"))
+		n, err = out.Write(p)
+		out.Write([]byte("-----------------------------------------\n"))
+	} else {
+		n, err = out.Write(p)
+	}
+	return
+}
+
+// trim 删除 over 字节。panic 或 fatal error 之后的输出(例如所有 goroutine 的调用栈)过多时，
+// 保留其开头(错误信息和发生 panic 的 goroutine)，从中间按行删除
+func (a *StderrCapturer) trim(over int) {
+	if !a.pinned {
+		a.buf = append(a.buf[:0], a.buf[over:]...)
+		return
+	}
+	if over <= a.crashAt {
+		a.buf = append(a.buf[:0], a.buf[over:]...)
+		a.crashAt -= over
+		return
+	}
+	a.buf = append(a.buf[:0], a.buf[a.crashAt:]...)
+	over -= a.crashAt
+	a.crashAt = 0
+	head := len(a.buf) - over
+	if head > CrashHeadSize {
+		head = CrashHeadSize
+	}
+	if i := bytes.LastIndexByte(a.buf[:head], '\n'); i > -1 {
+		head = i + 1
+	}
+	end := head + over
+	if i := bytes.IndexByte(a.buf[end:], '\n'); i > -1 {
+		end += i + 1
+	}
+	a.buf = append(a.buf[:head], a.buf[end:]...)
+}
+
+// Output returns the buffered stderr output of the instance.
+func (a *StderrCapturer) Output() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return string(a.buf)
+}
+
+// Stopping marks the instance as stopped by tower, so its exit is not treated as a crash.
+func (a *StderrCapturer) Stopping() {
+	a.mu.Lock()
+	a.stopping = true
+	a.mu.Unlock()
+}
+
+func (a *StderrCapturer) IsStopping() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stopping
+}
+
+// Crashing reports whether a panic or fatal error has been written, the process may not have exited yet.
+func (a *StderrCapturer) Crashing() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.pinned
+}
+
+// Exited parses the buffered output once the process has exited.
+func (a *StderrCapturer) Exited(state *os.ProcessState) *AppCrash {
+	a.mu.Lock()
+	defer func() {
+		a.mu.Unlock()
+		close(a.done)
+	}()
+	if a.stopping || state == nil {
+		return nil
+	}
+	crash := &AppCrash{
+		Port:     a.port,
+		ExitCode: state.ExitCode(),
+		Time:     time.Now(),
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		crash.Signal = ws.Signal().String()
+	}
+	abnormal := crash.ExitCode != 0 || len(crash.Signal) > 0
+	crash.Output = parseCrashOutput(string(a.buf), abnormal)
+	if len(crash.Output) == 0 {
+		if !abnormal {
+			return nil
+		}
+		crash.Output = crash.Status()
+	}
+	a.crash = crash
+	return crash
+}
+
+// Crash returns the crash information if the process exited unexpectedly.
+func (a *StderrCapturer) Crash() *AppCrash {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.crash
+}
+
+// Wait waits for the process to exit and returns the crash information.
+func (a *StderrCapturer) Wait(timeout time.Duration) *AppCrash {
+	select {
+	case <-a.done:
+		return a.Crash()
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// parseCrashOutput 从 stderr 中提取最后一次 panic 或 fatal error 的完整输出，
+// 如果没有找到并且进程异常退出，则使用最后几行输出(例如 log.Fatal)
+func parseCrashOutput(output string, abnormal bool) string {
+	locs := regexCrashStart.FindAllStringIndex(output, -1)
+	if len(locs) > 0 {
+		return strings.TrimSpace(output[locs[len(locs)-1][0]:])
+	}
+	if !abnormal {
+		return ``
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) > CrashTailLines {
+		lines = lines[len(lines)-CrashTailLines:]
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrashOutput(t *testing.T) {
+	wd, _ := os.Getwd()
+	wd = filepath.ToSlash(wd)
+	stderr := "2013/02/12 18:24:15 listening\n" +
+		"panic: worker failed\n\n" +
+		"goroutine 7 [running]:\n" +
+		"main.worker()\n" +
+		"\t" + wd + "/test/dev/server1.go:21 +0x1d\n" +
+		"created by main.main in goroutine 1\n" +
+		"\t" + wd + "/test/dev/server1.go:30 +0x25\n"
+	output := parseCrashOutput(stderr, true)
+	assert.True(t, strings.HasPrefix(output, `panic: worker failed`))
+
+	message, trace, appIndex := extractAppErrorInfo(output)
+	assert.Equal(t, `panic: worker failed`, message[0])
+	assert.Equal(t, 0, appIndex)
+	assert.Equal(t, `test/dev/server1.go`, trace[0].File)
+	assert.Equal(t, 21, trace[0].Line)
+
+	// log.Fatal: no panic message, use the last lines.
+	output = parseCrashOutput("2013/02/12 18:24:15 ListenAndServe: address already in use\n", true)
+	assert.Equal(t, `2013/02/12 18:24:15 ListenAndServe: address already in use`, output)
+	assert.Equal(t, ``, parseCrashOutput("bye\n", false))
+}
+
+func TestStderrCapturerTrim(t *testing.T) {
+	a := NewStderrCapturer(&App{Requests: NewRequestTracker()}, `6001`)
+	a.out = NewAppLog(io.Discard).SourceWriter(`app`, StreamStderr)
+	a.Write([]byte(strings.Repeat("listening\n", 1000)))
+	a.Write([]byte("panic: worker failed\n\ngoroutine 7 [running]:\nmain.worker()\n\t/go/src/app/main.go:21 +0x1d\n"))
+	for i := 0; i < 5000; i++ {
+		a.Write([]byte("\ngoroutine " + strconv.Itoa(i+8) + " [select]:\nmain.idle()\n\t/go/src/app/main.go:30 +0x25\n"))
+	}
+	output := a.Output()
+	assert.True(t, len(output) <= StderrBufferSize)
+	assert.True(t, strings.HasPrefix(output, "panic: worker failed\n"))
+	assert.Contains(t, output, "goroutine 5007 [select]:\nmain.idle()\n")
+
+	message, trace, _ := extractAppErrorInfo(parseCrashOutput(output, true))
+	assert.Equal(t, `panic: worker failed`, message[0])
+	assert.Equal(t, 21, trace[0].Line)
+}
+
+// TestCrashHelperProcess 是 TestCrashPage 中运行的应用进程，/crash 在 HTTP handler 以外的 goroutine 中 panic
+func TestCrashHelperProcess(t *testing.T) {
+	if os.Getenv(`TOWER_TEST_CRASH`) != `1` {
+		return
+	}
+	http.HandleFunc(`/crash`, func(w http.ResponseWriter, r *http.Request) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			panic(errors.New(`Crash !!`))
+		}()
+		<-done
+	})
+	http.ListenAndServe(`127.0.0.1:`+os.Getenv(`TOWER_TEST_PORT`), nil)
+	os.Exit(1)
+}
+
+func TestCrashPage(t *testing.T) {
+	dir := t.TempDir()
+	// 使用测试程序的副本，停止实例时会删除可执行文件
+	b, err := os.ReadFile(os.Args[0])
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, `tower-app-test`), b, 0755))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	app := NewApp(ctx, `main.go`, `0`, dir, ``)
+	app.binName = `tower-app-test`
+	app.DisabledBuild = true
+	app.RunParams = []string{`-test.run=^TestCrashHelperProcess$`}
+	app.Env = []string{`TOWER_TEST_CRASH=1`, `TOWER_TEST_PORT=` + PortTemplateVar}
+	defer func() {
+		for _, inst := range app.Instances() {
+			inst.kill()
+		}
+	}()
+	if !assert.NoError(t, app.Start(ctx, false)) {
+		return
+	}
+	proxyPort, err := kernelFreePort()
+	assert.NoError(t, err)
+	proxy := NewProxy(ctx, app, &Watcher{})
+	proxy.Port = `127.0.0.1:` + proxyPort
+	proxy.AutoRestartMaxTimes = 0
+	go proxy.Listen()
+	assert.NoError(t, dialAddress(proxy.Port, 10, nil))
+
+	// 进程因为 handler 以外的 panic 退出，错误页面显示 panic 的输出
+	resp, err := http.Get(`http://` + proxy.Port + `/crash`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	b, _ = io.ReadAll(resp.Body)
+	page := string(b)
+	assert.Contains(t, page, `Application Crashed`)
+	assert.Contains(t, page, `panic: Crash !!`)
+	assert.Contains(t, page, `TestCrashHelperProcess`)
+}
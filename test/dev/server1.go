@@ -42,3 +42,17 @@ func Exit(w http.ResponseWriter, req *http.Request) {
 func Panic(w http.ResponseWriter, req *http.Request) {
 	panic(errors.New("Panic !!"))
 }
+
+// Crash 在 init 中注册，以免改变上面的函数所在的行(main_test.go 会检查错误页面上的行号)
+func init() {
+	http.HandleFunc("/crash", Crash)
+}
+
+func Crash(w http.ResponseWriter, req *http.Request) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		panic(errors.New("Crash !!"))
+	}()
+	<-done
+}
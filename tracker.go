@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+const (
+	// PanicClaimWindow 未能通过请求 ID 关联的 panic 在此时间内可被 panic 开始时实例上唯一进行中的请求认领
+	PanicClaimWindow = 5 * time.Second
+	// PanicWaitTimeout 请求结束时等待尚未输出完整的 panic 的最长时间
+	PanicWaitTimeout = PanicBlockIdle * 3
+	// TrackedRequestMaxAge 超过此时间的请求记录将被清除(例如没有经过 ResponseAfter 的请求)
+	TrackedRequestMaxAge = time.Hour
+	// FailedRequestsSize 保留最近多少个触发了 panic 的请求(用于重放)
+	FailedRequestsSize = 20
+	// ServerErrorWait 应用返回 5xx 响应时等待其错误输出(例如带有调用栈的错误日志)的最长时间
+	ServerErrorWait = 100 * time.Millisecond
+	// serverErrorCheckInterval 等待错误输出时检查的间隔
+	serverErrorCheckInterval = 10 * time.Millisecond
+)
+
+// AppPanic 是从 stderr 中捕获到的一次 panic
+type AppPanic struct {
+	Port    string
+	Message string
+	Time    time.Time
+
+	owner     *TrackedRequest
+	candidate *TrackedRequest //panic 开始时实例上唯一进行中的请求，没有或有多个时为 nil
+	inFlight  int             //panic 开始时实例上进行中的请求数
+	done      chan struct{}
+}
+
+// TrackedRequest 是一个正在经过代理的请求
+type TrackedRequest struct {
+	ID      string
+	Port    string
+	Start   time.Time
+	Request *RequestSnapshot
+
+	panic *AppPanic
+}
+
+// RequestTracker 记录正在处理的请求，并将 panic 关联到触发它的请求
+type RequestTracker struct {
+	mu       sync.Mutex
+	requests map[string]*TrackedRequest
+	pending  []*AppPanic
+	failed   []*RequestSnapshot
+}
+
+func NewRequestTracker() *RequestTracker {
+	return &RequestTracker{
+		requests: make(map[string]*TrackedRequest),
+	}
+}
+
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Begin starts tracking a request sent to the instance listening on port.
+func (t *RequestTracker) Begin(id string, port string, snapshots ...*RequestSnapshot) *TrackedRequest {
+	now := time.Now()
+	req := &TrackedRequest{ID: id, Port: port, Start: now}
+	if len(snapshots) > 0 {
+		req.Request = snapshots[0]
+	}
+	t.mu.Lock()
+	for key, r := range t.requests {
+		if now.Sub(r.Start) > TrackedRequestMaxAge {
+			delete(t.requests, key)
+		}
+	}
+	t.requests[id] = req
+	t.mu.Unlock()
+	return req
+}
+
+// Panicking records the beginning of a panic output on the instance listening on port.
+// The returned AppPanic must be finished with Finish.
+func (t *RequestTracker) Panicking(port string) *AppPanic {
+	p := &AppPanic{Port: port, Time: time.Now(), done: make(chan struct{})}
+	t.mu.Lock()
+	for _, req := range t.requests {
+		if req.Port == port && req.panic == nil {
+			p.inFlight++
+			p.candidate = req
+		}
+	}
+	if p.inFlight != 1 {
+		p.candidate = nil
+	}
+	t.pending = append(t.pending, p)
+	t.mu.Unlock()
+	return p
+}
+
+// Finish completes the panic and assigns it to the request whose ID appears in the message.
+func (t *RequestTracker) Finish(p *AppPanic, message string) {
+	t.mu.Lock()
+	p.Message = message
+	if p.owner == nil {
+		for id, req := range t.requests {
+			if req.panic == nil && strings.Contains(message, id) {
+				t.assign(p, req)
+				break
+			}
+		}
+	}
+	unattributed := p.owner == nil && p.candidate == nil
+	t.mu.Unlock()
+	close(p.done)
+	if unattributed {
+		log.Warnf(`== Unattributed panic on port %s (%d requests in flight)`, p.Port, p.inFlight)
+	}
+}
+
+// Report records a complete panic output.
+func (t *RequestTracker) Report(port string, message string) {
+	t.Finish(t.Panicking(port), message)
+}
+
+func (t *RequestTracker) assign(p *AppPanic, req *TrackedRequest) {
+	p.owner = req
+	req.panic = p
+	for i, v := range t.pending {
+		if v == p {
+			t.pending = append(t.pending[:i], t.pending[i+1:]...)
+			break
+		}
+	}
+}
+
+// End stops tracking the request and returns the panic message caused by it and its snapshot.
+// A panic that can not be matched by request ID is claimed by the request only if it was
+// the only request in flight on the same instance when the panic began.
+func (t *RequestTracker) End(id string) (message string, snapshot *RequestSnapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	req, ok := t.requests[id]
+	if !ok {
+		return
+	}
+	delete(t.requests, id)
+	for {
+		p := req.panic
+		if p == nil {
+			p = t.claimable(req)
+		}
+		if p == nil {
+			return ``, req.Request
+		}
+		select {
+		case <-p.done:
+		default:
+			// 等待 panic 输出完整后再确认是否属于其它请求
+			t.mu.Unlock()
+			select {
+			case <-p.done:
+			case <-time.After(PanicWaitTimeout):
+			}
+			t.mu.Lock()
+		}
+		if p.owner != nil && p.owner != req {
+			continue
+		}
+		if p.owner == nil {
+			select {
+			case <-p.done:
+				t.assign(p, req)
+			default:
+				// 超时仍未结束
+				return ``, req.Request
+			}
+		}
+		if req.Request != nil {
+			t.failed = append(t.failed, req.Request)
+			if len(t.failed) > FailedRequestsSize {
+				t.failed = t.failed[len(t.failed)-FailedRequestsSize:]
+			}
+		}
+		return p.Message, req.Request
+	}
+}
+
+// AwaitPanic 等待可以关联到请求的 panic 或错误输出，最多等待 timeout。
+// 应用的错误输出经由管道读取，可能晚于响应到达代理
+func (t *RequestTracker) AwaitPanic(id string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		t.mu.Lock()
+		req, ok := t.requests[id]
+		found := !ok || req.panic != nil || t.claimable(req) != nil
+		t.mu.Unlock()
+		if found || time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(serverErrorCheckInterval)
+	}
+}
+
+// Failed returns a recent request that caused a panic.
+func (t *RequestTracker) Failed(id string) *RequestSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range t.failed {
+		if r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+func (t *RequestTracker) claimable(req *TrackedRequest) *AppPanic {
+	now := time.Now()
+	var found *AppPanic
+	pending := t.pending[:0]
+	for _, p := range t.pending {
+		if now.Sub(p.Time) > PanicClaimWindow {
+			continue
+		}
+		pending = append(pending, p)
+		if found == nil && p.owner == nil && p.candidate == req {
+			found = p
+		}
+	}
+	t.pending = pending
+	return found
+}
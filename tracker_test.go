@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/webx-top/reverseproxy"
+)
+
+func TestRequestTracker(t *testing.T) {
+	tracker := NewRequestTracker()
+	idA, idB := NewRequestID(), NewRequestID()
+	tracker.Begin(idA, `6001`)
+	tracker.Begin(idB, `6001`)
+
+	// matched by request ID
+	tracker.Report(`6001`, "[Recovery] panic recovered:\nX-Request-Id: "+idB+"\n\nPanic !!")
+	message, _ := tracker.End(idA)
+	assert.Equal(t, ``, message)
+	message, _ = tracker.End(idB)
+	assert.Contains(t, message, `Panic !!`)
+
+	// matched by timing: the only request in flight on the same instance when the panic began
+	idC, idD, idE := NewRequestID(), NewRequestID(), NewRequestID()
+	tracker.Begin(idC, `6001`)
+	tracker.Begin(idD, `6002`)
+	p := tracker.Panicking(`6001`)
+	go func() {
+		time.Sleep(PanicBlockIdle / 2)
+		tracker.Finish(p, `Panic !!`)
+	}()
+	tracker.Begin(idE, `6001`)
+	message, _ = tracker.End(idD)
+	assert.Equal(t, ``, message)
+	message, _ = tracker.End(idC)
+	assert.Equal(t, `Panic !!`, message)
+	message, _ = tracker.End(idE)
+	assert.Equal(t, ``, message)
+
+	// not attributed: more than one request in flight on the same instance
+	idF, idG := NewRequestID(), NewRequestID()
+	tracker.Begin(idF, `6001`)
+	tracker.Begin(idG, `6001`)
+	tracker.Report(`6001`, `Panic !!`)
+	message, _ = tracker.End(idF)
+	assert.Equal(t, ``, message)
+	message, _ = tracker.End(idG)
+	assert.Equal(t, ``, message)
+}
+
+func TestAssignRequestID(t *testing.T) {
+	req := httptest.NewRequest(`GET`, `/`, nil)
+	req.Header.Set(RequestIDHeader, `client-id`)
+	ctx := &reverseproxy.NativeResponse{Request: req}
+	id := assignRequestID(ctx)
+	assert.NotEqual(t, `client-id`, id)
+	assert.Equal(t, id, requestID(ctx))
+	assert.Equal(t, `client-id`, req.Header.Get(ClientRequestIDHeader))
+
+	req = httptest.NewRequest(`GET`, `/`, nil)
+	req.Header.Set(ClientRequestIDHeader, `forged`)
+	assignRequestID(&reverseproxy.NativeResponse{Request: req})
+	assert.Len(t, req.Header.Get(RequestIDHeader), 32)
+	assert.Equal(t, ``, req.Header.Get(ClientRequestIDHeader))
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -57,13 +59,52 @@ func dialAddress(address string, timeOut int, args ...func() bool) (err error) {
 	return err
 }
 
+// waitHTTPResponse 等待 address 上的应用返回 HTTP 响应(任意状态码)，超过 timeOut 秒时返回错误。
+// fn 返回 false 时停止等待(例如进程已经退出)
+func waitHTTPResponse(address string, timeOut int, fn func() bool) error {
+	client := &http.Client{
+		Timeout: time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.Now().Add(time.Duration(timeOut) * time.Second)
+	for range ticker.C {
+		resp, err := client.Head(`http://` + address + `/`)
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+		if fn != nil && !fn() {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf(`no response from %s: %w`, address, err)
+		}
+	}
+	return nil
+}
+
+// isFreePort 通过尝试监听端口来判断端口是否可用
 func isFreePort(port string) bool {
-	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
-	if err == nil {
-		conn.Close()
-		return true
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+// kernelFreePort 由操作系统分配一个可用的端口
+func kernelFreePort() (string, error) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return ``, err
 	}
-	return false
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port), nil
 }
 
 func mustSuccess(err error) {
@@ -113,3 +154,31 @@ func parseParams(param string) []string {
 	}
 	return strings.Split(param, delim)
 }
+
+// parseSize 解析大小，例如: 512MB、1.5GB、1024(字节)。单位按 1024 进位，不区分大小写
+func parseSize(s string) (uint64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	num := strings.TrimRight(strings.TrimSuffix(strings.TrimSuffix(s, `IB`), `B`), `KMGT`)
+	unit := strings.TrimSpace(strings.TrimPrefix(s, num))
+	num = strings.TrimSpace(num)
+	var multiple float64
+	switch strings.TrimSuffix(strings.TrimSuffix(unit, `IB`), `B`) {
+	case ``:
+		multiple = 1
+	case `K`:
+		multiple = 1 << 10
+	case `M`:
+		multiple = 1 << 20
+	case `G`:
+		multiple = 1 << 30
+	case `T`:
+		multiple = 1 << 40
+	default:
+		return 0, fmt.Errorf(`invalid size: %q`, s)
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf(`invalid size: %q`, s)
+	}
+	return uint64(n * multiple), nil
+}
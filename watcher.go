@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -29,6 +30,12 @@ type Watcher struct {
 	OnlyWatchBin       bool
 	FileNameSuffix     string
 	Paused             bool
+	Filter             func(file string) bool //返回 false 时忽略此文件的更改，为空时不过滤
+	Reloads            []*ReloadRule          //匹配的文件更改时调用 OnReload 而不重新编译
+	OnReload           func(sig os.Signal)
+	EnvFiles           []string //更改时调用 OnEnvChanged 的 .env 文件(绝对路径)
+	OnEnvChanged       func()
+	OnStylesheet       func(file string) //不为空时 CSS 文件(不匹配 FilePattern 时)的更改调用它而不重新编译
 	compiling          atomic.Bool
 	lastEventTime      atomic.Int64
 }
@@ -72,6 +79,17 @@ func (w *Watcher) Watch(ctx context.Context) (err error) {
 	})
 	defer dr.Close()
 
+	reloadTimers := map[os.Signal]*time.Timer{}
+	var envTimer *time.Timer
+	defer func() {
+		for _, t := range reloadTimers {
+			t.Stop()
+		}
+		if envTimer != nil {
+			envTimer.Stop()
+		}
+	}()
+
 	expectedFileReg := regexp.MustCompile(filePattern)
 	defer w.Watcher.Close()
 	for {
@@ -85,7 +103,33 @@ func (w *Watcher) Watch(ctx context.Context) (err error) {
 			if checkTMPFile(file.Name) {
 				continue
 			}
+			if w.isEnvFile(file.Name) {
+				log.Info(`== Env file changed: `, file.Name)
+				if envTimer != nil {
+					envTimer.Reset(EnvReloadDelay)
+				} else {
+					envTimer = time.AfterFunc(EnvReloadDelay, w.OnEnvChanged)
+				}
+				continue
+			}
+			if rule := w.reloadRule(file.Name); rule != nil {
+				log.Info(`== Reload triggered: `, file.Name)
+				if t, ok := reloadTimers[rule.Signal]; ok {
+					t.Reset(ReloadDelay)
+				} else {
+					sig := rule.Signal
+					reloadTimers[sig] = time.AfterFunc(ReloadDelay, func() {
+						w.OnReload(sig)
+					})
+				}
+				continue
+			}
 			if !expectedFileReg.MatchString(file.Name) {
+				if w.OnStylesheet != nil && isStylesheet(file.Name) {
+					log.Info(`== Stylesheet changed: `, file.Name)
+					w.OnStylesheet(file.Name)
+					continue
+				}
 				if w.OnlyWatchBin {
 					log.Info("== [IGNORE]", file.Name)
 				}
@@ -123,6 +167,10 @@ func (w *Watcher) Watch(ctx context.Context) (err error) {
 					log.Info(`忽略`, fileName, `更改`)
 					continue
 				}
+				if w.Filter != nil && !w.Filter(file.Name) {
+					log.Debugf("== [SKIP] # %s # (not a dependency)", file.Name)
+					continue
+				}
 			}
 			mt, isDir := getFileModTime(file.Name)
 			if file.Op == fsnotify.Create && isDir {
@@ -148,6 +196,29 @@ func (w *Watcher) Watch(ctx context.Context) (err error) {
 	}
 }
 
+// isEnvFile 是否是 EnvFiles 中的文件
+func (w *Watcher) isEnvFile(file string) bool {
+	if w.OnEnvChanged == nil {
+		return false
+	}
+	file, _ = filepath.Abs(file)
+	return slices.Contains(w.EnvFiles, file)
+}
+
+// reloadRule 返回文件匹配的软重载规则，没有时返回 nil
+func (w *Watcher) reloadRule(file string) *ReloadRule {
+	if w.OnlyWatchBin || w.OnReload == nil {
+		return nil
+	}
+	file = filepath.ToSlash(file)
+	for _, rule := range w.Reloads {
+		if rule.Pattern.MatchString(file) {
+			return rule
+		}
+	}
+	return nil
+}
+
 func (w *Watcher) dirsToWatch() (dirs []string) {
 	ignoredPathReg := regexp.MustCompile(w.IgnoredPathPattern)
 	matchedDirs := make(map[string]bool)
@@ -193,6 +264,10 @@ func (w *Watcher) dirsToWatch() (dirs []string) {
 		log.Debug("")
 		log.Debug("")
 	}
+	// .env 文件所在的目录可能不在 WatchedDir 中
+	for _, file := range w.EnvFiles {
+		matchedDirs[filepath.Dir(file)] = true
+	}
 	for dir := range matchedDirs {
 		dirs = append(dirs, dir)
 	}